@@ -1,3 +1,5 @@
 #!/usr/bin/env bash
 
-go build -o /tmp/tmp-api-ez-pwd/api_ez_pwd cmd/api_ez_pwd.go
+APP_VERSION=$(git describe --tags --always --dirty 2>/dev/null || echo dev)
+
+go build -ldflags "-X app-ez-pwd/internal/settings.AppVersion=${APP_VERSION}" -o /tmp/tmp-api-ez-pwd/api_ez_pwd cmd/api_ez_pwd.go
@@ -2,12 +2,20 @@ package main
 
 import (
 	"app-ez-pwd/internal/apis"
+	"app-ez-pwd/internal/auth"
+	"app-ez-pwd/internal/backups"
+	"app-ez-pwd/internal/events"
+	"app-ez-pwd/internal/jobs"
 	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/objectstore"
+	"app-ez-pwd/internal/secrets"
+	"app-ez-pwd/internal/sends"
 	"app-ez-pwd/internal/settings"
 	"app-ez-pwd/internal/storage"
 	"context"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"go.uber.org/zap"
 	"net/http"
 	"os"
 	"os/signal"
@@ -20,22 +28,68 @@ func main() {
 
 	storage.ApplicationDB = storage.PrepareApplicationDB(settings.Settings.DatabaseURL)
 
+	if settings.Settings.EventsBroker == "postgres" {
+		events.Hub = events.NewPostgresBroker(settings.Settings.DatabaseURL)
+	}
+
+	if settings.Settings.BackupSchedule.IntervalMinutes > 0 {
+		scheduler, err := backups.NewScheduler(settings.Settings.BackupSchedule)
+		if err != nil {
+			logger.Logger.Error("invalid BACKUP_SCHEDULE", zap.Error(err))
+			os.Exit(1)
+		}
+		backups.Schedule = scheduler
+		backups.Schedule.Start()
+	}
+
+	if settings.Settings.Attachments.Store.Enabled() {
+		attachmentStore, err := objectstore.New(settings.Settings.Attachments.Store)
+		if err != nil {
+			logger.Logger.Error("invalid ATTACHMENTS", zap.Error(err))
+			os.Exit(1)
+		}
+		secrets.AttachmentStore = attachmentStore
+	}
+
+	sendsCleanup := jobs.Start(sends.CleanupInterval, sends.Cleanup)
+	emergencyTimeouts := jobs.Start(secrets.EmergencyTimeoutInterval, secrets.ProcessEmergencyTimeouts)
+
 	e := echo.New()
+	e.HTTPErrorHandler = apis.HTTPErrorHandler
+	e.Use(middleware.RequestID())
 	e.Use(middleware.Logger())
 
+	e.POST("/api/v1/auth/prelogin", apis.PreloginPOST)
 	e.POST("/api/v1/auth", apis.DoAuthPOST)
 	e.DELETE("/api/v1/auth", apis.DoLogoutDELETE)
 	e.POST("/api/v1/create-account", apis.CreateNewAccountPOST)
+	e.POST("/api/v1/auth/recover/key", apis.RecoverKeyPOST)
+	e.POST("/api/v1/auth/recover", apis.RecoverAccountPOST)
+	e.GET("/api/v1/send/:sendId", apis.ViewSendGET)
 
 	apiV1 := e.Group("/api/v1")
 	apiV1.Use(apis.VerifyAuthTokenMiddleware(""))
+	apis.RouteAccountApiHandlers(apiV1)
 	apis.RouteUserSecretsApiHandlers(apiV1)
+	apis.RouteAttachmentsApiHandlers(apiV1)
+	apis.RouteSharesApiHandlers(apiV1)
+	apis.RouteOrganizationsApiHandlers(apiV1)
+	apis.RouteSendsApiHandlers(apiV1)
+	apis.RouteEmergencyApiHandlers(apiV1)
+
+	adminV1 := e.Group("/api/v1/admin")
+	adminV1.Use(apis.VerifyAuthTokenMiddleware(auth.UserTypeAdmin))
+	apis.RouteAdminApiHandlers(adminV1)
 
 	go func() {
 		signalStop := make(chan os.Signal, 1)
 		signal.Notify(signalStop, syscall.SIGTERM, syscall.SIGINT)
 		<-signalStop
 
+		events.Hub.Close() // ends the event streams, otherwise the shutdown waits for them
+		backups.Schedule.Stop()
+		sendsCleanup.Stop()
+		emergencyTimeouts.Stop()
 		if err := e.Shutdown(context.Background()); err != nil {
 			e.Logger.Fatal(err)
 		}
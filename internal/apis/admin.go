@@ -0,0 +1,27 @@
+package apis
+
+import (
+	"app-ez-pwd/internal/backups"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+func RouteAdminApiHandlers(group *echo.Group) {
+	group.GET("/backups/status", BackupsStatusGET)
+	group.POST("/backups/run", BackupsRunPOST)
+}
+
+func BackupsStatusGET(ctx echo.Context) error {
+	return ctx.JSON(http.StatusOK, backups.Schedule.Status())
+}
+
+// BackupsRunPOST starts a scheduled backup now, the result is in the status.
+func BackupsRunPOST(ctx echo.Context) error {
+	if backups.Schedule == nil {
+		return NewAPIError(http.StatusConflict, "backups_disabled", "the scheduled backups are disabled")
+	}
+	if !backups.Schedule.RunNow() {
+		return NewAPIError(http.StatusConflict, "backup_running", "a backup is already running")
+	}
+	return ctx.JSON(http.StatusAccepted, backups.Schedule.Status())
+}
@@ -0,0 +1,134 @@
+package apis
+
+import (
+	"app-ez-pwd/internal/secrets"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+)
+
+func RouteAttachmentsApiHandlers(group *echo.Group) {
+	group.GET("/user-secrets/:secretId/attachments", ListAttachmentsGET)
+	group.POST("/user-secrets/:secretId/attachments", NewAttachmentPOST)
+	group.GET("/user-secrets/:secretId/attachments/:attachmentId", DownloadAttachmentGET)
+	group.DELETE("/user-secrets/:secretId/attachments/:attachmentId", DeleteAttachmentDELETE)
+}
+
+var errAttachmentsDisabled = NewAPIError(http.StatusConflict, "attachments_disabled", "the attachments are disabled")
+
+func ListAttachmentsGET(ctx echo.Context) error {
+	if secrets.AttachmentStore == nil {
+		return errAttachmentsDisabled
+	}
+
+	secretId, err := strconv.ParseInt(ctx.Param("secretId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("secretId", "invalid id")
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	result, err := secrets.ListAttachmentsDB(userId, int(secretId))
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, result)
+}
+
+// NewAttachmentPOST uploads the file encrypted by the client, multipart form: file and fileNameEncrypted.
+func NewAttachmentPOST(ctx echo.Context) error {
+	if secrets.AttachmentStore == nil {
+		return errAttachmentsDisabled
+	}
+
+	secretId, err := strconv.ParseInt(ctx.Param("secretId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("secretId", "invalid id")
+	}
+
+	var form secrets.AttachmentForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	fileHeader, err := ctx.FormFile("file")
+	if err != nil {
+		return secrets.FieldError("file", "the file is required")
+	}
+
+	attachmentFile, err := fileHeader.Open()
+	if err != nil {
+		return err
+	}
+	defer attachmentFile.Close()
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	attachment, err := form.Save(userId, int(secretId), attachmentFile, fileHeader.Size)
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusCreated, attachment)
+}
+
+// DownloadAttachmentGET streams the encrypted content, the client decrypts it and the file name.
+func DownloadAttachmentGET(ctx echo.Context) error {
+	if secrets.AttachmentStore == nil {
+		return errAttachmentsDisabled
+	}
+
+	secretId, err := strconv.ParseInt(ctx.Param("secretId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("secretId", "invalid id")
+	}
+	attachmentId, err := strconv.ParseInt(ctx.Param("attachmentId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("attachmentId", "invalid id")
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	attachment, content, err := secrets.OpenAttachmentDB(userId, int(secretId), int(attachmentId))
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	response := ctx.Response()
+	response.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=attachment-%d.bin", attachment.Id))
+	response.Header().Set(echo.HeaderContentLength, strconv.FormatInt(attachment.Size, 10))
+	response.Header().Set(echo.HeaderCacheControl, "no-store")
+	response.Header().Set("X-Content-SHA256", attachment.SHA256)
+	return ctx.Stream(http.StatusOK, echo.MIMEOctetStream, content)
+}
+
+func DeleteAttachmentDELETE(ctx echo.Context) error {
+	if secrets.AttachmentStore == nil {
+		return errAttachmentsDisabled
+	}
+
+	secretId, err := strconv.ParseInt(ctx.Param("secretId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("secretId", "invalid id")
+	}
+	attachmentId, err := strconv.ParseInt(ctx.Param("attachmentId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("attachmentId", "invalid id")
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	if err = secrets.DeleteAttachmentDB(userId, int(secretId), int(attachmentId)); err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, map[string]string{})
+}
@@ -3,6 +3,7 @@ package apis
 import (
 	"app-ez-pwd/internal/auth"
 	"app-ez-pwd/internal/settings"
+	"errors"
 	"github.com/labstack/echo/v4"
 	"net/http"
 	"time"
@@ -11,18 +12,21 @@ import (
 func DoAuthPOST(ctx echo.Context) error {
 	var form auth.DoLoginForm
 	if err := ctx.Bind(&form); err != nil {
-		return ctx.JSON(http.StatusInternalServerError, err)
+		return err
 	}
 
 	if err := form.ValidateFront(); err != nil {
-		return ctx.JSON(http.StatusBadRequest, err)
+		return err
 	}
 
 	if formErrors := form.Validate(); len(formErrors) > 0 {
-		return ctx.JSON(http.StatusBadRequest, formErrors)
+		return FieldsError(formErrors)
 	}
 
-	strToken, _ := form.AuthToken()
+	strToken, err := form.AuthToken()
+	if err != nil {
+		return err
+	}
 
 	secure := !settings.Settings.Debug
 
@@ -48,10 +52,16 @@ func DoAuthPOST(ctx echo.Context) error {
 	tokenCookie.HttpOnly = true
 	tokenCookie.SameSite = http.SameSiteLaxMode
 
+	vaultKey, err := auth.GetVaultKeyDB(form.UserId)
+	if err != nil {
+		return err
+	}
+
 	ctx.SetCookie(userTypeCookie)
 	ctx.SetCookie(tokenCookie)
 
-	return ctx.JSON(http.StatusOK, map[string]string{})
+	ctx.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	return ctx.JSON(http.StatusOK, vaultKey)
 }
 
 func DoLogoutDELETE(ctx echo.Context) error {
@@ -88,20 +98,163 @@ func DoLogoutDELETE(ctx echo.Context) error {
 func CreateNewAccountPOST(ctx echo.Context) error {
 	var form auth.NewAccountForm
 	if err := ctx.Bind(&form); err != nil {
-		return ctx.JSON(http.StatusInternalServerError, err)
+		return err
 	}
 
 	if err := form.ValidateFront(); err != nil {
-		return ctx.JSON(http.StatusBadRequest, err)
+		return err
 	}
 
 	if formErrors := form.Validate(); len(formErrors) > 0 {
-		return ctx.JSON(http.StatusBadRequest, formErrors)
+		return FieldsError(formErrors)
 	}
 
 	if err := form.Save(); err != nil {
-		return ctx.JSON(http.StatusInternalServerError, err)
+		return err
 	}
 
 	return ctx.JSON(http.StatusCreated, map[string]string{})
 }
+
+func RouteAccountApiHandlers(group *echo.Group) {
+	group.PUT("/password", ChangePasswordPUT)
+	group.PUT("/vault-key", MigrateVaultKeyPUT)
+	group.PUT("/recovery-key", SaveRecoveryKeyPUT)
+}
+
+// ChangePasswordPUT changes the login hash, the secrets don't change: only the vault key is encrypted again.
+func ChangePasswordPUT(ctx echo.Context) error {
+	var form auth.ChangePasswordForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	if formErrors := form.Validate(userId); len(formErrors) > 0 {
+		return FieldsError(formErrors)
+	}
+
+	if err := form.Save(userId); err != nil {
+		if errors.Is(err, auth.ErrVaultKeyMigration) {
+			return NewAPIError(http.StatusConflict, "vault_key_migration_required", err.Error())
+		}
+		return err
+	}
+	return ctx.JSON(http.StatusOK, map[string]string{})
+}
+
+// MigrateVaultKeyPUT sets the vault key of an account without it and saves its secrets encrypted with it,
+// all or nothing.
+func MigrateVaultKeyPUT(ctx echo.Context) error {
+	var form auth.MigrateVaultKeyForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	if formErrors := form.Validate(userId); len(formErrors) > 0 {
+		return FieldsError(formErrors)
+	}
+
+	if err := form.Save(userId); err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, map[string]string{})
+}
+
+// SaveRecoveryKeyPUT sets or replaces the recovery key, the account must have the vault key.
+func SaveRecoveryKeyPUT(ctx echo.Context) error {
+	var form auth.RecoveryKeyForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	if err := form.Save(userId); err != nil {
+		if errors.Is(err, auth.ErrVaultKeyRequired) {
+			return NewAPIError(http.StatusConflict, "vault_key_required", err.Error())
+		}
+		return err
+	}
+	return ctx.JSON(http.StatusOK, map[string]string{})
+}
+
+// RecoverKeyPOST answers the vault key encrypted with the recovery key when the proof is valid.
+func RecoverKeyPOST(ctx echo.Context) error {
+	var form auth.RecoverKeyForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	if formErrors := form.Validate(); len(formErrors) > 0 {
+		return FieldsError(formErrors)
+	}
+
+	ctx.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	return ctx.JSON(http.StatusOK, map[string]interface{}{"recoveryWrappedKey": form.RecoveryWrappedKey})
+}
+
+// RecoverAccountPOST replaces the forgotten password: the proof of the recovery key, the new login hash
+// and the vault key encrypted with the new password key.
+func RecoverAccountPOST(ctx echo.Context) error {
+	var form auth.RecoverAccountForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	if formErrors := form.Validate(); len(formErrors) > 0 {
+		return FieldsError(formErrors)
+	}
+
+	if err := form.Save(); err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, map[string]string{})
+}
+
+// PreloginPOST answers the kdf params of the user, the client derives the password key with them.
+func PreloginPOST(ctx echo.Context) error {
+	var form auth.PreloginForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	prelogin, err := form.Prelogin()
+	if errors.Is(err, auth.ErrUsernameNotFound) {
+		return FieldsError(map[string]string{"username": err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, prelogin)
+}
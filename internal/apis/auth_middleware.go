@@ -10,6 +10,12 @@ import (
 	"net/http"
 )
 
+var (
+	errUnauthorized = NewAPIError(http.StatusUnauthorized, "unauthorized", "not authenticated")
+	errForbidden    = NewAPIError(http.StatusForbidden, "forbidden", "not allowed for this user")
+)
+
+// VerifyAuthTokenMiddleware checks the token cookie, with userType (ex: auth.UserTypeAdmin) only that type is allowed.
 func VerifyAuthTokenMiddleware(userType string) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(ctx echo.Context) error {
@@ -17,22 +23,21 @@ func VerifyAuthTokenMiddleware(userType string) echo.MiddlewareFunc {
 			if err != nil {
 				if err == http.ErrNoCookie {
 					logger.Logger.Warn("request doesn't have the token")
-					return ctx.JSON(http.StatusUnauthorized, map[string]string{})
+					return errUnauthorized
 				}
 				return err
 			}
 
-			tokenUserId, err := evaluateCookieToken(cookieToken.Value)
+			tokenUserId, tokenUserType, err := evaluateCookieToken(cookieToken.Value)
 			if err != nil {
 				logger.Logger.Warn("invalid token", zap.Error(err))
-				return err
+				return errUnauthorized
 			}
 
-			/*
-				// TODO: handle user type, ex: ADMIN
-					if tokenUserType != userType {
-						return ctx.JSON(http.StatusForbidden, map[string]string{})
-					}*/
+			if userType != "" && tokenUserType != userType {
+				logger.Logger.Warn("forbidden user type", zap.Int("userId", tokenUserId), zap.String("userType", tokenUserType))
+				return errForbidden
+			}
 
 			ctx.Set("userId", tokenUserId)
 
@@ -41,7 +46,7 @@ func VerifyAuthTokenMiddleware(userType string) echo.MiddlewareFunc {
 	}
 }
 
-func evaluateCookieToken(strToken string) (userId int, err error) {
+func evaluateCookieToken(strToken string) (userId int, userType string, err error) {
 	tokenParser, err := jwt.Parse(strToken, func(token *jwt.Token) (interface{}, error) {
 		if token.Method.Alg() != "HS256" {
 			return nil, errors.New("invalid sign method")
@@ -50,17 +55,19 @@ func evaluateCookieToken(strToken string) (userId int, err error) {
 	})
 
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 
 	if tokenParser.Valid {
 		if claims, ok := tokenParser.Claims.(jwt.MapClaims); ok {
 			rawUserId, _ := claims["id"].(float64)
 			userId = int(rawUserId)
+			// the tokens signed before the user types don't have the claim
+			userType, _ = claims["userType"].(string)
 
-			return userId, nil
+			return userId, userType, nil
 		}
 	}
 
-	return 0, errors.New("not authenticated")
+	return 0, "", errors.New("not authenticated")
 }
@@ -0,0 +1,138 @@
+package apis
+
+import (
+	"app-ez-pwd/internal/secrets"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+)
+
+func RouteEmergencyApiHandlers(group *echo.Group) {
+	group.GET("/emergency-access", ListEmergencyAccessGET)
+	group.POST("/emergency-access", GrantEmergencyAccessPOST)
+	group.DELETE("/emergency-access/:accessId", RevokeEmergencyAccessDELETE)
+	group.POST("/emergency-access/:accessId/request", RequestEmergencyAccessPOST)
+	group.POST("/emergency-access/:accessId/approve", ApproveEmergencyAccessPOST)
+	group.POST("/emergency-access/:accessId/reject", RejectEmergencyAccessPOST)
+	group.GET("/emergency-access/:accessId/vault", EmergencyVaultGET)
+	group.GET("/emergency-access/:accessId/audit", EmergencyAuditGET)
+}
+
+func ListEmergencyAccessGET(ctx echo.Context) error {
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	result, err := secrets.ListEmergencyAccessDB(userId)
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, result)
+}
+
+// GrantEmergencyAccessPOST adds the trusted contact with the vault key wrapped by the client with the contact public key.
+func GrantEmergencyAccessPOST(ctx echo.Context) error {
+	var form secrets.EmergencyAccessForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	access, err := form.Save(userId)
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusCreated, access)
+}
+
+func RevokeEmergencyAccessDELETE(ctx echo.Context) error {
+	accessId, err := strconv.ParseInt(ctx.Param("accessId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("accessId", "invalid id")
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	if err = secrets.RevokeEmergencyAccessDB(userId, int(accessId)); err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, map[string]string{})
+}
+
+func RequestEmergencyAccessPOST(ctx echo.Context) error {
+	accessId, err := strconv.ParseInt(ctx.Param("accessId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("accessId", "invalid id")
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	if err = secrets.RequestEmergencyAccessDB(userId, int(accessId)); err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, map[string]string{})
+}
+
+func ApproveEmergencyAccessPOST(ctx echo.Context) error {
+	return decideEmergencyAccess(ctx, true)
+}
+
+func RejectEmergencyAccessPOST(ctx echo.Context) error {
+	return decideEmergencyAccess(ctx, false)
+}
+
+func decideEmergencyAccess(ctx echo.Context, approve bool) error {
+	accessId, err := strconv.ParseInt(ctx.Param("accessId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("accessId", "invalid id")
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	if err = secrets.DecideEmergencyAccessDB(userId, int(accessId), approve); err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, map[string]string{})
+}
+
+// EmergencyVaultGET returns the vault of the grantor to the grantee once the access is approved.
+func EmergencyVaultGET(ctx echo.Context) error {
+	accessId, err := strconv.ParseInt(ctx.Param("accessId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("accessId", "invalid id")
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	vault, err := secrets.GetEmergencyVaultDB(userId, int(accessId))
+	if err != nil {
+		return err
+	}
+	ctx.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	return ctx.JSON(http.StatusOK, vault)
+}
+
+func EmergencyAuditGET(ctx echo.Context) error {
+	accessId, err := strconv.ParseInt(ctx.Param("accessId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("accessId", "invalid id")
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	entries, err := secrets.ListEmergencyAuditDB(userId, int(accessId))
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, entries)
+}
@@ -0,0 +1,190 @@
+package apis
+
+import (
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/secrets"
+	"errors"
+	"fmt"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+// APIError is the error returned by the handlers, HTTPErrorHandler renders it as the error envelope.
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+	Fields  map[string]string
+	Current interface{} // the server copy on conflicts
+	Err     error       // internal cause, it's logged and never sent to the client
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%d %s: %s: %v", e.Status, e.Code, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+func NewAPIError(status int, code, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+// FieldsError is the 400 for the forms that return their errors as map, ex: auth.DoLoginForm.Validate
+func FieldsError(fields map[string]string) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: "validation", Message: "invalid fields", Fields: fields}
+}
+
+type errorEnvelope struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code      string            `json:"code"`
+	Message   string            `json:"message"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	RequestId string            `json:"requestId,omitempty"`
+	Current   interface{}       `json:"current,omitempty"`
+}
+
+var secretsErrorStatus = map[secrets.ErrorKind]int{
+	secrets.KindNotFound:   http.StatusNotFound,
+	secrets.KindConflict:   http.StatusConflict,
+	secrets.KindForbidden:  http.StatusForbidden,
+	secrets.KindValidation: http.StatusBadRequest,
+	secrets.KindQuota:      http.StatusRequestEntityTooLarge,
+	secrets.KindInternal:   http.StatusInternalServerError,
+}
+
+// HTTPErrorHandler is the echo.HTTPErrorHandler of the api, every error is sent as:
+// {"error": {"code": "", "message": "", "fields": {}, "requestId": ""}}
+func HTTPErrorHandler(err error, ctx echo.Context) {
+	if ctx.Response().Committed {
+		logger.Logger.Error("error after the response was sent", zap.Error(err))
+		return
+	}
+
+	apiErr := toAPIError(ctx, err)
+	if apiErr.Status >= http.StatusInternalServerError {
+		logger.Logger.Error("internal error",
+			zap.String("path", ctx.Path()),
+			zap.String("requestId", requestId(ctx)),
+			zap.Error(err))
+	}
+
+	if ctx.Request().Method == http.MethodHead {
+		err = ctx.NoContent(apiErr.Status)
+	} else {
+		err = ctx.JSON(apiErr.Status, errorEnvelope{Error: errorBody{
+			Code:      apiErr.Code,
+			Message:   apiErr.Message,
+			Fields:    apiErr.Fields,
+			RequestId: requestId(ctx),
+			Current:   apiErr.Current,
+		}})
+	}
+	if err != nil {
+		logger.Logger.Error("err sending error response", zap.Error(err))
+	}
+}
+
+func toAPIError(ctx echo.Context, err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var secretsErr *secrets.Error
+	if errors.As(err, &secretsErr) {
+		return secretsAPIError(ctx, secretsErr)
+	}
+
+	var validationErrors validation.Errors
+	if errors.As(err, &validationErrors) {
+		fields := make(map[string]string)
+		flattenValidationErrors("", validationErrors, fields)
+		return FieldsError(fields)
+	}
+
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		message := http.StatusText(httpErr.Code)
+		if rawMessage, ok := httpErr.Message.(string); ok && httpErr.Code < http.StatusInternalServerError {
+			message = rawMessage
+		}
+		return &APIError{Status: httpErr.Code, Code: statusCode(httpErr.Code), Message: message, Err: err}
+	}
+
+	return &APIError{Status: http.StatusInternalServerError, Code: "internal", Message: "internal error", Err: err}
+}
+
+func secretsAPIError(ctx echo.Context, secretsErr *secrets.Error) *APIError {
+	apiErr := &APIError{
+		Status:  secretsErrorStatus[secretsErr.Kind],
+		Code:    string(secretsErr.Kind),
+		Message: secretsErr.Message,
+		Fields:  secretsErr.Fields,
+		Err:     secretsErr,
+	}
+	if secretsErr.Current != nil {
+		apiErr.Current = secretsErr.Current
+		setSecretETag(ctx, secretsErr.Version)
+	}
+	return apiErr
+}
+
+// versionedError is for the writes with a version precondition:
+// the conflict is 412 when the version came in the If-Match header.
+func versionedError(ctx echo.Context, err error, fromHeader bool) error {
+	var secretsErr *secrets.Error
+	if fromHeader && errors.As(err, &secretsErr) && secretsErr.Kind == secrets.KindConflict && secretsErr.Current != nil {
+		setSecretETag(ctx, secretsErr.Version)
+		return &APIError{
+			Status:  http.StatusPreconditionFailed,
+			Code:    "precondition_failed",
+			Message: secretsErr.Message,
+			Current: secretsErr.Current,
+			Err:     err,
+		}
+	}
+	return err
+}
+
+// flattenValidationErrors joins the nested fields with a dot, ex: passwordEncrypted.iv
+func flattenValidationErrors(prefix string, validationErrors validation.Errors, fields map[string]string) {
+	for name, fieldErr := range validationErrors {
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		var nestedErrors validation.Errors
+		if errors.As(fieldErr, &nestedErrors) {
+			flattenValidationErrors(name, nestedErrors, fields)
+		} else {
+			fields[name] = fieldErr.Error()
+		}
+	}
+}
+
+// statusCode is the envelope code for the echo errors, ex: 405 -> method_not_allowed
+func statusCode(status int) string {
+	if status >= http.StatusInternalServerError {
+		return "internal"
+	}
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ReplaceAll(strings.ToLower(text), " ", "_")
+}
+
+func requestId(ctx echo.Context) string {
+	return ctx.Response().Header().Get(echo.HeaderXRequestID)
+}
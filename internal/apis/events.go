@@ -0,0 +1,60 @@
+package apis
+
+import (
+	"app-ez-pwd/internal/events"
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"time"
+)
+
+// eventsHeartbeat keeps the stream open behind proxies that close idle connections.
+const eventsHeartbeat = 25 * time.Second
+
+// EventsStreamGET sends the changes of the user vault as server-sent events:
+//
+//	event: secret.updated
+//	data: {"type":"secret.updated","userId":1,"id":10,"version":3}
+func EventsStreamGET(ctx echo.Context) error {
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	userEvents, cancel := events.Hub.Subscribe(userId)
+	defer cancel()
+
+	response := ctx.Response()
+	response.Header().Set(echo.HeaderContentType, "text/event-stream")
+	response.Header().Set(echo.HeaderCacheControl, "no-cache")
+	response.Header().Set(echo.HeaderConnection, "keep-alive")
+	response.Header().Set("X-Accel-Buffering", "no")
+	response.WriteHeader(http.StatusOK)
+
+	if _, err := fmt.Fprint(response, ": connected\n\n"); err != nil {
+		return nil
+	}
+	response.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Request().Context().Done():
+			return nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(response, ": heartbeat\n\n"); err != nil {
+				return nil
+			}
+		case event, ok := <-userEvents:
+			if !ok {
+				return nil
+			}
+			data, _ := json.Marshal(event)
+			if _, err := fmt.Fprintf(response, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return nil
+			}
+		}
+		response.Flush()
+	}
+}
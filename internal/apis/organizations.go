@@ -0,0 +1,293 @@
+package apis
+
+import (
+	"app-ez-pwd/internal/secrets"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+)
+
+func RouteOrganizationsApiHandlers(group *echo.Group) {
+	group.GET("/organizations", ListOrganizationsGET)
+	group.POST("/organizations", NewOrganizationPOST)
+
+	group.GET("/organizations/:organizationId/members", ListOrganizationMembersGET)
+	group.POST("/organizations/:organizationId/members", AddOrganizationMemberPOST)
+	group.PUT("/organizations/:organizationId/members/:memberId", ChangeOrganizationMemberPUT)
+	group.DELETE("/organizations/:organizationId/members/:memberId", RemoveOrganizationMemberDELETE)
+
+	group.POST("/organizations/:organizationId/categories", NewOrganizationCategoryPOST)
+	group.POST("/organizations/:organizationId/secrets", NewOrganizationSecretPOST)
+	group.GET("/organizations/:organizationId/secrets/:secretId", GetOrganizationSecretGET)
+	group.PUT("/organizations/:organizationId/secrets/:secretId", UpdateOrganizationSecretPUT)
+	group.DELETE("/organizations/:organizationId/secrets/:secretId", DeleteOrganizationSecretDELETE)
+}
+
+func ListOrganizationsGET(ctx echo.Context) error {
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	organizations, err := secrets.ListOrganizationsDB(userId)
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, organizations)
+}
+
+// NewOrganizationPOST creates the organization, the user is the owner.
+func NewOrganizationPOST(ctx echo.Context) error {
+	var form secrets.OrganizationForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	organization, err := form.Save(userId)
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusCreated, organization)
+}
+
+func ListOrganizationMembersGET(ctx echo.Context) error {
+	organizationId, err := strconv.ParseInt(ctx.Param("organizationId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("organizationId", "invalid id")
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	members, err := secrets.ListOrganizationMembersDB(userId, int(organizationId))
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, members)
+}
+
+// AddOrganizationMemberPOST adds the user with the org key wrapped by the client with the user public key.
+func AddOrganizationMemberPOST(ctx echo.Context) error {
+	organizationId, err := strconv.ParseInt(ctx.Param("organizationId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("organizationId", "invalid id")
+	}
+
+	var form secrets.OrganizationMemberForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	member, err := form.Save(userId, int(organizationId))
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusCreated, member)
+}
+
+func ChangeOrganizationMemberPUT(ctx echo.Context) error {
+	organizationId, err := strconv.ParseInt(ctx.Param("organizationId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("organizationId", "invalid id")
+	}
+	memberId, err := strconv.ParseInt(ctx.Param("memberId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("memberId", "invalid id")
+	}
+
+	var form secrets.OrganizationMemberRoleForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	if err = secrets.ChangeOrganizationMemberDB(userId, int(organizationId), int(memberId), form.Role); err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, map[string]string{})
+}
+
+// RemoveOrganizationMemberDELETE removes the member, with the id of the user it leaves the organization.
+func RemoveOrganizationMemberDELETE(ctx echo.Context) error {
+	organizationId, err := strconv.ParseInt(ctx.Param("organizationId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("organizationId", "invalid id")
+	}
+	memberId, err := strconv.ParseInt(ctx.Param("memberId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("memberId", "invalid id")
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	if err = secrets.ChangeOrganizationMemberDB(userId, int(organizationId), int(memberId), ""); err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, map[string]string{})
+}
+
+func NewOrganizationCategoryPOST(ctx echo.Context) error {
+	organizationId, err := strconv.ParseInt(ctx.Param("organizationId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("organizationId", "invalid id")
+	}
+
+	var form secrets.OrganizationCategoryForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	category, err := secrets.CreateOrganizationCategoryDB(userId, int(organizationId), form.Name)
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusCreated, category)
+}
+
+// NewOrganizationSecretPOST saves the secret encrypted by the client with the org key.
+func NewOrganizationSecretPOST(ctx echo.Context) error {
+	organizationId, err := strconv.ParseInt(ctx.Param("organizationId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("organizationId", "invalid id")
+	}
+
+	var form secrets.UserSecretForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	newSecretId, err := form.SaveOrganization(userId, int(organizationId))
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusCreated, map[string]int{"id": newSecretId})
+}
+
+func GetOrganizationSecretGET(ctx echo.Context) error {
+	organizationId, err := strconv.ParseInt(ctx.Param("organizationId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("organizationId", "invalid id")
+	}
+	secretId, err := strconv.ParseInt(ctx.Param("secretId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("secretId", "invalid id")
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	theSecret, err := secrets.GetOrganizationSecretDB(userId, int(organizationId), int(secretId))
+	if err != nil {
+		return err
+	}
+	setSecretETag(ctx, theSecret.Version)
+	return ctx.JSON(http.StatusOK, theSecret)
+}
+
+func UpdateOrganizationSecretPUT(ctx echo.Context) error {
+	organizationId, err := strconv.ParseInt(ctx.Param("organizationId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("organizationId", "invalid id")
+	}
+	secretId, err := strconv.ParseInt(ctx.Param("secretId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("secretId", "invalid id")
+	}
+
+	var form secrets.UpdateUserSecretForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+	form.Id = int(secretId)
+
+	headerVersion, fromHeader, err := ifMatchVersion(ctx)
+	if err != nil {
+		return secrets.FieldError("If-Match", err.Error())
+	}
+	if fromHeader {
+		form.Version = headerVersion
+	}
+	if form.Version == 0 {
+		return errVersionRequired
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	newVersion, err := form.UpdateOrganization(userId, int(organizationId))
+	if err != nil {
+		return versionedError(ctx, err, fromHeader)
+	}
+
+	setSecretETag(ctx, newVersion)
+	return ctx.JSON(http.StatusOK, map[string]int{"version": newVersion})
+}
+
+func DeleteOrganizationSecretDELETE(ctx echo.Context) error {
+	organizationId, err := strconv.ParseInt(ctx.Param("organizationId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("organizationId", "invalid id")
+	}
+	secretId, err := strconv.ParseInt(ctx.Param("secretId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("secretId", "invalid id")
+	}
+
+	version, fromHeader, err := ifMatchVersion(ctx)
+	if err != nil {
+		return secrets.FieldError("If-Match", err.Error())
+	}
+	if !fromHeader {
+		rawVersion, _ := strconv.ParseInt(ctx.QueryParam("version"), 10, 32)
+		version = int(rawVersion)
+	}
+	if version == 0 {
+		return errVersionRequired
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	err = secrets.DeleteOrganizationSecretDB(userId, int(organizationId), int(secretId), version)
+	if err != nil {
+		return versionedError(ctx, err, fromHeader)
+	}
+	return ctx.JSON(http.StatusOK, map[string]string{})
+}
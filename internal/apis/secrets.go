@@ -1,11 +1,15 @@
 package apis
 
 import (
+	"app-ez-pwd/internal/logger"
 	"app-ez-pwd/internal/secrets"
+	"errors"
 	"fmt"
 	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 func RouteUserSecretsApiHandlers(group *echo.Group) {
@@ -14,16 +18,31 @@ func RouteUserSecretsApiHandlers(group *echo.Group) {
 	group.GET("/user-secrets/:secretId", GetTheUserSecretGET)
 	group.POST("/user-secrets", NewUserSecretPOST)
 	group.PUT("/user-secrets", UpdateUserSecretsPUT)
+	group.PATCH("/user-secrets/:secretId", PatchUserSecretPATCH)
 	group.DELETE("/user-secrets/:secretId", DeleteUserSecretDELETE)
+	group.POST("/user-secrets/bulk", BulkUserSecretsPOST)
+	group.POST("/user-secrets/import/parse", ImportParsePOST)
+	group.POST("/user-secrets/import", ImportUserSecretsPOST)
+	group.GET("/user-secrets/export", ExportUserSecretsGET)
 
 	group.GET("/user-secrets/backup", GenerateBackupUserSecretsGET)
+	group.POST("/user-secrets/restore", RestoreUserSecretsPOST)
+	group.GET("/user-secrets/backup/key", GetBackupPublicKeyGET)
+	group.PUT("/user-secrets/backup/key", SaveBackupPublicKeyPUT)
+	group.DELETE("/user-secrets/backup/key", DeleteBackupPublicKeyDELETE)
+
+	group.GET("/sync", SyncGET)
+	group.GET("/events", EventsStreamGET)
 }
 
 func ListCategorySecretsGET(ctx echo.Context) error {
 	rawUserId := ctx.Get("userId")
 	userId, _ := rawUserId.(int)
 
-	items, _ := secrets.ListCategorySecretsDB(userId)
+	items, err := secrets.ListCategorySecretsDB(userId)
+	if err != nil {
+		return err
+	}
 	return ctx.JSON(http.StatusOK, items)
 }
 
@@ -34,9 +53,14 @@ func ListUserSecretsGET(ctx echo.Context) error {
 	rawCategoryId := ctx.QueryParam("categoryId")
 	categoryId, _ := strconv.ParseInt(rawCategoryId, 10, 32)
 
-	itemsUserSecrets, err := secrets.ListUserSecretDB(userId, int(categoryId))
+	itemType := ctx.QueryParam("type")
+	if err := secrets.ValidateItemType(itemType); err != nil {
+		return err
+	}
+
+	itemsUserSecrets, err := secrets.ListUserSecretDB(userId, int(categoryId), itemType)
 	if err != nil {
-		return ctx.JSON(http.StatusInternalServerError, err)
+		return err
 	}
 	return ctx.JSON(http.StatusOK, itemsUserSecrets)
 }
@@ -46,24 +70,28 @@ func GetTheUserSecretGET(ctx echo.Context) error {
 
 	secretId, err := strconv.ParseInt(rawSecretId, 10, 32)
 	if err != nil {
-		return ctx.JSON(http.StatusBadRequest, err)
+		return secrets.FieldError("secretId", "invalid id")
 	}
 
 	rawUserId := ctx.Get("userId")
 	userId, _ := rawUserId.(int)
 
-	theSecret, _ := secrets.GetUserSecretByIdDB(userId, int(secretId))
+	theSecret, err := secrets.GetUserSecretByIdDB(userId, int(secretId))
+	if err != nil {
+		return err
+	}
+	setSecretETag(ctx, theSecret.Version)
 	return ctx.JSON(http.StatusOK, theSecret)
 }
 
 func NewUserSecretPOST(ctx echo.Context) error {
 	var form secrets.UserSecretForm
 	if err := ctx.Bind(&form); err != nil {
-		return ctx.JSON(http.StatusInternalServerError, err)
+		return err
 	}
 
 	if err := form.ValidateFront(); err != nil {
-		return ctx.JSON(http.StatusBadRequest, err)
+		return err
 	}
 
 	rawUserId := ctx.Get("userId")
@@ -71,7 +99,7 @@ func NewUserSecretPOST(ctx echo.Context) error {
 
 	newSecretId, err := form.Save(userId)
 	if err != nil {
-		return ctx.JSON(http.StatusInternalServerError, err)
+		return err
 	}
 
 	return ctx.JSON(http.StatusCreated, map[string]int{"id": newSecretId})
@@ -80,22 +108,74 @@ func NewUserSecretPOST(ctx echo.Context) error {
 func UpdateUserSecretsPUT(ctx echo.Context) error {
 	var form secrets.UpdateUserSecretForm
 	if err := ctx.Bind(&form); err != nil {
-		return ctx.JSON(http.StatusInternalServerError, err)
+		return err
+	}
+
+	headerVersion, fromHeader, err := ifMatchVersion(ctx)
+	if err != nil {
+		return secrets.FieldError("If-Match", err.Error())
+	}
+	if fromHeader {
+		form.Version = headerVersion
+	}
+	if form.Version == 0 {
+		return errVersionRequired
 	}
 
 	if err := form.ValidateFront(); err != nil {
-		return ctx.JSON(http.StatusBadRequest, err)
+		return err
 	}
 
 	rawUserId := ctx.Get("userId")
 	userId, _ := rawUserId.(int)
 
-	err := form.Update(userId)
+	newVersion, err := form.Update(userId)
 	if err != nil {
-		return ctx.JSON(http.StatusInternalServerError, err)
+		return versionedError(ctx, err, fromHeader)
 	}
 
-	return ctx.JSON(http.StatusOK, map[string]string{})
+	setSecretETag(ctx, newVersion)
+	return ctx.JSON(http.StatusOK, map[string]int{"version": newVersion})
+}
+
+func PatchUserSecretPATCH(ctx echo.Context) error {
+	rawSecretId := ctx.Param("secretId")
+
+	secretId, err := strconv.ParseInt(rawSecretId, 10, 32)
+	if err != nil {
+		return secrets.FieldError("secretId", "invalid id")
+	}
+
+	var form secrets.PatchUserSecretForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	headerVersion, fromHeader, err := ifMatchVersion(ctx)
+	if err != nil {
+		return secrets.FieldError("If-Match", err.Error())
+	}
+	if fromHeader {
+		form.Version = headerVersion
+	}
+	if form.Version == 0 {
+		return errVersionRequired
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	newVersion, err := form.Patch(userId, int(secretId))
+	if err != nil {
+		return versionedError(ctx, err, fromHeader)
+	}
+
+	setSecretETag(ctx, newVersion)
+	return ctx.JSON(http.StatusOK, map[string]int{"version": newVersion})
 }
 
 func DeleteUserSecretDELETE(ctx echo.Context) error {
@@ -103,26 +183,273 @@ func DeleteUserSecretDELETE(ctx echo.Context) error {
 
 	secretId, err := strconv.ParseInt(rawSecretId, 10, 32)
 	if err != nil {
-		return ctx.JSON(http.StatusBadRequest, err)
+		return secrets.FieldError("secretId", "invalid id")
+	}
+
+	version, fromHeader, err := ifMatchVersion(ctx)
+	if err != nil {
+		return secrets.FieldError("If-Match", err.Error())
+	}
+	if !fromHeader {
+		rawVersion, _ := strconv.ParseInt(ctx.QueryParam("version"), 10, 32)
+		version = int(rawVersion)
+	}
+	if version == 0 {
+		return errVersionRequired
 	}
 
 	rawUserId := ctx.Get("userId")
 	userId, _ := rawUserId.(int)
 
-	err = secrets.DeleteUserSecretDB(userId, int(secretId))
+	err = secrets.DeleteUserSecretDB(userId, int(secretId), version)
 	if err != nil {
-		return ctx.JSON(http.StatusInternalServerError, err)
+		return versionedError(ctx, err, fromHeader)
 	}
 
 	return ctx.JSON(http.StatusOK, map[string]string{})
 }
 
+func BulkUserSecretsPOST(ctx echo.Context) error {
+	var form secrets.BulkUserSecretsForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	results, err := form.Apply(userId)
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, map[string][]secrets.BulkItemResultModel{"results": results})
+}
+
+// ImportParsePOST reads the export of other password manager, multipart form: file and format.
+// The answer has the plaintext items for the client encryption, nothing is saved.
+func ImportParsePOST(ctx echo.Context) error {
+	var form secrets.ImportParseForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	fileHeader, err := ctx.FormFile("file")
+	if err != nil {
+		return secrets.FieldError("file", "the export file is required")
+	}
+
+	exportFile, err := fileHeader.Open()
+	if err != nil {
+		return err
+	}
+	defer exportFile.Close()
+
+	result, err := form.Parse(exportFile)
+	if err != nil {
+		return err
+	}
+
+	ctx.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	return ctx.JSON(http.StatusOK, result)
+}
+
+// ImportUserSecretsPOST saves the items of the import encrypted by the client in one transaction.
+func ImportUserSecretsPOST(ctx echo.Context) error {
+	var form secrets.ImportUserSecretsForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	result, err := form.Import(userId)
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusCreated, result)
+}
+
+// ExportUserSecretsGET exports for other password managers, ?format=bitwarden-json or keepass-xml,
+// the client decrypts the ezPwd fields before the import in the other manager.
+func ExportUserSecretsGET(ctx echo.Context) error {
+	form := secrets.ExportUserSecretsForm{Format: ctx.QueryParam("format")}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	export, err := secrets.OpenUserSecretsExport(userId, form.Format)
+	if err != nil {
+		return err
+	}
+
+	contentType := echo.MIMEApplicationJSONCharsetUTF8
+	if form.Format == secrets.ExportKeePassXML {
+		contentType = echo.MIMEApplicationXMLCharsetUTF8
+	}
+
+	response := ctx.Response()
+	response.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", export.FileName))
+	response.Header().Set(echo.HeaderCacheControl, "no-store")
+	response.Header().Set(echo.HeaderContentType, contentType)
+	response.WriteHeader(http.StatusOK)
+
+	if err = export.Write(response); err != nil {
+		// the status was sent: abort the connection so the client doesn't import a truncated export
+		logger.Logger.Error("err streaming export", zap.Int("userId", userId), zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+// GenerateBackupUserSecretsGET downloads the backup zip, ?encryption=passphrase (with the X-Backup-Passphrase header)
+// or ?encryption=publicKey wraps it for the restore with the same passphrase or the private key.
 func GenerateBackupUserSecretsGET(ctx echo.Context) error {
+	form := secrets.BackupExportForm{
+		Encryption:       ctx.QueryParam("encryption"),
+		Passphrase:       ctx.Request().Header.Get("X-Backup-Passphrase"),
+		ExcludeLoginHash: ctx.QueryParam("excludeLoginHash") == "true",
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	export, err := form.Open(userId)
+	if err != nil {
+		return err
+	}
+	defer export.Close()
+
+	contentType, fileName := "application/zip", fmt.Sprintf("the-%s-secrets.zip", export.Username)
+	if export.Encrypted() {
+		contentType, fileName = "application/octet-stream", fileName+".ezpwd"
+	}
+
+	response := ctx.Response()
+	response.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fileName))
+	response.Header().Set(echo.HeaderContentType, contentType)
+	response.WriteHeader(http.StatusOK)
+
+	if err = export.Write(response); err != nil {
+		// the status was sent: abort the connection so the client doesn't keep a truncated backup as valid
+		logger.Logger.Error("err streaming backup", zap.Int("userId", userId), zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+func GetBackupPublicKeyGET(ctx echo.Context) error {
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	publicKey, err := secrets.GetBackupPublicKeyDB(userId)
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, map[string]string{"publicKey": publicKey})
+}
+
+func SaveBackupPublicKeyPUT(ctx echo.Context) error {
+	var form secrets.BackupPublicKeyForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
 	rawUserId := ctx.Get("userId")
 	userId, _ := rawUserId.(int)
 
-	username, byteSecrets := secrets.QueryUserSecretsForExportAsBackup(userId)
+	if err := form.Save(userId); err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, map[string]string{})
+}
+
+func DeleteBackupPublicKeyDELETE(ctx echo.Context) error {
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	if err := secrets.SaveBackupPublicKeyDB(userId, ""); err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, map[string]string{})
+}
+
+var errVersionRequired = NewAPIError(http.StatusPreconditionRequired, "precondition_required", "If-Match header or version is required")
+
+// setSecretETag exposes the secret version as ETag, clients send it back in If-Match.
+func setSecretETag(ctx echo.Context, version int) {
+	ctx.Response().Header().Set("ETag", fmt.Sprintf(`"%d"`, version))
+}
+
+// ifMatchVersion parses the If-Match header, ex: "3" or W/"3".
+func ifMatchVersion(ctx echo.Context) (version int, present bool, err error) {
+	rawIfMatch := strings.TrimSpace(ctx.Request().Header.Get("If-Match"))
+	if rawIfMatch == "" {
+		return 0, false, nil
+	}
+
+	rawIfMatch = strings.Trim(strings.TrimPrefix(rawIfMatch, "W/"), `"`)
+	parsedVersion, err := strconv.ParseInt(rawIfMatch, 10, 32)
+	if err != nil || parsedVersion <= 0 {
+		return 0, true, errors.New("invalid version")
+	}
+	return int(parsedVersion), true, nil
+}
 
-	ctx.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=the-%s-secrets.zip", username))
-	return ctx.Blob(http.StatusOK, "application/zip", byteSecrets)
+// RestoreUserSecretsPOST restores the backup, multipart form: file, mode (merge or replace)
+// and passphrase or privateKey for the encrypted backup.
+func RestoreUserSecretsPOST(ctx echo.Context) error {
+	var form secrets.RestoreBackupForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	fileHeader, err := ctx.FormFile("file")
+	if err != nil {
+		return secrets.FieldError("file", "the backup zip is required")
+	}
+
+	backupFile, err := fileHeader.Open()
+	if err != nil {
+		return err
+	}
+	defer backupFile.Close()
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	result, err := form.Restore(userId, backupFile, fileHeader.Size)
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, result)
 }
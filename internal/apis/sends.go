@@ -0,0 +1,81 @@
+package apis
+
+import (
+	"app-ez-pwd/internal/sends"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+func RouteSendsApiHandlers(group *echo.Group) {
+	group.GET("/sends", ListSendsGET)
+	group.POST("/sends", NewSendPOST)
+	group.DELETE("/sends/:sendId", DeleteSendDELETE)
+}
+
+// sendsError maps the errors of the sends package, the others are internal.
+func sendsError(err error) error {
+	switch {
+	case errors.Is(err, sends.ErrNotFound):
+		return &APIError{Status: http.StatusNotFound, Code: "not_found", Message: err.Error(), Err: err}
+	case errors.Is(err, sends.ErrPasswordRequired):
+		return &APIError{Status: http.StatusUnauthorized, Code: "password_required", Message: err.Error(), Err: err}
+	case errors.Is(err, sends.ErrInvalidPassword):
+		return &APIError{Status: http.StatusUnauthorized, Code: "invalid_password", Message: err.Error(), Err: err}
+	}
+	return err
+}
+
+func ListSendsGET(ctx echo.Context) error {
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	userSends, err := sends.ListSendsDB(userId)
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, userSends)
+}
+
+// NewSendPOST saves the payload encrypted by the client, the link is /send/<id>#<key>.
+func NewSendPOST(ctx echo.Context) error {
+	var form sends.SendForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	send, err := form.Save(userId)
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusCreated, send)
+}
+
+func DeleteSendDELETE(ctx echo.Context) error {
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	if err := sends.DeleteSendDB(userId, ctx.Param("sendId")); err != nil {
+		return sendsError(err)
+	}
+	return ctx.JSON(http.StatusOK, map[string]string{})
+}
+
+// ViewSendGET is public: it answers the ciphertext and counts the view.
+// The access password hash comes in the X-Send-Password header.
+func ViewSendGET(ctx echo.Context) error {
+	content, err := sends.ViewSendDB(ctx.Param("sendId"), ctx.Request().Header.Get("X-Send-Password"))
+	if err != nil {
+		return sendsError(err)
+	}
+
+	ctx.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	return ctx.JSON(http.StatusOK, content)
+}
@@ -0,0 +1,173 @@
+package apis
+
+import (
+	"app-ez-pwd/internal/secrets"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+)
+
+func RouteSharesApiHandlers(group *echo.Group) {
+	group.GET("/user-keys", GetUserKeysGET)
+	group.PUT("/user-keys", SaveUserKeysPUT)
+	group.GET("/users/:username/public-key", GetPublicKeyGET)
+
+	group.GET("/user-secrets/:secretId/shares", ListSecretSharesGET)
+	group.POST("/user-secrets/:secretId/shares", ShareSecretPOST)
+	group.GET("/shared-secrets/:shareId", GetSharedSecretGET)
+	group.PUT("/shared-secrets/:shareId", UpdateSharedSecretPUT)
+	group.DELETE("/shared-secrets/:shareId", RevokeShareDELETE)
+}
+
+func GetUserKeysGET(ctx echo.Context) error {
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	userKeys, err := secrets.GetUserKeysDB(userId)
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, userKeys)
+}
+
+// SaveUserKeysPUT saves the key pair generated by the client, it can't be replaced.
+func SaveUserKeysPUT(ctx echo.Context) error {
+	var form secrets.UserKeysForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	if err := form.Save(userId); err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, map[string]string{})
+}
+
+func GetPublicKeyGET(ctx echo.Context) error {
+	publicKey, err := secrets.GetPublicKeyDB(ctx.Param("username"))
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, publicKey)
+}
+
+func ListSecretSharesGET(ctx echo.Context) error {
+	secretId, err := strconv.ParseInt(ctx.Param("secretId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("secretId", "invalid id")
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	shares, err := secrets.ListSecretSharesDB(userId, int(secretId))
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, shares)
+}
+
+// ShareSecretPOST shares the secret re-encrypted by the client with a share key wrapped for the recipient.
+func ShareSecretPOST(ctx echo.Context) error {
+	secretId, err := strconv.ParseInt(ctx.Param("secretId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("secretId", "invalid id")
+	}
+
+	var form secrets.ShareSecretForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	share, err := form.Save(userId, int(secretId))
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusCreated, share)
+}
+
+func GetSharedSecretGET(ctx echo.Context) error {
+	shareId, err := strconv.ParseInt(ctx.Param("shareId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("shareId", "invalid id")
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	sharedSecret, err := secrets.GetSharedSecretDB(userId, int(shareId))
+	if err != nil {
+		return err
+	}
+	setSecretETag(ctx, sharedSecret.Version)
+	return ctx.JSON(http.StatusOK, sharedSecret)
+}
+
+// UpdateSharedSecretPUT updates the shared copy, the owner or the recipient with edit permission.
+func UpdateSharedSecretPUT(ctx echo.Context) error {
+	shareId, err := strconv.ParseInt(ctx.Param("shareId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("shareId", "invalid id")
+	}
+
+	var form secrets.UpdateSharedSecretForm
+	if err := ctx.Bind(&form); err != nil {
+		return err
+	}
+
+	headerVersion, fromHeader, err := ifMatchVersion(ctx)
+	if err != nil {
+		return secrets.FieldError("If-Match", err.Error())
+	}
+	if fromHeader {
+		form.Version = headerVersion
+	}
+	if form.Version == 0 {
+		return errVersionRequired
+	}
+
+	if err := form.ValidateFront(); err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	newVersion, err := form.Update(userId, int(shareId))
+	if err != nil {
+		return versionedError(ctx, err, fromHeader)
+	}
+
+	setSecretETag(ctx, newVersion)
+	return ctx.JSON(http.StatusOK, map[string]int{"version": newVersion})
+}
+
+// RevokeShareDELETE is the revoke of the owner, or the recipient that leaves the share.
+func RevokeShareDELETE(ctx echo.Context) error {
+	shareId, err := strconv.ParseInt(ctx.Param("shareId"), 10, 32)
+	if err != nil {
+		return secrets.FieldError("shareId", "invalid id")
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	if err = secrets.RevokeShareDB(userId, int(shareId)); err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, map[string]string{})
+}
@@ -0,0 +1,25 @@
+package apis
+
+import (
+	"app-ez-pwd/internal/secrets"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+// SyncGET returns the changes since the token of the previous sync: GET /api/v1/sync?since=<token>
+// without since it's a full sync.
+func SyncGET(ctx echo.Context) error {
+	since, err := secrets.ParseSyncToken(ctx.QueryParam("since"))
+	if err != nil {
+		return err
+	}
+
+	rawUserId := ctx.Get("userId")
+	userId, _ := rawUserId.(int)
+
+	syncModel, err := secrets.SyncUserSecretsDB(userId, since)
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, syncModel)
+}
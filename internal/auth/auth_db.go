@@ -10,10 +10,10 @@ import (
 	"strings"
 )
 
-func GetPasswordHashDB(username string) (int, string, error) {
+func GetPasswordHashDB(username string) (int, string, string, error) {
 	username = strings.ToUpper(username)
 	query, queryArgs, _ := storage.ApplicationDB.Psql.
-		Select("id", "password_hash").
+		Select("id", "password_hash", "user_type").
 		From("users").
 		Where(sq.Eq{
 			"UPPER(username)": username,
@@ -23,16 +23,16 @@ func GetPasswordHashDB(username string) (int, string, error) {
 	defer storage.ApplicationDB.Rollback(cn, tx)
 
 	var userId int
-	var passwordHash string
-	if err := tx.QueryRow(context.Background(), query, queryArgs...).Scan(&userId, &passwordHash); err != nil {
+	var passwordHash, userType string
+	if err := tx.QueryRow(context.Background(), query, queryArgs...).Scan(&userId, &passwordHash, &userType); err != nil {
 		if err == pgx.ErrNoRows {
-			return 0, "", nil
+			return 0, "", "", nil
 		}
 		logger.Logger.Error("err scan", zap.Error(err))
-		return 0, "", err
+		return 0, "", "", err
 	}
 
-	return userId, passwordHash, nil
+	return userId, passwordHash, userType, nil
 }
 
 func ExistsUsernameDB(username string) (bool, error) {
@@ -58,11 +58,30 @@ func ExistsUsernameDB(username string) (bool, error) {
 	return userId > 0, nil
 }
 
-func SaveNewAccount(username, passwordHash string) error {
+// AccountKeysModel are the optional keys of the new account, nil is NULL.
+type AccountKeysModel struct {
+	WrappedVaultKey    []byte
+	KDFType            string // empty without vault key
+	KDFParams          []byte
+	RecoveryVerifier   []byte // bcrypt of the recovery proof
+	RecoveryWrappedKey []byte
+}
+
+func SaveNewAccount(username, passwordHash string, keys AccountKeysModel) error {
+	var kdfType interface{}
+	if keys.KDFType != "" {
+		kdfType = keys.KDFType
+	}
+
 	insertUser, insertUserArgs, _ := storage.ApplicationDB.Psql.Insert("users").
 		SetMap(map[string]interface{}{
-			"username":      username,
-			"password_hash": passwordHash,
+			"username":             username,
+			"password_hash":        passwordHash,
+			"wrapped_vault_key":    keys.WrappedVaultKey,
+			"kdf_type":             kdfType,
+			"kdf_params_json":      keys.KDFParams,
+			"recovery_verifier":    nullString(keys.RecoveryVerifier),
+			"recovery_wrapped_key": keys.RecoveryWrappedKey,
 		}).ToSql() // .Suffix("RETURNING id")
 
 	cn, tx, _ := storage.ApplicationDB.Begin()
@@ -2,7 +2,9 @@ package auth
 
 import (
 	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/secrets"
 	"app-ez-pwd/internal/settings"
+	"encoding/json"
 	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/go-ozzo/ozzo-validation/v4/is"
 	"github.com/golang-jwt/jwt"
@@ -15,8 +17,14 @@ type DoLoginForm struct {
 	Username     string `json:"username"`
 	PasswordHash string `json:"passwordHash"` // the sha256 pwd
 	UserId       int
+	UserType     string
 }
 
+const (
+	UserTypeUser  = "USER"
+	UserTypeAdmin = "ADMIN"
+)
+
 func (f *DoLoginForm) ValidateFront() error {
 	return validation.ValidateStruct(f,
 		validation.Field(&f.Username, validation.Required, validation.Length(3, 50)),
@@ -26,7 +34,7 @@ func (f *DoLoginForm) ValidateFront() error {
 func (f *DoLoginForm) Validate() map[string]string {
 	formErrors := make(map[string]string)
 
-	userId, bCryptPasswordHash, err := GetPasswordHashDB(strings.ToUpper(f.Username))
+	userId, bCryptPasswordHash, userType, err := GetPasswordHashDB(strings.ToUpper(f.Username))
 	if err != nil {
 		formErrors["passwordHash"] = "internal error"
 	}
@@ -38,6 +46,7 @@ func (f *DoLoginForm) Validate() map[string]string {
 			formErrors["passwordHash"] = "invalid password"
 		} else {
 			f.UserId = userId
+			f.UserType = userType
 		}
 	}
 
@@ -46,7 +55,8 @@ func (f *DoLoginForm) Validate() map[string]string {
 
 func (f *DoLoginForm) AuthToken() (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id": f.UserId,
+		"id":       f.UserId,
+		"userType": f.UserType,
 	})
 	strToken, err := token.SignedString([]byte(settings.Settings.SecretHex))
 	if err != nil {
@@ -56,14 +66,20 @@ func (f *DoLoginForm) AuthToken() (string, error) {
 }
 
 type NewAccountForm struct {
-	Username     string `json:"username"`
-	PasswordHash string `json:"passwordHash"` // sha256
+	Username        string                        `json:"username"`
+	PasswordHash    string                        `json:"passwordHash"`    // sha256
+	WrappedVaultKey *secrets.EncryptedPayloadForm `json:"wrappedVaultKey"` // optional, the vault key encrypted with the password key
+	KDF             *KDFParamsForm                `json:"kdf"`             // of the password key, required with the vault key
+	Recovery        *RecoveryKeyForm              `json:"recovery"`        // optional, it needs the vault key
 }
 
 func (f NewAccountForm) ValidateFront() error {
 	return validation.ValidateStruct(&f,
 		validation.Field(&f.Username, validation.Required, validation.Length(3, 50)),
-		validation.Field(&f.PasswordHash, validation.Required, is.Hexadecimal))
+		validation.Field(&f.PasswordHash, validation.Required, is.Hexadecimal),
+		validation.Field(&f.WrappedVaultKey, validation.When(f.Recovery != nil, validation.Required), requiredKey),
+		validation.Field(&f.KDF, validation.When(f.WrappedVaultKey != nil, validation.Required)),
+		validation.Field(&f.Recovery))
 }
 
 func (f NewAccountForm) Validate() map[string]string {
@@ -82,6 +98,19 @@ func (f NewAccountForm) Validate() map[string]string {
 
 func (f NewAccountForm) Save() error {
 	passwordHash, _ := bcrypt.GenerateFromPassword([]byte(f.PasswordHash), bcrypt.DefaultCost)
-	err := SaveNewAccount(f.Username, string(passwordHash))
+
+	var keys AccountKeysModel
+	if f.WrappedVaultKey != nil {
+		keys.WrappedVaultKey, _ = json.Marshal(f.WrappedVaultKey)
+		keys.KDFType, keys.KDFParams = f.KDF.values()
+	}
+	if f.Recovery != nil {
+		var err error
+		if keys.RecoveryVerifier, keys.RecoveryWrappedKey, err = f.Recovery.values(); err != nil {
+			return err
+		}
+	}
+
+	err := SaveNewAccount(f.Username, string(passwordHash), keys)
 	return err
 }
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/storage"
+	"context"
+	"errors"
+	sq "github.com/Masterminds/squirrel"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+	"strings"
+)
+
+// The kdf of the password key is chosen by the client and stored per user, the client reads it with the
+// prelogin before deriving the key. The recommended values are raised over time: the client upgrades the
+// kdf with a password change (the same password is allowed).
+const (
+	// the values below the recommended ones answer upgrade in the prelogin
+	recommendedPBKDF2Iterations = 600000
+	recommendedArgon2MemoryKiB  = 64 * 1024
+	recommendedArgon2Iterations = 3
+)
+
+// ErrUsernameNotFound: like the login, the prelogin doesn't hide the usernames that don't exist.
+var ErrUsernameNotFound = errors.New("username does not exists")
+
+// needsUpgrade is true when the params are below the recommended ones of the type.
+func (m KDFModel) needsUpgrade() bool {
+	if m.Type == KDFTypeArgon2id {
+		return m.MemoryKiB < recommendedArgon2MemoryKiB || m.Iterations < recommendedArgon2Iterations
+	}
+	return m.Iterations < recommendedPBKDF2Iterations
+}
+
+// PreloginModel is the answer of the prelogin, KDF is null for the accounts without vault key.
+type PreloginModel struct {
+	KDF     *KDFModel `json:"kdf"`
+	Upgrade bool      `json:"upgrade"` // the client should change the kdf after the login
+}
+
+type PreloginForm struct {
+	Username string `json:"username"`
+}
+
+func (f PreloginForm) ValidateFront() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Username, validation.Required, validation.Length(3, 50)))
+}
+
+// Prelogin answers the kdf of the user, ErrUsernameNotFound when the username doesn't exist.
+func (f PreloginForm) Prelogin() (PreloginModel, error) {
+	var prelogin PreloginModel
+
+	exists, kdf, err := GetKDFDB(f.Username)
+	if err != nil {
+		return prelogin, err
+	}
+
+	if !exists {
+		return prelogin, ErrUsernameNotFound
+	}
+
+	prelogin.KDF = kdf
+	prelogin.Upgrade = kdf == nil || kdf.needsUpgrade()
+	return prelogin, nil
+}
+
+func GetKDFDB(username string) (bool, *KDFModel, error) {
+	username = strings.ToUpper(username)
+	query, queryArgs, _ := storage.ApplicationDB.Psql.
+		Select("kdf_type", "kdf_params_json").
+		From("users").
+		Where(sq.Eq{
+			"UPPER(username)": username,
+		}).ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return false, nil, err
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	var kdfType *string
+	var kdfParams []byte
+	if err = tx.QueryRow(context.Background(), query, queryArgs...).Scan(&kdfType, &kdfParams); err != nil {
+		if err == pgx.ErrNoRows {
+			return false, nil, nil
+		}
+		logger.Logger.Error("err scan", zap.Error(err))
+		return false, nil, err
+	}
+	return true, scanKDF(kdfType, kdfParams), nil
+}
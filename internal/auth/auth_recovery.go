@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/secrets"
+	"app-ez-pwd/internal/storage"
+	"context"
+	"encoding/json"
+	"errors"
+	sq "github.com/Masterminds/squirrel"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/go-ozzo/ozzo-validation/v4/is"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// The recovery key is generated by the client and shown once to the user: the server stores the vault key
+// encrypted with it and the bcrypt of the proof (a sha256 derived from the recovery key), never the key.
+
+var ErrVaultKeyRequired = errors.New("the account doesn't have a vault key")
+
+// dummyVerifier is compared when there isn't user or recovery key: the answer takes the same time.
+// It's the bcrypt of a random proof that was thrown away, at the default cost like the verifiers.
+const dummyVerifier = "$2a$10$OBCp3tNvmkkkmgBlza4Fg.bPH7Z1kY5F.wJd3e4KYZ3sm41DF5Qly"
+
+type RecoveryKeyForm struct {
+	RecoveryProof      string                       `json:"recoveryProof"`      // sha256
+	RecoveryWrappedKey secrets.EncryptedPayloadForm `json:"recoveryWrappedKey"` // the vault key encrypted with the recovery key
+}
+
+func (f RecoveryKeyForm) Validate() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.RecoveryProof, validation.Required, validation.Length(64, 64), is.Hexadecimal),
+		validation.Field(&f.RecoveryWrappedKey, validation.By(func(value interface{}) error {
+			if len(f.RecoveryWrappedKey.Encrypted) == 0 {
+				return errors.New("cannot be blank")
+			}
+			return nil
+		})))
+}
+
+func (f RecoveryKeyForm) ValidateFront() error {
+	return f.Validate()
+}
+
+func (f RecoveryKeyForm) values() (verifier, wrappedKey []byte, err error) {
+	verifier, err = bcrypt.GenerateFromPassword([]byte(f.RecoveryProof), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrappedKey, _ = json.Marshal(f.RecoveryWrappedKey)
+	return verifier, wrappedKey, nil
+}
+
+// Save sets or replaces the recovery key of the account, the vault key is required.
+func (f RecoveryKeyForm) Save(userId int) error {
+	verifier, wrappedKey, err := f.values()
+	if err != nil {
+		return err
+	}
+	return SaveRecoveryKeyDB(userId, verifier, wrappedKey)
+}
+
+// RecoverKeyForm is the first step of the recovery: with the proof the client gets the vault key
+// encrypted with the recovery key.
+type RecoverKeyForm struct {
+	Username      string `json:"username"`
+	RecoveryProof string `json:"recoveryProof"`
+
+	UserId             int             `json:"-"`
+	RecoveryWrappedKey json.RawMessage `json:"-"`
+}
+
+func (f *RecoverKeyForm) ValidateFront() error {
+	return validation.ValidateStruct(f,
+		validation.Field(&f.Username, validation.Required, validation.Length(3, 50)),
+		validation.Field(&f.RecoveryProof, validation.Required, validation.Length(64, 64), is.Hexadecimal))
+}
+
+func (f *RecoverKeyForm) Validate() map[string]string {
+	formErrors := make(map[string]string)
+
+	userId, verifier, wrappedKey, err := GetRecoveryDB(f.Username)
+	if err != nil {
+		formErrors["recoveryProof"] = "internal error"
+		return formErrors
+	}
+
+	// the same answer and the same bcrypt without user or without recovery key
+	hasVerifier := userId != 0 && verifier != ""
+	if !hasVerifier {
+		verifier = dummyVerifier
+	}
+	if bcrypt.CompareHashAndPassword([]byte(verifier), []byte(f.RecoveryProof)) != nil || !hasVerifier {
+		formErrors["recoveryProof"] = "invalid recovery key"
+	} else {
+		f.UserId = userId
+		f.RecoveryWrappedKey = wrappedKey
+	}
+	return formErrors
+}
+
+// RecoverAccountForm is the second step: the new login hash and the vault key encrypted with the new password key.
+type RecoverAccountForm struct {
+	RecoverKeyForm
+	NewPasswordHash string                       `json:"newPasswordHash"` // sha256
+	WrappedVaultKey secrets.EncryptedPayloadForm `json:"wrappedVaultKey"`
+	KDF             KDFParamsForm                `json:"kdf"`
+}
+
+func (f *RecoverAccountForm) ValidateFront() error {
+	if err := f.RecoverKeyForm.ValidateFront(); err != nil {
+		return err
+	}
+	return validation.ValidateStruct(f,
+		validation.Field(&f.NewPasswordHash, validation.Required, is.Hexadecimal),
+		validation.Field(&f.WrappedVaultKey, validation.By(func(value interface{}) error {
+			if len(f.WrappedVaultKey.Encrypted) == 0 {
+				return errors.New("cannot be blank")
+			}
+			return nil
+		})),
+		validation.Field(&f.KDF))
+}
+
+func (f *RecoverAccountForm) Save() error {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(f.NewPasswordHash), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	bytesWrappedVaultKey, _ := json.Marshal(f.WrappedVaultKey)
+	return ResetPasswordDB(f.UserId, string(passwordHash), bytesWrappedVaultKey, f.KDF)
+}
+
+func GetRecoveryDB(username string) (int, string, json.RawMessage, error) {
+	username = strings.ToUpper(username)
+	query, queryArgs, _ := storage.ApplicationDB.Psql.
+		Select("id", "COALESCE(recovery_verifier, '')", "recovery_wrapped_key").
+		From("users").
+		Where(sq.Eq{
+			"UPPER(username)": username,
+		}).ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return 0, "", nil, err
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	var userId int
+	var verifier string
+	var wrappedKey json.RawMessage
+	if err := tx.QueryRow(context.Background(), query, queryArgs...).Scan(&userId, &verifier, &wrappedKey); err != nil {
+		if err == pgx.ErrNoRows {
+			return 0, "", nil, nil
+		}
+		logger.Logger.Error("err scan", zap.Error(err))
+		return 0, "", nil, err
+	}
+	return userId, verifier, wrappedKey, nil
+}
+
+func SaveRecoveryKeyDB(userId int, verifier, wrappedKey []byte) error {
+	updateUser, updateUserArgs, _ := storage.ApplicationDB.Psql.Update("users").
+		SetMap(map[string]interface{}{
+			"recovery_verifier":    string(verifier),
+			"recovery_wrapped_key": wrappedKey,
+		}).
+		Where(sq.Eq{
+			"id": userId,
+		}).
+		Where(sq.NotEq{
+			"wrapped_vault_key": nil,
+		}).ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(context.Background(), updateUser, updateUserArgs...)
+	if err != nil {
+		logger.Logger.Error("err update recovery key", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return ErrVaultKeyRequired
+	}
+
+	return storage.ApplicationDB.Commit(cn, tx)
+}
+
+// nullString is the varchar value of the optional hashes, nil is NULL.
+func nullString(value []byte) interface{} {
+	if value == nil {
+		return nil
+	}
+	return string(value)
+}
@@ -0,0 +1,292 @@
+package auth
+
+import (
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/secrets"
+	"app-ez-pwd/internal/storage"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	sq "github.com/Masterminds/squirrel"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/go-ozzo/ozzo-validation/v4/is"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The secrets are encrypted with a random vault key, the vault key is encrypted with the key derived from
+// the password (PBKDF2 or Argon2id with the kdf params of the user): changing the password only encrypts the vault key again.
+
+const (
+	KDFTypePBKDF2   = "PBKDF2"
+	KDFTypeArgon2id = "Argon2id"
+
+	minPBKDF2Iterations = 100000
+	maxPBKDF2Iterations = 10000000
+
+	minArgon2Iterations  = 2
+	maxArgon2Iterations  = 100
+	minArgon2MemoryKiB   = 19 * 1024
+	maxArgon2MemoryKiB   = 1024 * 1024
+	minArgon2Parallelism = 1
+	maxArgon2Parallelism = 16
+)
+
+// ErrVaultKeyMigration: the password change can't set the vault key of an account with secrets,
+// they are encrypted with the password key until the migration.
+var ErrVaultKeyMigration = errors.New("the account has secrets without vault key: use the vault key migration")
+
+// maxMigrationSecrets is the limit of the secrets of the vault key migration.
+const maxMigrationSecrets = 10000
+
+// requiredKey is the required rule for the optional payloads: nil is checked by Required.
+var requiredKey = validation.By(func(value interface{}) error {
+	if payload, ok := value.(*secrets.EncryptedPayloadForm); ok && payload != nil && len(payload.Encrypted) == 0 {
+		return errors.New("cannot be blank")
+	}
+	return nil
+})
+
+// VaultKeyModel is sent at login, both are null for the accounts that derive the key from the password.
+type VaultKeyModel struct {
+	WrappedVaultKey json.RawMessage `json:"wrappedVaultKey"`
+	KDF             *KDFModel       `json:"kdf"`
+}
+
+// KDFModel are the kdf params of the user, MemoryKiB and Parallelism are only for Argon2id.
+type KDFModel struct {
+	Type        string `json:"type"`
+	Salt        string `json:"salt"`
+	Iterations  int    `json:"iterations"`
+	MemoryKiB   int    `json:"memoryKiB,omitempty"`
+	Parallelism int    `json:"parallelism,omitempty"`
+}
+
+type KDFParamsForm struct {
+	Type        string `json:"type"` // PBKDF2 when it's empty
+	Salt        string `json:"salt"` // base64, random per user
+	Iterations  int    `json:"iterations"`
+	MemoryKiB   int    `json:"memoryKiB"`
+	Parallelism int    `json:"parallelism"`
+}
+
+func (f KDFParamsForm) Validate() error {
+	argon2 := f.Type == KDFTypeArgon2id
+
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Type, validation.In(KDFTypePBKDF2, KDFTypeArgon2id)),
+		validation.Field(&f.Salt, validation.Required, validation.Length(16, 100), validation.By(func(value interface{}) error {
+			if _, err := base64.StdEncoding.DecodeString(f.Salt); err != nil {
+				return errors.New("must be base64")
+			}
+			return nil
+		})),
+		validation.Field(&f.Iterations, validation.Required,
+			validation.When(argon2, validation.Min(minArgon2Iterations), validation.Max(maxArgon2Iterations)).
+				Else(validation.Min(minPBKDF2Iterations), validation.Max(maxPBKDF2Iterations))),
+		validation.Field(&f.MemoryKiB, validation.When(argon2,
+			validation.Required, validation.Min(minArgon2MemoryKiB), validation.Max(maxArgon2MemoryKiB)).
+			Else(validation.Empty)),
+		validation.Field(&f.Parallelism, validation.When(argon2,
+			validation.Required, validation.Min(minArgon2Parallelism), validation.Max(maxArgon2Parallelism)).
+			Else(validation.Empty)))
+}
+
+// values are the kdf_type and kdf_params_json columns.
+func (f KDFParamsForm) values() (string, []byte) {
+	kdf := KDFModel{
+		Type:        f.Type,
+		Salt:        f.Salt,
+		Iterations:  f.Iterations,
+		MemoryKiB:   f.MemoryKiB,
+		Parallelism: f.Parallelism,
+	}
+	if kdf.Type == "" {
+		kdf.Type = KDFTypePBKDF2
+	}
+	bytesKDF, _ := json.Marshal(kdf)
+	return kdf.Type, bytesKDF
+}
+
+// scanKDF returns nil for the accounts without kdf: their key is derived with the params of the first clients.
+func scanKDF(kdfType *string, kdfParams []byte) *KDFModel {
+	if kdfType == nil || kdfParams == nil {
+		return nil
+	}
+	var kdf KDFModel
+	if err := json.Unmarshal(kdfParams, &kdf); err != nil {
+		logger.Logger.Error("invalid kdf_params_json", zap.Error(err))
+		return nil
+	}
+	kdf.Type = *kdfType
+	return &kdf
+}
+
+// ChangePasswordForm changes the login hash and encrypts the vault key with the new password key.
+type ChangePasswordForm struct {
+	CurrentPasswordHash string                       `json:"currentPasswordHash"` // sha256
+	NewPasswordHash     string                       `json:"newPasswordHash"`     // sha256
+	WrappedVaultKey     secrets.EncryptedPayloadForm `json:"wrappedVaultKey"`
+	KDF                 KDFParamsForm                `json:"kdf"`
+}
+
+func (f ChangePasswordForm) ValidateFront() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.CurrentPasswordHash, validation.Required, is.Hexadecimal),
+		validation.Field(&f.NewPasswordHash, validation.Required, is.Hexadecimal),
+		validation.Field(&f.WrappedVaultKey, validation.By(func(value interface{}) error {
+			if len(f.WrappedVaultKey.Encrypted) == 0 {
+				return errors.New("cannot be blank")
+			}
+			return nil
+		})),
+		validation.Field(&f.KDF))
+}
+
+func (f ChangePasswordForm) Validate(userId int) map[string]string {
+	formErrors := make(map[string]string)
+
+	bCryptPasswordHash, err := GetPasswordHashByIdDB(userId)
+	if err != nil {
+		formErrors["currentPasswordHash"] = "internal error"
+	} else if bcrypt.CompareHashAndPassword([]byte(bCryptPasswordHash), []byte(f.CurrentPasswordHash)) != nil {
+		formErrors["currentPasswordHash"] = "invalid password"
+	}
+	return formErrors
+}
+
+func (f ChangePasswordForm) Save(userId int) error {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(f.NewPasswordHash), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	bytesWrappedVaultKey, _ := json.Marshal(f.WrappedVaultKey)
+	return ResetPasswordDB(userId, string(passwordHash), bytesWrappedVaultKey, f.KDF)
+}
+
+// MigrateVaultKeyForm is the password change of the accounts without vault key that have secrets:
+// the secrets encrypted with the new vault key are saved with it.
+type MigrateVaultKeyForm struct {
+	ChangePasswordForm
+	Secrets []secrets.VaultSecretForm `json:"secrets"`
+}
+
+func (f MigrateVaultKeyForm) ValidateFront() error {
+	if err := f.ChangePasswordForm.ValidateFront(); err != nil {
+		return err
+	}
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Secrets, validation.Length(0, maxMigrationSecrets)))
+}
+
+func (f MigrateVaultKeyForm) Save(userId int) error {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(f.NewPasswordHash), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	bytesWrappedVaultKey, _ := json.Marshal(f.WrappedVaultKey)
+	kdfType, kdfParams := f.KDF.values()
+
+	return secrets.MigrateVaultKeyDB(userId, map[string]interface{}{
+		"password_hash":     string(passwordHash),
+		"wrapped_vault_key": bytesWrappedVaultKey,
+		"kdf_type":          kdfType,
+		"kdf_params_json":   kdfParams,
+	}, f.Secrets)
+}
+
+func GetVaultKeyDB(userId int) (VaultKeyModel, error) {
+	var vaultKey VaultKeyModel
+
+	query, queryArgs, _ := storage.ApplicationDB.Psql.
+		Select("wrapped_vault_key", "kdf_type", "kdf_params_json").
+		From("users").
+		Where(sq.Eq{
+			"id": userId,
+		}).ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return vaultKey, err
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	var kdfType *string
+	var kdfParams []byte
+	if err = tx.QueryRow(context.Background(), query, queryArgs...).Scan(&vaultKey.WrappedVaultKey, &kdfType, &kdfParams); err != nil {
+		logger.Logger.Error("err scan", zap.Error(err))
+		return vaultKey, err
+	}
+	if vaultKey.WrappedVaultKey == nil {
+		vaultKey.WrappedVaultKey = json.RawMessage("null")
+	}
+	vaultKey.KDF = scanKDF(kdfType, kdfParams)
+	return vaultKey, nil
+}
+
+func GetPasswordHashByIdDB(userId int) (string, error) {
+	query, queryArgs, _ := storage.ApplicationDB.Psql.
+		Select("password_hash").
+		From("users").
+		Where(sq.Eq{
+			"id": userId,
+		}).ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	var passwordHash string
+	if err = tx.QueryRow(context.Background(), query, queryArgs...).Scan(&passwordHash); err != nil {
+		if err == pgx.ErrNoRows {
+			return "", nil
+		}
+		logger.Logger.Error("err scan", zap.Error(err))
+		return "", err
+	}
+	return passwordHash, nil
+}
+
+// ResetPasswordDB changes the login hash and the wrapped vault key with its kdf params,
+// the recovery key keeps working: the vault key didn't change. The accounts without vault key
+// only set it here without secrets (ErrVaultKeyMigration).
+func ResetPasswordDB(userId int, passwordHash string, wrappedVaultKey []byte, kdf KDFParamsForm) error {
+	kdfType, kdfParams := kdf.values()
+
+	updateUser, updateUserArgs, _ := storage.ApplicationDB.Psql.Update("users").
+		SetMap(map[string]interface{}{
+			"password_hash":     passwordHash,
+			"wrapped_vault_key": wrappedVaultKey,
+			"kdf_type":          kdfType,
+			"kdf_params_json":   kdfParams,
+		}).
+		Where(sq.Eq{
+			"id": userId,
+		}).
+		Where(sq.Or{
+			sq.NotEq{"wrapped_vault_key": nil},
+			sq.Expr("NOT EXISTS (SELECT 1 FROM user_secrets WHERE user_id = ?)", userId),
+		}).ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(context.Background(), updateUser, updateUserArgs...)
+	if err != nil {
+		logger.Logger.Error("err reset password", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return ErrVaultKeyMigration
+	}
+
+	return storage.ApplicationDB.Commit(cn, tx)
+}
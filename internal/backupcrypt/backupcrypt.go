@@ -0,0 +1,294 @@
+// Package backupcrypt encrypts the backup archive with a passphrase or with the X25519 public key of the user.
+//
+// Format: the header and the payload in chunks of 64KiB encrypted with ChaCha20-Poly1305,
+// the nonce is the chunk counter and the last chunk is flagged, so truncation is detected.
+//
+//	magic (8 bytes) | mode (1 byte) | passphrase: logN (1 byte) + salt (16 bytes)
+//	                                | public key: ephemeral public key (32 bytes)
+package backupcrypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+	"io"
+)
+
+const (
+	ModePassphrase byte = 1
+	ModePublicKey  byte = 2
+)
+
+// Magic starts every encrypted backup, restore uses it to know the upload is encrypted.
+var Magic = []byte("EZPWDEC1")
+
+const (
+	chunkSize        = 64 * 1024
+	scryptLogN       = 17
+	saltSize         = 16
+	MinPassphraseLen = 12
+)
+
+var (
+	ErrInvalidHeader = errors.New("backupcrypt: invalid header")
+	ErrDecrypt       = errors.New("backupcrypt: wrong key or corrupted backup")
+	ErrInvalidKey    = errors.New("backupcrypt: invalid X25519 key")
+)
+
+// ParseKey decodes the raw X25519 key in base64 (standard or url encoding).
+func ParseKey(encodedKey string) ([]byte, error) {
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if key, err := encoding.DecodeString(encodedKey); err == nil {
+			if len(key) != curve25519.PointSize {
+				return nil, ErrInvalidKey
+			}
+			return key, nil
+		}
+	}
+	return nil, ErrInvalidKey
+}
+
+func passphraseKey(passphrase string, logN byte, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<logN, 8, 1, chacha20poly1305.KeySize)
+}
+
+func publicKeyKey(sharedSecret, ephemeralPublic, recipientPublic []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeralPublic...), recipientPublic...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, sharedSecret, salt, []byte("ez-pwd backup")), key)
+	return key, err
+}
+
+// NewPassphraseWriter returns the writer that encrypts to w, Close must be called to write the last chunk.
+func NewPassphraseWriter(w io.Writer, passphrase string) (io.WriteCloser, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := passphraseKey(passphrase, scryptLogN, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append(append(append([]byte{}, Magic...), ModePassphrase, scryptLogN), salt...)
+	return newChunkWriter(w, key, header)
+}
+
+// NewPublicKeyWriter encrypts to the X25519 public key, only the owner of the private key can decrypt.
+func NewPublicKeyWriter(w io.Writer, recipientPublic []byte) (io.WriteCloser, error) {
+	ephemeralPrivate := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeralPrivate); err != nil {
+		return nil, err
+	}
+	ephemeralPublic, err := curve25519.X25519(ephemeralPrivate, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := curve25519.X25519(ephemeralPrivate, recipientPublic)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	key, err := publicKeyKey(sharedSecret, ephemeralPublic, recipientPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append(append(append([]byte{}, Magic...), ModePublicKey), ephemeralPublic...)
+	return newChunkWriter(w, key, header)
+}
+
+// Identity is what decrypts the backup: the passphrase or the X25519 private key.
+type Identity struct {
+	Passphrase string
+	PrivateKey []byte
+}
+
+// IsEncrypted reports if the content starts with Magic.
+func IsEncrypted(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, Magic)
+}
+
+// NewReader reads the header and returns the reader of the decrypted content,
+// it returns ErrDecrypt when a chunk can't be authenticated.
+func NewReader(r io.Reader, identity Identity) (io.Reader, error) {
+	bufReader := bufio.NewReader(r)
+
+	prefix := make([]byte, len(Magic)+1)
+	if _, err := io.ReadFull(bufReader, prefix); err != nil || !IsEncrypted(prefix) {
+		return nil, ErrInvalidHeader
+	}
+
+	var key []byte
+	switch prefix[len(Magic)] {
+	case ModePassphrase:
+		// the writer only uses scryptLogN, a bigger cost from the upload would take gigabytes of memory
+		params := make([]byte, 1+saltSize)
+		if _, err := io.ReadFull(bufReader, params); err != nil || params[0] != scryptLogN {
+			return nil, ErrInvalidHeader
+		}
+		if identity.Passphrase == "" {
+			return nil, ErrDecrypt
+		}
+		var err error
+		if key, err = passphraseKey(identity.Passphrase, params[0], params[1:]); err != nil {
+			return nil, err
+		}
+	case ModePublicKey:
+		ephemeralPublic := make([]byte, curve25519.PointSize)
+		if _, err := io.ReadFull(bufReader, ephemeralPublic); err != nil {
+			return nil, ErrInvalidHeader
+		}
+		if len(identity.PrivateKey) != curve25519.ScalarSize {
+			return nil, ErrDecrypt
+		}
+		sharedSecret, err := curve25519.X25519(identity.PrivateKey, ephemeralPublic)
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		recipientPublic, _ := curve25519.X25519(identity.PrivateKey, curve25519.Basepoint)
+		if key, err = publicKeyKey(sharedSecret, ephemeralPublic, recipientPublic); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrInvalidHeader
+	}
+
+	return newChunkReader(bufReader, key)
+}
+
+// nonce is the chunk counter (big endian) and the last byte is 1 for the last chunk.
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type chunkWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buffer  []byte
+	counter uint64
+	closed  bool
+}
+
+func newChunkWriter(w io.Writer, key, header []byte) (*chunkWriter, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+	return &chunkWriter{w: w, aead: aead, buffer: make([]byte, 0, chunkSize)}, nil
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	if cw.closed {
+		return 0, errors.New("backupcrypt: write after close")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed when more data comes, the last chunk is sealed on Close
+		if len(cw.buffer) == chunkSize {
+			if err := cw.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(cw.buffer[len(cw.buffer):chunkSize], p)
+		cw.buffer = cw.buffer[:len(cw.buffer)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (cw *chunkWriter) seal(last bool) error {
+	sealed := cw.aead.Seal(nil, chunkNonce(cw.counter, last), cw.buffer, nil)
+	cw.counter++
+	cw.buffer = cw.buffer[:0]
+	_, err := cw.w.Write(sealed)
+	return err
+}
+
+// Close writes the last chunk, it doesn't close the underlying writer.
+func (cw *chunkWriter) Close() error {
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+	return cw.seal(true)
+}
+
+type chunkReader struct {
+	r         io.Reader
+	aead      cipher.AEAD
+	counter   uint64
+	plaintext []byte
+	pending   []byte // the sealed bytes read and not opened yet
+	done      bool
+}
+
+func newChunkReader(r io.Reader, key []byte) (*chunkReader, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{r: r, aead: aead, pending: make([]byte, 0, chunkSize+aead.Overhead()+1)}, nil
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.plaintext) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err := cr.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, cr.plaintext)
+	cr.plaintext = cr.plaintext[n:]
+	return n, nil
+}
+
+// open reads up to one byte more than a full chunk: when that byte is there the chunk isn't the last one.
+func (cr *chunkReader) open() error {
+	fullChunk := chunkSize + cr.aead.Overhead()
+
+	n, err := io.ReadFull(cr.r, cr.pending[len(cr.pending):fullChunk+1])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	cr.pending = cr.pending[:len(cr.pending)+n]
+
+	last := len(cr.pending) <= fullChunk
+	chunkLen := len(cr.pending)
+	if !last {
+		chunkLen = fullChunk
+	}
+
+	plaintext, err := cr.aead.Open(nil, chunkNonce(cr.counter, last), cr.pending[:chunkLen], nil)
+	if err != nil {
+		return ErrDecrypt
+	}
+	cr.counter++
+	cr.plaintext = plaintext
+	cr.done = last
+
+	rest := copy(cr.pending, cr.pending[chunkLen:])
+	cr.pending = cr.pending[:rest]
+	return nil
+}
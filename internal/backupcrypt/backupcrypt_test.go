@@ -0,0 +1,163 @@
+package backupcrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"golang.org/x/crypto/curve25519"
+	"io"
+	"testing"
+)
+
+const testPassphrase = "correct horse battery"
+
+func randomBytes(t *testing.T, size int) []byte {
+	t.Helper()
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func testKeyPair(t *testing.T) (privateKey, publicKey []byte) {
+	t.Helper()
+	privateKey = randomBytes(t, curve25519.ScalarSize)
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return privateKey, publicKey
+}
+
+func encryptPassphrase(t *testing.T, content []byte) []byte {
+	t.Helper()
+	var encrypted bytes.Buffer
+	w, err := NewPassphraseWriter(&encrypted, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return encrypted.Bytes()
+}
+
+func encryptPublicKey(t *testing.T, content, publicKey []byte) []byte {
+	t.Helper()
+	var encrypted bytes.Buffer
+	w, err := NewPublicKeyWriter(&encrypted, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return encrypted.Bytes()
+}
+
+func decrypt(encrypted []byte, identity Identity) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(encrypted), identity)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	privateKey, publicKey := testKeyPair(t)
+
+	// empty, smaller than a chunk, exactly one chunk and several chunks with a partial last one
+	sizes := []int{0, 100, chunkSize, 3*chunkSize + 17}
+
+	for _, size := range sizes {
+		content := randomBytes(t, size)
+
+		decrypted, err := decrypt(encryptPassphrase(t, content), Identity{Passphrase: testPassphrase})
+		if err != nil {
+			t.Fatalf("passphrase, size %d: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, content) {
+			t.Fatalf("passphrase, size %d: the content is different", size)
+		}
+
+		decrypted, err = decrypt(encryptPublicKey(t, content, publicKey), Identity{PrivateKey: privateKey})
+		if err != nil {
+			t.Fatalf("public key, size %d: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, content) {
+			t.Fatalf("public key, size %d: the content is different", size)
+		}
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+	privateKey, publicKey := testKeyPair(t)
+	otherPrivateKey, _ := testKeyPair(t)
+
+	content := randomBytes(t, 2*chunkSize+10)
+	passphraseBackup := encryptPassphrase(t, content)
+	publicKeyBackup := encryptPublicKey(t, content, publicKey)
+
+	passphraseHeader := len(Magic) + 2 + saltSize
+	publicKeyHeader := len(Magic) + 1 + curve25519.PointSize
+	sealedChunk := chunkSize + 16
+
+	tampered := append([]byte{}, publicKeyBackup...)
+	tampered[publicKeyHeader+sealedChunk+5] ^= 1
+
+	costly := append([]byte{}, passphraseBackup...)
+	costly[len(Magic)+1] = 22
+
+	tests := []struct {
+		name      string
+		encrypted []byte
+		identity  Identity
+		err       error
+	}{
+		{"wrong passphrase", passphraseBackup, Identity{Passphrase: "wrong passphrase"}, ErrDecrypt},
+		{"without passphrase", passphraseBackup, Identity{PrivateKey: privateKey}, ErrDecrypt},
+		{"wrong private key", publicKeyBackup, Identity{PrivateKey: otherPrivateKey}, ErrDecrypt},
+		{"tampered chunk", tampered, Identity{PrivateKey: privateKey}, ErrDecrypt},
+		{"truncated in a chunk", publicKeyBackup[:len(publicKeyBackup)-3], Identity{PrivateKey: privateKey}, ErrDecrypt},
+		{"truncated after a chunk", publicKeyBackup[:publicKeyHeader+sealedChunk], Identity{PrivateKey: privateKey}, ErrDecrypt},
+		{"without chunks", passphraseBackup[:passphraseHeader], Identity{Passphrase: testPassphrase}, ErrDecrypt},
+		{"truncated header", passphraseBackup[:passphraseHeader-1], Identity{Passphrase: testPassphrase}, ErrInvalidHeader},
+		{"scrypt cost of the upload", costly, Identity{Passphrase: testPassphrase}, ErrInvalidHeader},
+		{"not encrypted", []byte("PK\x03\x04 a zip file"), Identity{Passphrase: testPassphrase}, ErrInvalidHeader},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decrypt(test.encrypted, test.identity); !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	_, publicKey := testKeyPair(t)
+
+	if _, err := ParseKey("c2hvcnQ="); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("expected ErrInvalidKey, got %v", err)
+	}
+	if _, err := NewPublicKeyWriter(io.Discard, make([]byte, curve25519.PointSize)); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("expected ErrInvalidKey for the low order key, got %v", err)
+	}
+
+	parsedKey, err := ParseKey(base64.RawURLEncoding.EncodeToString(publicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsedKey, publicKey) {
+		t.Fatal("the parsed key is different")
+	}
+}
@@ -0,0 +1,376 @@
+// Package backups writes the scheduled backups to the object store and applies the retention.
+package backups
+
+import (
+	"app-ez-pwd/internal/backupcrypt"
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/objectstore"
+	"app-ez-pwd/internal/secrets"
+	"app-ez-pwd/internal/settings"
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	ModeUsers    = "users"
+	ModeDatabase = "database"
+)
+
+// keyTimeFormat sorts by name in the same order as by date.
+const keyTimeFormat = "20060102T150405Z"
+
+// Status is the result of the last run, it's in memory: every instance has its own.
+type Status struct {
+	Enabled         bool       `json:"enabled"`
+	Mode            string     `json:"mode,omitempty"`
+	IntervalMinutes int        `json:"intervalMinutes,omitempty"`
+	Running         bool       `json:"running"`
+	LastStartedAt   *time.Time `json:"lastStartedAt"`
+	LastFinishedAt  *time.Time `json:"lastFinishedAt"`
+	LastSuccessAt   *time.Time `json:"lastSuccessAt"`
+	LastError       string     `json:"lastError,omitempty"`
+	Skipped         bool       `json:"skipped"` // another instance runs or already ran the backups of the interval
+	BackupsWritten  int        `json:"backupsWritten"`
+	BackupsFailed   int        `json:"backupsFailed"`
+	BytesWritten    int64      `json:"bytesWritten"`
+	BackupsDeleted  int        `json:"backupsDeleted"`
+	NextRunAt       *time.Time `json:"nextRunAt"`
+}
+
+type Scheduler struct {
+	config    settings.BackupScheduleSettings
+	store     objectstore.Store
+	publicKey []byte // of the database mode
+
+	mu     sync.Mutex
+	status Status
+
+	trigger chan struct{}
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// Schedule is the scheduler started by main, nil when the scheduled backups are disabled.
+var Schedule *Scheduler
+
+func NewScheduler(config settings.BackupScheduleSettings) (*Scheduler, error) {
+	if config.Mode == "" {
+		config.Mode = ModeUsers
+	}
+	if config.Mode != ModeUsers && config.Mode != ModeDatabase {
+		return nil, fmt.Errorf("backups: invalid mode %q", config.Mode)
+	}
+	if config.IntervalMinutes <= 0 {
+		return nil, fmt.Errorf("backups: INTERVAL_MINUTES must be greater than 0")
+	}
+
+	// the database backup has the password hashes and the private keys: never in plaintext
+	var publicKey []byte
+	if config.Mode == ModeDatabase {
+		if config.PublicKey == "" {
+			return nil, fmt.Errorf("backups: the database mode needs PUBLIC_KEY")
+		}
+		var err error
+		if publicKey, err = backupcrypt.ParseKey(config.PublicKey); err != nil {
+			return nil, fmt.Errorf("backups: PUBLIC_KEY: %w", err)
+		}
+	}
+
+	store, err := objectstore.New(config.Store)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Scheduler{
+		config:    config,
+		store:     store,
+		publicKey: publicKey,
+		status:    Status{Enabled: true, Mode: config.Mode, IntervalMinutes: config.IntervalMinutes},
+		trigger:   make(chan struct{}, 1),
+	}, nil
+}
+
+func (s *Scheduler) interval() time.Duration {
+	return time.Duration(s.config.IntervalMinutes) * time.Minute
+}
+
+// Start runs the backups every interval in the background until Stop.
+func (s *Scheduler) Start() {
+	runCtx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+
+		timer := time.NewTimer(s.interval())
+		defer timer.Stop()
+		s.setNextRun(time.Now().Add(s.interval()))
+
+		for {
+			manual := false
+			select {
+			case <-runCtx.Done():
+				return
+			case <-timer.C:
+			case <-s.trigger:
+				manual = true
+				if !timer.Stop() {
+					<-timer.C
+				}
+			}
+
+			s.run(runCtx, manual)
+			timer.Reset(s.interval())
+			s.setNextRun(time.Now().Add(s.interval()))
+		}
+	}()
+}
+
+// Stop cancels the running backup and waits for the scheduler goroutine.
+func (s *Scheduler) Stop() {
+	if s == nil || s.cancel == nil {
+		return
+	}
+	s.cancel()
+	<-s.done
+}
+
+// RunNow asks for a run without waiting the interval, false when a run is already running or requested.
+func (s *Scheduler) RunNow() bool {
+	s.mu.Lock()
+	running := s.status.Running
+	s.mu.Unlock()
+	if running {
+		return false
+	}
+
+	select {
+	case s.trigger <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Status is safe to call on the nil scheduler: the backups are disabled.
+func (s *Scheduler) Status() Status {
+	if s == nil {
+		return Status{Enabled: false}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+func (s *Scheduler) setNextRun(nextRun time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.NextRunAt = &nextRun
+}
+
+func (s *Scheduler) run(ctx context.Context, manual bool) {
+	startedAt := time.Now().UTC()
+
+	s.mu.Lock()
+	s.status.Running = true
+	s.status.LastStartedAt = &startedAt
+	s.mu.Unlock()
+
+	result := Status{}
+	err := s.backup(ctx, startedAt, manual, &result)
+
+	finishedAt := time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Running = false
+	s.status.LastFinishedAt = &finishedAt
+	s.status.Skipped = result.Skipped
+	s.status.BackupsWritten = result.BackupsWritten
+	s.status.BackupsFailed = result.BackupsFailed
+	s.status.BytesWritten = result.BytesWritten
+	s.status.BackupsDeleted = result.BackupsDeleted
+	s.status.LastError = ""
+	if err != nil {
+		s.status.LastError = err.Error()
+		logger.Logger.Error("err scheduled backup", zap.Error(err))
+	} else if !result.Skipped {
+		s.status.LastSuccessAt = &finishedAt
+	}
+}
+
+// backup writes the backups and applies the retention, a failed user backup doesn't stop the others.
+// With more than one instance only one writes the backups of an interval, the manual run always writes them.
+func (s *Scheduler) backup(ctx context.Context, startedAt time.Time, manual bool, result *Status) error {
+	lock, locked, err := tryLockDB()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	if !locked {
+		result.Skipped = true
+		return nil
+	}
+	claimed, err := lock.claimIntervalDB(startedAt.Truncate(s.interval()))
+	if err != nil {
+		return err
+	}
+	if !claimed && !manual {
+		result.Skipped = true
+		return nil
+	}
+
+	stamp := startedAt.Format(keyTimeFormat)
+	prefix := ModeUsers + "/"
+
+	if s.config.Mode == ModeDatabase {
+		prefix = ModeDatabase + "/"
+		size, err := s.put(ctx, fmt.Sprintf("%s%s.zip.ezpwd", prefix, stamp), s.writeEncryptedDatabaseBackup)
+		if err != nil {
+			result.BackupsFailed++
+			return err
+		}
+		result.BackupsWritten++
+		result.BytesWritten += size
+	} else {
+		userIds, err := ListUserIdsDB()
+		if err != nil {
+			return err
+		}
+
+		for _, userId := range userIds {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			size, err := s.backupUser(ctx, userId, stamp)
+			if err != nil {
+				logger.Logger.Error("err scheduled user backup", zap.Int("userId", userId), zap.Error(err))
+				result.BackupsFailed++
+				continue
+			}
+			result.BackupsWritten++
+			result.BytesWritten += size
+		}
+	}
+
+	deleted, err := s.applyRetention(ctx, prefix, startedAt)
+	result.BackupsDeleted = deleted
+	if err != nil {
+		return err
+	}
+	if result.BackupsFailed > 0 {
+		return fmt.Errorf("backups: %d backups failed", result.BackupsFailed)
+	}
+	return nil
+}
+
+// backupUser encrypts the backup to the backup public key of the user when it's set,
+// like the download with ?encryption=publicKey.
+func (s *Scheduler) backupUser(ctx context.Context, userId int, stamp string) (int64, error) {
+	encodedKey, err := secrets.GetBackupPublicKeyDB(userId)
+	if err != nil {
+		return 0, err
+	}
+
+	export, err := secrets.OpenBackupExport(userId, secrets.BackupOptions{ExcludeLoginHash: s.config.ExcludeLoginHash})
+	if err != nil {
+		return 0, err
+	}
+	defer export.Close()
+
+	key := fmt.Sprintf("%s/%d/%s.zip", ModeUsers, userId, stamp)
+	if encodedKey != "" {
+		publicKey, err := backupcrypt.ParseKey(encodedKey)
+		if err != nil {
+			return 0, err
+		}
+		export.EncryptToPublicKey(publicKey)
+		key += ".ezpwd"
+	}
+
+	return s.put(ctx, key, export.Write)
+}
+
+func (s *Scheduler) writeEncryptedDatabaseBackup(w io.Writer) error {
+	encrypter, err := backupcrypt.NewPublicKeyWriter(w, s.publicKey)
+	if err != nil {
+		return err
+	}
+	if err = writeDatabaseBackup(encrypter); err != nil {
+		return err
+	}
+	return encrypter.Close()
+}
+
+// put writes the backup to a temporary file first: the S3 upload needs the size.
+func (s *Scheduler) put(ctx context.Context, key string, write func(w io.Writer) error) (int64, error) {
+	tmpFile, err := os.CreateTemp("", "ez-pwd-backup-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	if err = write(tmpFile); err != nil {
+		return 0, err
+	}
+	size, err := tmpFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = tmpFile.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	if err = s.store.Put(ctx, key, tmpFile, size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// applyRetention deletes by folder (every user has one): the backups after RetentionCount
+// and the ones older than RetentionDays, the newest backup of the folder is always kept.
+func (s *Scheduler) applyRetention(ctx context.Context, prefix string, now time.Time) (int, error) {
+	if s.config.RetentionCount <= 0 && s.config.RetentionDays <= 0 {
+		return 0, nil
+	}
+
+	objects, err := s.store.List(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	folders := make(map[string][]objectstore.Object)
+	for _, object := range objects {
+		folder := path.Dir(object.Key)
+		folders[folder] = append(folders[folder], object)
+	}
+
+	minDate := now.AddDate(0, 0, -s.config.RetentionDays)
+	deleted := 0
+
+	for _, folderObjects := range folders {
+		// sorted by key: the newest is the last one
+		for i, object := range folderObjects[:len(folderObjects)-1] {
+			newerCount := len(folderObjects) - 1 - i
+			expiredCount := s.config.RetentionCount > 0 && newerCount >= s.config.RetentionCount
+			expiredDays := s.config.RetentionDays > 0 && object.LastModified.Before(minDate)
+			if !expiredCount && !expiredDays {
+				continue
+			}
+
+			if err = s.store.Delete(ctx, object.Key); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+	}
+	return deleted, nil
+}
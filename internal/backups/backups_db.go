@@ -0,0 +1,185 @@
+package backups
+
+import (
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/secrets"
+	"app-ez-pwd/internal/settings"
+	"app-ez-pwd/internal/storage"
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+	"io"
+	"time"
+)
+
+// backupLockKey is the advisory lock of the scheduled backups, the instance that takes it writes them.
+const backupLockKey = 7301
+
+type backupLock struct {
+	cn *pgx.Conn
+	tx pgx.Tx
+}
+
+// release commits the claimed interval with the end of the lock.
+func (l backupLock) release() {
+	if l.tx != nil {
+		if err := storage.ApplicationDB.Commit(l.cn, l.tx); err != nil {
+			logger.Logger.Error("err commit", zap.Error(err))
+		}
+	}
+}
+
+// tryLockDB takes the transaction lock, it's held until release.
+func tryLockDB() (backupLock, bool, error) {
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return backupLock{}, false, err
+	}
+	lock := backupLock{cn: cn, tx: tx}
+
+	var locked bool
+	if err = tx.QueryRow(context.Background(), "SELECT pg_try_advisory_xact_lock($1)", backupLockKey).Scan(&locked); err != nil {
+		logger.Logger.Error("err scan", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return backupLock{}, false, err
+	}
+	return lock, locked, nil
+}
+
+// claimIntervalDB saves the interval of the run in the lock transaction, false when another instance
+// already ran the backups of the interval: the timers of the instances aren't aligned.
+// Only the current interval is kept.
+func (l backupLock) claimIntervalDB(intervalStart time.Time) (bool, error) {
+	if _, err := l.tx.Exec(context.Background(), "DELETE FROM backup_runs WHERE interval_start < $1", intervalStart); err != nil {
+		logger.Logger.Error("err exec", zap.Error(err))
+		return false, err
+	}
+	tag, err := l.tx.Exec(context.Background(),
+		"INSERT INTO backup_runs (interval_start) VALUES ($1) ON CONFLICT (interval_start) DO NOTHING", intervalStart)
+	if err != nil {
+		logger.Logger.Error("err exec", zap.Error(err))
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func ListUserIdsDB() ([]int, error) {
+	query, queryArgs, _ := storage.ApplicationDB.Psql.
+		Select("id").
+		From("users").
+		OrderBy("id").ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	rows, err := tx.Query(context.Background(), query, queryArgs...)
+	if err != nil {
+		logger.Logger.Error("err query", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIds := make([]int, 0)
+	for rows.Next() {
+		var userId int
+		if err = rows.Scan(&userId); err != nil {
+			logger.Logger.Error("err scan", zap.Error(err))
+			return nil, err
+		}
+		userIds = append(userIds, userId)
+	}
+	return userIds, rows.Err()
+}
+
+// DatabaseManifest is the manifest.json of the database backup: a csv file per table.
+type DatabaseManifest struct {
+	FormatVersion int                          `json:"formatVersion"`
+	AppVersion    string                       `json:"appVersion"`
+	CreatedAt     time.Time                    `json:"createdAt"`
+	Tables        []secrets.BackupManifestFile `json:"tables"`
+}
+
+// writeDatabaseBackup copies every table of the public schema in the same snapshot,
+// the tables added later are included without changes here.
+func writeDatabaseBackup(w io.Writer) error {
+	cn, tx, err := storage.ApplicationDB.BeginTx(pgx.TxOptions{
+		IsoLevel:   pgx.RepeatableRead,
+		AccessMode: pgx.ReadOnly,
+	})
+	if err != nil {
+		return err
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	rows, err := tx.Query(context.Background(),
+		"SELECT table_name FROM information_schema.tables WHERE table_schema = 'public' AND table_type = 'BASE TABLE' ORDER BY table_name")
+	if err != nil {
+		logger.Logger.Error("err query", zap.Error(err))
+		return err
+	}
+	tableNames := make([]string, 0)
+	for rows.Next() {
+		var tableName string
+		if err = rows.Scan(&tableName); err != nil {
+			rows.Close()
+			return err
+		}
+		tableNames = append(tableNames, tableName)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	manifest := DatabaseManifest{
+		FormatVersion: secrets.BackupFormatVersion,
+		AppVersion:    settings.AppVersion,
+		CreatedAt:     time.Now().UTC(),
+		Tables:        make([]secrets.BackupManifestFile, 0),
+	}
+
+	zipWriter := zip.NewWriter(w)
+
+	for _, tableName := range tableNames {
+		fileName := tableName + ".csv"
+		fileWriter, err := zipWriter.Create(fileName)
+		if err != nil {
+			return err
+		}
+
+		hasher := sha256.New()
+		copyQuery := fmt.Sprintf("COPY (SELECT * FROM %s) TO STDOUT WITH (FORMAT csv, HEADER true)",
+			pgx.Identifier{tableName}.Sanitize())
+
+		result, err := cn.PgConn().CopyTo(context.Background(), io.MultiWriter(fileWriter, hasher), copyQuery)
+		if err != nil {
+			logger.Logger.Error("err copy to", zap.String("table", tableName), zap.Error(err))
+			return err
+		}
+
+		manifest.Tables = append(manifest.Tables, secrets.BackupManifestFile{
+			Name:   fileName,
+			Rows:   result.RowsAffected(),
+			SHA256: hex.EncodeToString(hasher.Sum(nil)),
+		})
+	}
+
+	manifestWriter, err := zipWriter.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(manifestWriter)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(manifest); err != nil {
+		return err
+	}
+	return zipWriter.Close()
+}
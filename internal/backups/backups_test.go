@@ -0,0 +1,110 @@
+package backups
+
+import (
+	"app-ez-pwd/internal/objectstore"
+	"app-ez-pwd/internal/objectstore/objectstoretest"
+	"app-ez-pwd/internal/settings"
+	"context"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyRetention(t *testing.T) {
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name           string
+		retentionCount int
+		retentionDays  int
+		expected       []string
+	}{
+		{"keeps all", 0, 0, []string{
+			"database/20260101T000000Z.zip",
+			"users/1/20260101T000000Z.zip", "users/1/20260201T000000Z.zip", "users/1/20260220T000000Z.zip", "users/1/20260228T000000Z.zip.ezpwd",
+			"users/2/20260101T000000Z.zip",
+		}},
+		{"by count", 2, 0, []string{
+			"database/20260101T000000Z.zip",
+			"users/1/20260220T000000Z.zip", "users/1/20260228T000000Z.zip.ezpwd",
+			"users/2/20260101T000000Z.zip",
+		}},
+		{"by days, the newest is kept", 0, 20, []string{
+			"database/20260101T000000Z.zip",
+			"users/1/20260220T000000Z.zip", "users/1/20260228T000000Z.zip.ezpwd",
+			"users/2/20260101T000000Z.zip",
+		}},
+		{"by count and days", 3, 40, []string{
+			"database/20260101T000000Z.zip",
+			"users/1/20260201T000000Z.zip", "users/1/20260220T000000Z.zip", "users/1/20260228T000000Z.zip.ezpwd",
+			"users/2/20260101T000000Z.zip",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := objectstoretest.NewS3Server("us-east-1", "ez-pwd", "access", "secret")
+			defer server.Close()
+			server.MaxKeys = 2
+
+			store, err := objectstore.NewS3Store(server.URL, server.Region, server.Bucket, server.AccessKey, server.SecretKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys := tests[0].expected
+			for _, key := range keys {
+				if err = store.Put(context.Background(), key, strings.NewReader(key), int64(len(key))); err != nil {
+					t.Fatal(err)
+				}
+				stamp := strings.TrimSuffix(strings.TrimSuffix(key[strings.LastIndex(key, "/")+1:], ".ezpwd"), ".zip")
+				lastModified, _ := time.Parse(keyTimeFormat, stamp)
+				server.SetLastModified(key, lastModified)
+			}
+
+			scheduler := &Scheduler{
+				config: settings.BackupScheduleSettings{RetentionCount: test.retentionCount, RetentionDays: test.retentionDays},
+				store:  store,
+			}
+			deleted, err := scheduler.applyRetention(context.Background(), ModeUsers+"/", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if remaining := server.Keys(); !reflect.DeepEqual(remaining, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, remaining)
+			}
+			if deleted != len(keys)-len(test.expected) {
+				t.Fatalf("expected %d deleted, got %d", len(keys)-len(test.expected), deleted)
+			}
+		})
+	}
+}
+
+func TestNewSchedulerDatabaseKey(t *testing.T) {
+	config := settings.BackupScheduleSettings{
+		IntervalMinutes: 60,
+		Mode:            ModeDatabase,
+		Store:           objectstore.Config{Dir: t.TempDir()},
+	}
+
+	if _, err := NewScheduler(config); err == nil {
+		t.Fatal("expected error without PUBLIC_KEY")
+	}
+
+	config.PublicKey = "invalid"
+	if _, err := NewScheduler(config); err == nil {
+		t.Fatal("expected error with an invalid PUBLIC_KEY")
+	}
+
+	config.PublicKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+	scheduler, err := NewScheduler(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scheduler.publicKey) != 32 {
+		t.Fatalf("expected the parsed key, got %d bytes", len(scheduler.publicKey))
+	}
+}
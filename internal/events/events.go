@@ -0,0 +1,110 @@
+package events
+
+import (
+	"sync"
+)
+
+const (
+	SecretCreated          = "secret.created"
+	SecretUpdated          = "secret.updated"
+	SecretDeleted          = "secret.deleted"
+	CategoryCreated        = "category.created"
+	AttachmentsChanged     = "secret.attachments" // id is the secret, an attachment was added or deleted
+	ShareUpdated           = "share.updated"      // id is the share, for the owner and the recipient
+	ShareRevoked           = "share.revoked"
+	OrganizationChanged    = "organization.changed" // id is the organization, the user was added, removed or the role changed
+	EmergencyAccessChanged = "emergency.changed"    // id is the emergency access, for the grantor and the grantee
+	VaultRestored          = "vault.restored"       // many changes, clients should sync
+)
+
+// Event is a change of the user vault, it only has ids: clients fetch the change with the sync api.
+type Event struct {
+	Type     string `json:"type"`
+	UserId   int    `json:"userId"`
+	EntityId int    `json:"id"`
+	Version  int    `json:"version,omitempty"`
+}
+
+// Broker delivers the events to the subscriptions of the same user.
+type Broker interface {
+	Publish(event Event)
+	// Subscribe returns the events channel and the function to cancel the subscription,
+	// the channel is closed on cancel or when the broker is closed.
+	Subscribe(userId int) (<-chan Event, func())
+	Close()
+}
+
+// Hub is the broker used by the application, by default it's in-process,
+// see NewPostgresBroker for deployments with more than one instance.
+var Hub Broker = NewMemoryBroker()
+
+// subscriptionBuffer is the number of events kept for a slow subscriber, newer events are dropped.
+const subscriptionBuffer = 32
+
+type MemoryBroker struct {
+	mu            sync.Mutex
+	closed        bool
+	subscriptions map[int]map[chan Event]struct{}
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subscriptions: make(map[int]map[chan Event]struct{})}
+}
+
+func (b *MemoryBroker) Publish(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for subscription := range b.subscriptions[event.UserId] {
+		select {
+		case subscription <- event:
+		default:
+		}
+	}
+}
+
+func (b *MemoryBroker) Subscribe(userId int) (<-chan Event, func()) {
+	subscription := make(chan Event, subscriptionBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		close(subscription)
+		return subscription, func() {}
+	}
+
+	if b.subscriptions[userId] == nil {
+		b.subscriptions[userId] = make(map[chan Event]struct{})
+	}
+	b.subscriptions[userId][subscription] = struct{}{}
+
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.subscriptions[userId][subscription]; !ok {
+			return
+		}
+		delete(b.subscriptions[userId], subscription)
+		if len(b.subscriptions[userId]) == 0 {
+			delete(b.subscriptions, userId)
+		}
+		close(subscription)
+	}
+	return subscription, cancel
+}
+
+// Close ends every subscription, the streams return so the server can shut down.
+func (b *MemoryBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for userId, userSubscriptions := range b.subscriptions {
+		for subscription := range userSubscriptions {
+			close(subscription)
+		}
+		delete(b.subscriptions, userId)
+	}
+}
@@ -0,0 +1,122 @@
+package events
+
+import (
+	"app-ez-pwd/internal/logger"
+	"context"
+	"encoding/json"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+const postgresChannel = "ez_pwd_events"
+
+// PostgresBroker publishes with NOTIFY and every instance delivers to its own subscriptions
+// what it receives with LISTEN, so the events reach the sessions connected to other instances.
+type PostgresBroker struct {
+	local      *MemoryBroker
+	connString string
+	cancel     context.CancelFunc
+
+	publishMu   sync.Mutex
+	publishConn *pgx.Conn // opened by the first Publish, reopened after an error
+}
+
+func NewPostgresBroker(connString string) *PostgresBroker {
+	listenCtx, cancel := context.WithCancel(context.Background())
+
+	b := &PostgresBroker{
+		local:      NewMemoryBroker(),
+		connString: connString,
+		cancel:     cancel,
+	}
+	go b.listen(listenCtx)
+	return b
+}
+
+func (b *PostgresBroker) Publish(event Event) {
+	payload, _ := json.Marshal(event)
+
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+
+	// the second try is for the connection closed by the server since the last event
+	for try := 0; try < 2; try++ {
+		if b.publishConn == nil {
+			cn, err := pgx.Connect(context.Background(), b.connString)
+			if err != nil {
+				logger.Logger.Error("pgx err connection", zap.Error(err))
+				return
+			}
+			b.publishConn = cn
+		}
+
+		_, err := b.publishConn.Exec(context.Background(), "SELECT pg_notify($1, $2)", postgresChannel, string(payload))
+		if err == nil {
+			return
+		}
+		logger.Logger.Error("err notify event", zap.Error(err))
+		b.closePublishConn()
+	}
+}
+
+func (b *PostgresBroker) closePublishConn() {
+	if b.publishConn != nil {
+		_ = b.publishConn.Close(context.Background())
+		b.publishConn = nil
+	}
+}
+
+func (b *PostgresBroker) Subscribe(userId int) (<-chan Event, func()) {
+	return b.local.Subscribe(userId)
+}
+
+func (b *PostgresBroker) Close() {
+	b.cancel()
+	b.local.Close()
+
+	b.publishMu.Lock()
+	b.closePublishConn()
+	b.publishMu.Unlock()
+}
+
+// listen keeps a connection with LISTEN, it reconnects until the broker is closed.
+func (b *PostgresBroker) listen(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := b.listenConnection(ctx); err != nil && ctx.Err() == nil {
+			logger.Logger.Error("err listening events, reconnecting", zap.Error(err))
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
+}
+
+func (b *PostgresBroker) listenConnection(ctx context.Context) error {
+	cn, err := pgx.Connect(ctx, b.connString)
+	if err != nil {
+		return err
+	}
+	defer cn.Close(context.Background())
+
+	if _, err = cn.Exec(ctx, "LISTEN "+postgresChannel); err != nil {
+		return err
+	}
+
+	for {
+		notification, err := cn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var event Event
+		if err = json.Unmarshal([]byte(notification.Payload), &event); err != nil {
+			logger.Logger.Warn("invalid event payload", zap.Error(err))
+			continue
+		}
+		b.local.Publish(event)
+	}
+}
@@ -0,0 +1,115 @@
+package importer
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+const (
+	bitwardenLogin      = 1
+	bitwardenSecureNote = 2
+	bitwardenCard       = 3
+	bitwardenIdentity   = 4
+)
+
+// bitwardenExport is the unencrypted json export, the encrypted one can't be read without the account key.
+type bitwardenExport struct {
+	Encrypted bool `json:"encrypted"`
+	Folders   []struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"folders"`
+	Items []bitwardenItem `json:"items"`
+}
+
+type bitwardenItem struct {
+	Type     int    `json:"type"`
+	Name     string `json:"name"`
+	Notes    string `json:"notes"`
+	FolderId string `json:"folderId"`
+	Favorite bool   `json:"favorite"`
+	Login    *struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Totp     string `json:"totp"`
+		Uris     []struct {
+			Uri string `json:"uri"`
+		} `json:"uris"`
+	} `json:"login"`
+	Fields []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"fields"`
+	Card     map[string]interface{} `json:"card"`
+	Identity map[string]interface{} `json:"identity"`
+}
+
+func parseBitwardenJSON(r io.Reader) ([]Item, error) {
+	var export bitwardenExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, invalidFile("it isn't a Bitwarden json export")
+	}
+	if export.Encrypted {
+		return nil, invalidFile("the Bitwarden export is encrypted, export it as json without encryption")
+	}
+
+	folderNames := make(map[string]string)
+	for _, folder := range export.Folders {
+		folderNames[folder.Id] = folder.Name
+	}
+
+	items := make([]Item, 0, len(export.Items))
+	for _, bitwardenItem := range export.Items {
+		item := Item{
+			Category:    folderNames[bitwardenItem.FolderId],
+			Description: bitwardenItem.Name,
+			SafeNote:    bitwardenItem.Notes,
+			Tags:        make([]string, 0),
+		}
+		if bitwardenItem.Favorite {
+			item.Tags = append(item.Tags, "favorite")
+		}
+
+		switch bitwardenItem.Type {
+		case bitwardenLogin:
+			if bitwardenItem.Login != nil {
+				item.Username = bitwardenItem.Login.Username
+				item.Password = bitwardenItem.Login.Password
+				for i, uri := range bitwardenItem.Login.Uris {
+					if i == 0 {
+						item.URLSite = uri.Uri
+					} else {
+						item.SafeNote = appendNote(item.SafeNote, "URL", uri.Uri)
+					}
+				}
+				item.SafeNote = appendNote(item.SafeNote, "TOTP", bitwardenItem.Login.Totp)
+			}
+		case bitwardenCard:
+			item.SafeNote = appendObjectNote(item.SafeNote, bitwardenItem.Card)
+			item.Tags = append(item.Tags, "card")
+		case bitwardenIdentity:
+			item.SafeNote = appendObjectNote(item.SafeNote, bitwardenItem.Identity)
+			item.Tags = append(item.Tags, "identity")
+		case bitwardenSecureNote:
+			item.Tags = append(item.Tags, "note")
+		}
+
+		for _, field := range bitwardenItem.Fields {
+			item.SafeNote = appendNote(item.SafeNote, field.Name, field.Value)
+		}
+
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// appendObjectNote adds the string fields of the card or identity, ex: "number: 4111..."
+func appendObjectNote(note string, object map[string]interface{}) string {
+	for _, key := range sortedKeys(object) {
+		if value, ok := object[key].(string); ok && strings.TrimSpace(value) != "" {
+			note = appendNote(note, key, value)
+		}
+	}
+	return note
+}
@@ -0,0 +1,177 @@
+package importer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	columnCategory    = "category"
+	columnDescription = "description"
+	columnUsername    = "username"
+	columnPassword    = "password"
+	columnNote        = "note"
+	columnURL         = "url"
+	columnTags        = "tags"
+	columnIgnored     = "-" // the column isn't imported, ex: the icon
+)
+
+// csvColumns maps the header (lowercase) to the item field, the other columns are appended to the safe note.
+type csvColumns map[string]string
+
+// keePassCSVColumns reads the csv of KeePassXC and of KeePass 2.
+var keePassCSVColumns = csvColumns{
+	"group":         columnCategory,
+	"title":         columnDescription,
+	"account":       columnDescription,
+	"username":      columnUsername,
+	"login name":    columnUsername,
+	"password":      columnPassword,
+	"url":           columnURL,
+	"web site":      columnURL,
+	"notes":         columnNote,
+	"comments":      columnNote,
+	"icon":          columnIgnored,
+	"last modified": columnIgnored,
+	"created":       columnIgnored,
+}
+
+// onePasswordCSVColumns reads the csv of 1Password 7 and 8, the header names changed between versions.
+var onePasswordCSVColumns = csvColumns{
+	"title":      columnDescription,
+	"url":        columnURL,
+	"urls":       columnURL,
+	"website":    columnURL,
+	"username":   columnUsername,
+	"password":   columnPassword,
+	"notes":      columnNote,
+	"notesplain": columnNote,
+	"tags":       columnTags,
+	"vault":      columnCategory,
+	"favorite":   columnIgnored,
+	"archived":   columnIgnored,
+	"uuid":       columnIgnored,
+}
+
+var lastPassCSVColumns = csvColumns{
+	"grouping": columnCategory,
+	"name":     columnDescription,
+	"username": columnUsername,
+	"password": columnPassword,
+	"url":      columnURL,
+	"extra":    columnNote,
+	"fav":      columnIgnored,
+}
+
+const utf8BOM = "\ufeff"
+
+// lastPassNoteURL is the url of the secure notes in the LastPass export.
+const lastPassNoteURL = "http://sn"
+
+func parseLastPassCSV(r io.Reader) ([]Item, error) {
+	items, err := parseCSV(r, lastPassCSVColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range items {
+		if items[i].URLSite == lastPassNoteURL {
+			items[i].URLSite = ""
+			items[i].Tags = append(items[i].Tags, "note")
+		}
+		// the subfolders are separated by backslash, the category is the last folder
+		folders := strings.Split(items[i].Category, "\\")
+		items[i].Category = folders[len(folders)-1]
+	}
+	return items, nil
+}
+
+func parseCSV(r io.Reader, columns csvColumns) ([]Item, error) {
+	// the BOM is before the first quote of the header, the csv reader would keep it with the quotes
+	bufReader := bufio.NewReader(r)
+	if bom, _ := bufReader.Peek(len(utf8BOM)); string(bom) == utf8BOM {
+		_, _ = bufReader.Discard(len(utf8BOM))
+	}
+
+	csvReader := csv.NewReader(bufReader)
+	csvReader.FieldsPerRecord = -1
+	csvReader.LazyQuotes = true
+
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, invalidFile("it isn't a csv file")
+	}
+
+	fields := make([]string, len(header))
+	knownColumns := 0
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		header[i] = strings.TrimSpace(header[i])
+		fields[i] = columns[name]
+		if fields[i] != "" && fields[i] != columnIgnored {
+			knownColumns++
+		}
+	}
+	if knownColumns < 2 {
+		return nil, invalidFile("the csv header doesn't have the columns of the format")
+	}
+
+	items := make([]Item, 0)
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, invalidFile("%v", err)
+		}
+
+		item := Item{Tags: make([]string, 0)}
+		extraNote := ""
+		for i, value := range record {
+			if i >= len(fields) {
+				break
+			}
+			switch fields[i] {
+			case columnCategory:
+				item.Category = value
+			case columnDescription:
+				item.Description = value
+			case columnUsername:
+				item.Username = value
+			case columnPassword:
+				item.Password = value
+			case columnURL:
+				item.URLSite = value
+			case columnNote:
+				item.SafeNote = appendNote(item.SafeNote, "", value)
+			case columnTags:
+				item.Tags = append(item.Tags, splitTags(value)...)
+			case columnIgnored:
+			default:
+				extraNote = appendNote(extraNote, header[i], value)
+			}
+		}
+		if extraNote != "" {
+			item.SafeNote = appendNote(item.SafeNote, "", extraNote)
+		}
+
+		if item.Description == "" && item.Username == "" && item.Password == "" && item.URLSite == "" && item.SafeNote == "" {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
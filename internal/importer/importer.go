@@ -0,0 +1,174 @@
+// Package importer reads the exports of other password managers into the plaintext items of this vault,
+// the client encrypts them and sends the batch back: the server never stores the plaintext.
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-ozzo/ozzo-validation/v4/is"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	FormatBitwardenJSON = "bitwarden-json"
+	FormatKeePassXML    = "keepass-xml"
+	FormatKeePassCSV    = "keepass-csv"
+	Format1PasswordCSV  = "1password-csv"
+	FormatLastPassCSV   = "lastpass-csv"
+)
+
+var Formats = []interface{}{FormatBitwardenJSON, FormatKeePassXML, FormatKeePassCSV, Format1PasswordCSV, FormatLastPassCSV}
+
+// DefaultCategory is for the items without folder or group.
+const DefaultCategory = "Imported"
+
+const (
+	maxCategoryLen = 50
+	maxFieldLen    = 250
+	maxTags        = 20
+	maxTagLen      = 50
+)
+
+// ErrInvalidFile is returned when the file isn't of the format, the message says what is wrong.
+var ErrInvalidFile = errors.New("importer: invalid file")
+
+func invalidFile(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidFile, fmt.Sprintf(format, args...))
+}
+
+// Item is a secret in plaintext, the fields without a column (totp, custom fields, other urls...)
+// are appended to the safe note so nothing is lost.
+type Item struct {
+	Category    string   `json:"category"`
+	Description string   `json:"description"`
+	Username    string   `json:"username"`
+	Password    string   `json:"password"`
+	SafeNote    string   `json:"safeNote"`
+	URLSite     string   `json:"urlSite"`
+	Tags        []string `json:"tags"`
+}
+
+type Result struct {
+	Format     string   `json:"format"`
+	Categories []string `json:"categories"`
+	Items      []Item   `json:"items"`
+	Warnings   []string `json:"warnings"`
+}
+
+func Parse(format string, r io.Reader) (Result, error) {
+	var items []Item
+	var err error
+
+	switch format {
+	case FormatBitwardenJSON:
+		items, err = parseBitwardenJSON(r)
+	case FormatKeePassXML:
+		items, err = parseKeePassXML(r)
+	case FormatKeePassCSV:
+		items, err = parseCSV(r, keePassCSVColumns)
+	case Format1PasswordCSV:
+		items, err = parseCSV(r, onePasswordCSVColumns)
+	case FormatLastPassCSV:
+		items, err = parseLastPassCSV(r)
+	default:
+		return Result{}, invalidFile("unknown format %q", format)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+
+	result := Result{Format: format, Categories: make([]string, 0), Items: make([]Item, 0, len(items)), Warnings: make([]string, 0)}
+	seenCategories := make(map[string]bool)
+
+	for i, item := range items {
+		item, warnings := normalize(item)
+		for _, warning := range warnings {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("item %d (%s): %s", i+1, item.Description, warning))
+		}
+
+		if !seenCategories[strings.ToUpper(item.Category)] {
+			seenCategories[strings.ToUpper(item.Category)] = true
+			result.Categories = append(result.Categories, item.Category)
+		}
+		result.Items = append(result.Items, item)
+	}
+	return result, nil
+}
+
+// normalize fits the item to the columns of the vault: the values that don't fit are moved to the safe note.
+func normalize(item Item) (Item, []string) {
+	warnings := make([]string, 0)
+
+	item.Category = truncate(strings.TrimSpace(item.Category), maxCategoryLen)
+	if item.Category == "" {
+		item.Category = DefaultCategory
+	}
+
+	item.Username = strings.TrimSpace(item.Username)
+	item.URLSite = strings.TrimSpace(item.URLSite)
+	item.SafeNote = strings.TrimSpace(item.SafeNote)
+
+	item.Description = strings.TrimSpace(item.Description)
+	if item.Description == "" {
+		item.Description = item.URLSite
+	}
+	if utf8.RuneCountInString(item.Description) > maxFieldLen {
+		item.SafeNote = appendNote(item.SafeNote, "Title", item.Description)
+		item.Description = truncate(item.Description, maxFieldLen)
+		warnings = append(warnings, "the title was truncated, the full title is in the safe note")
+	}
+
+	if utf8.RuneCountInString(item.Username) > maxFieldLen {
+		item.SafeNote = appendNote(item.SafeNote, "Username", item.Username)
+		item.Username = ""
+		warnings = append(warnings, "the username is too long, it was moved to the safe note")
+	}
+
+	if item.URLSite != "" && (utf8.RuneCountInString(item.URLSite) > maxFieldLen || is.URL.Validate(item.URLSite) != nil) {
+		item.SafeNote = appendNote(item.SafeNote, "URL", item.URLSite)
+		item.URLSite = ""
+		warnings = append(warnings, "the url isn't valid, it was moved to the safe note")
+	}
+
+	tags := make([]string, 0, len(item.Tags))
+	seenTags := make(map[string]bool)
+	for _, tag := range item.Tags {
+		tag = truncate(strings.TrimSpace(tag), maxTagLen)
+		if tag == "" || seenTags[tag] {
+			continue
+		}
+		if len(tags) == maxTags {
+			warnings = append(warnings, fmt.Sprintf("only the first %d tags were kept", maxTags))
+			break
+		}
+		seenTags[tag] = true
+		tags = append(tags, tag)
+	}
+	item.Tags = tags
+
+	return item, warnings
+}
+
+func appendNote(note, name, value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return note
+	}
+	line := value
+	if name != "" {
+		line = name + ": " + value
+	}
+	if note == "" {
+		return line
+	}
+	return note + "\n" + line
+}
+
+func truncate(value string, maxLen int) string {
+	if utf8.RuneCountInString(value) <= maxLen {
+		return value
+	}
+	return string([]rune(value)[:maxLen])
+}
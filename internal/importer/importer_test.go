@@ -0,0 +1,241 @@
+package importer
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const bitwardenExportJSON = `{
+  "encrypted": false,
+  "folders": [{"id": "f1", "name": "Work"}],
+  "items": [
+    {
+      "type": 1, "name": "GitHub", "folderId": "f1", "favorite": true, "notes": "main account",
+      "login": {
+        "username": "octo", "password": "pw1", "totp": "otpauth://totp/gh?secret=ABC",
+        "uris": [{"uri": "https://github.com"}, {"uri": "https://gist.github.com"}]
+      },
+      "fields": [{"name": "PIN", "value": "1234"}, {"name": "empty", "value": ""}]
+    },
+    {"type": 2, "name": "Wifi", "folderId": null, "notes": "the wifi key", "secureNote": {"type": 0}},
+    {"type": 3, "name": "Visa", "card": {"cardholderName": "Ann", "number": "4111", "code": "123", "expYear": null}},
+    {"type": 4, "name": "Passport", "folderId": "f1", "identity": {"firstName": "Ann", "passportNumber": "X1"}}
+  ]
+}`
+
+const keePassExportXML = `<?xml version="1.0" encoding="utf-8" standalone="yes"?>
+<KeePassFile>
+  <Meta><RecycleBinUUID>bin</RecycleBinUUID></Meta>
+  <Root>
+    <Group>
+      <UUID>root</UUID><Name>Database</Name>
+      <Entry>
+        <String><Key>Title</Key><Value>Root entry</Value></String>
+        <String><Key>Password</Key><Value>r</Value></String>
+      </Entry>
+      <Group>
+        <UUID>g1</UUID><Name>Email</Name>
+        <Entry>
+          <String><Key>Recovery</Key><Value>codes</Value></String>
+          <String><Key>Notes</Key><Value>personal</Value></String>
+          <String><Key>Title</Key><Value>Mail</Value></String>
+          <String><Key>UserName</Key><Value>ann</Value></String>
+          <String><Key>URL</Key><Value>https://mail.example.com</Value></String>
+          <Tags>web;mail</Tags>
+          <History>
+            <Entry><String><Key>Password</Key><Value>old</Value></String></Entry>
+          </History>
+          <String><Key>Password</Key><Value>new</Value></String>
+        </Entry>
+        <Group>
+          <UUID>g2</UUID><Name>Old</Name>
+          <Entry><String><Key>Title</Key><Value>Nested</Value></String></Entry>
+        </Group>
+      </Group>
+      <Group>
+        <UUID>bin</UUID><Name>Recycle Bin</Name>
+        <Entry><String><Key>Title</Key><Value>Deleted</Value></String></Entry>
+        <Group>
+          <UUID>g3</UUID><Name>Inside</Name>
+          <Entry><String><Key>Title</Key><Value>Deleted nested</Value></String></Entry>
+        </Group>
+      </Group>
+    </Group>
+  </Root>
+</KeePassFile>`
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     string
+		content    string
+		categories []string
+		items      []Item
+		warnings   int
+	}{
+		{
+			name:       "bitwarden json",
+			format:     FormatBitwardenJSON,
+			content:    bitwardenExportJSON,
+			categories: []string{"Work", DefaultCategory},
+			items: []Item{
+				{
+					Category: "Work", Description: "GitHub", Username: "octo", Password: "pw1", URLSite: "https://github.com",
+					SafeNote: "main account\nURL: https://gist.github.com\nTOTP: otpauth://totp/gh?secret=ABC\nPIN: 1234",
+					Tags:     []string{"favorite"},
+				},
+				{Category: DefaultCategory, Description: "Wifi", SafeNote: "the wifi key", Tags: []string{"note"}},
+				{Category: DefaultCategory, Description: "Visa", SafeNote: "cardholderName: Ann\ncode: 123\nnumber: 4111", Tags: []string{"card"}},
+				{Category: "Work", Description: "Passport", SafeNote: "firstName: Ann\npassportNumber: X1", Tags: []string{"identity"}},
+			},
+		},
+		{
+			name:       "keepass xml with nested groups and recycle bin",
+			format:     FormatKeePassXML,
+			content:    keePassExportXML,
+			categories: []string{DefaultCategory, "Email", "Old"},
+			items: []Item{
+				{Category: DefaultCategory, Description: "Root entry", Password: "r", Tags: []string{}},
+				{
+					Category: "Email", Description: "Mail", Username: "ann", Password: "new", URLSite: "https://mail.example.com",
+					SafeNote: "personal\nRecovery: codes", Tags: []string{"web", "mail"},
+				},
+				{Category: "Old", Description: "Nested", Tags: []string{}},
+			},
+		},
+		{
+			name:   "keepassxc csv",
+			format: FormatKeePassCSV,
+			content: "\ufeff\"Group\",\"Title\",\"Username\",\"Password\",\"URL\",\"Notes\",\"TOTP\",\"Icon\",\"Last Modified\",\"Created\"\n" +
+				"\"Root/Social\",\"Twitter\",\"bird\",\"pw\",\"https://twitter.com\",\"note one\",\"otpauth://totp/x\",\"0\",\"2024\",\"2024\"\n" +
+				"\"Root\",\"\",\"\",\"\",\"\",\"\",\"\",\"0\",\"2024\",\"2024\"\n",
+			categories: []string{"Root/Social"},
+			items: []Item{
+				{
+					Category: "Root/Social", Description: "Twitter", Username: "bird", Password: "pw", URLSite: "https://twitter.com",
+					SafeNote: "note one\nTOTP: otpauth://totp/x", Tags: []string{},
+				},
+			},
+		},
+		{
+			name:   "keepass 2 csv with invalid url",
+			format: FormatKeePassCSV,
+			content: "\"Account\",\"Login Name\",\"Password\",\"Web Site\",\"Comments\"\n" +
+				"\"Bank\",\"me\",\"pw\",\"not a url\",\"c\"\n",
+			categories: []string{DefaultCategory},
+			items: []Item{
+				{Category: DefaultCategory, Description: "Bank", Username: "me", Password: "pw", SafeNote: "c\nURL: not a url", Tags: []string{}},
+			},
+			warnings: 1,
+		},
+		{
+			name:   "1password 8 csv",
+			format: Format1PasswordCSV,
+			content: "Title,Url,Username,Password,OTPAuth,Favorite,Archived,Tags,Notes\n" +
+				"Shop,https://shop.example.com,u,p,,true,false,\"a;b,a\",n\n",
+			categories: []string{DefaultCategory},
+			items: []Item{
+				{Category: DefaultCategory, Description: "Shop", Username: "u", Password: "p", URLSite: "https://shop.example.com", SafeNote: "n", Tags: []string{"a", "b"}},
+			},
+		},
+		{
+			name:   "1password 7 csv",
+			format: Format1PasswordCSV,
+			content: "title,website,username,password,notesPlain,vault\n" +
+				"Mail,https://mail.example.com,u7,p7,\"multi\nline\",Personal\n",
+			categories: []string{"Personal"},
+			items: []Item{
+				{Category: "Personal", Description: "Mail", Username: "u7", Password: "p7", URLSite: "https://mail.example.com", SafeNote: "multi\nline", Tags: []string{}},
+			},
+		},
+		{
+			name:   "lastpass csv",
+			format: FormatLastPassCSV,
+			content: "url,username,password,totp,extra,name,grouping,fav\n" +
+				"https://example.com,lu,lp,,extra note,Example,Parent\\Child,1\n" +
+				"http://sn,,,,NoteType:Server,Server note,,0\n",
+			categories: []string{"Child", DefaultCategory},
+			items: []Item{
+				{Category: "Child", Description: "Example", Username: "lu", Password: "lp", URLSite: "https://example.com", SafeNote: "extra note", Tags: []string{}},
+				{Category: DefaultCategory, Description: "Server note", SafeNote: "NoteType:Server", Tags: []string{"note"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := Parse(test.format, strings.NewReader(test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result.Categories, test.categories) {
+				t.Fatalf("categories: expected %q, got %q", test.categories, result.Categories)
+			}
+			if len(result.Items) != len(test.items) {
+				t.Fatalf("expected %d items, got %d: %+v", len(test.items), len(result.Items), result.Items)
+			}
+			for i := range test.items {
+				if !reflect.DeepEqual(result.Items[i], test.items[i]) {
+					t.Fatalf("item %d:\nexpected %+v\ngot      %+v", i, test.items[i], result.Items[i])
+				}
+			}
+			if len(result.Warnings) != test.warnings {
+				t.Fatalf("expected %d warnings, got %q", test.warnings, result.Warnings)
+			}
+		})
+	}
+}
+
+func TestParseInvalidFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		content string
+	}{
+		{"unknown format", "dashlane-csv", "a,b\n"},
+		{"encrypted bitwarden", FormatBitwardenJSON, `{"encrypted": true, "items": []}`},
+		{"bitwarden not json", FormatBitwardenJSON, "url,username\n"},
+		{"keepass not xml", FormatKeePassXML, `{"items": []}`},
+		{"csv of another format", FormatLastPassCSV, "Title,Notes\nA,B\n"},
+		{"empty csv", FormatKeePassCSV, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Parse(test.format, strings.NewReader(test.content)); !errors.Is(err, ErrInvalidFile) {
+				t.Fatalf("expected ErrInvalidFile, got %v", err)
+			}
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	longTitle := strings.Repeat("t", maxFieldLen+10)
+	tags := make([]string, 0)
+	for i := 0; i < maxTags+5; i++ {
+		tags = append(tags, strings.Repeat("x", i+1))
+	}
+
+	item, warnings := normalize(Item{
+		Category:    "  ",
+		Description: longTitle,
+		Username:    strings.Repeat("u", maxFieldLen+1),
+		URLSite:     " https://example.com ",
+		Tags:        append(tags, "x", " "),
+	})
+
+	if item.Category != DefaultCategory || item.URLSite != "https://example.com" || item.Username != "" {
+		t.Fatalf("unexpected item %+v", item)
+	}
+	if len([]rune(item.Description)) != maxFieldLen || !strings.Contains(item.SafeNote, "Title: "+longTitle) {
+		t.Fatal("the long title must be truncated and kept in the safe note")
+	}
+	if !strings.Contains(item.SafeNote, "Username: u") {
+		t.Fatal("the long username must be moved to the safe note")
+	}
+	if len(item.Tags) != maxTags || len(warnings) != 3 {
+		t.Fatalf("expected %d tags and 3 warnings, got %d tags and %q", maxTags, len(item.Tags), warnings)
+	}
+}
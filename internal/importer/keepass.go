@@ -0,0 +1,86 @@
+package importer
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// keePassFile is the KeePass 2 xml export (also KeePassXC), the entries are in nested groups.
+type keePassFile struct {
+	XMLName xml.Name `xml:"KeePassFile"`
+	Meta    struct {
+		RecycleBinUUID string `xml:"RecycleBinUUID"`
+	} `xml:"Meta"`
+	Root struct {
+		Groups []keePassGroup `xml:"Group"`
+	} `xml:"Root"`
+}
+
+type keePassGroup struct {
+	UUID    string         `xml:"UUID"`
+	Name    string         `xml:"Name"`
+	Entries []keePassEntry `xml:"Entry"`
+	Groups  []keePassGroup `xml:"Group"`
+}
+
+// keePassEntry only reads the direct String elements: the History has the old versions of the entry.
+type keePassEntry struct {
+	Strings []struct {
+		Key   string `xml:"Key"`
+		Value string `xml:"Value"`
+	} `xml:"String"`
+	Tags string `xml:"Tags"`
+}
+
+func parseKeePassXML(r io.Reader) ([]Item, error) {
+	var file keePassFile
+	if err := xml.NewDecoder(r).Decode(&file); err != nil {
+		return nil, invalidFile("it isn't a KeePass xml export")
+	}
+
+	items := make([]Item, 0)
+	for _, rootGroup := range file.Root.Groups {
+		// the entries of the root group go to the default category, the subgroups are the categories
+		items = appendKeePassGroup(items, rootGroup, "", file.Meta.RecycleBinUUID)
+	}
+	return items, nil
+}
+
+func appendKeePassGroup(items []Item, group keePassGroup, category, recycleBinUUID string) []Item {
+	if recycleBinUUID != "" && group.UUID == recycleBinUUID {
+		return items
+	}
+
+	for _, entry := range group.Entries {
+		item := Item{Category: category, Tags: splitTags(entry.Tags)}
+		for _, field := range entry.Strings {
+			switch field.Key {
+			case "Title":
+				item.Description = field.Value
+			case "UserName":
+				item.Username = field.Value
+			case "Password":
+				item.Password = field.Value
+			case "URL":
+				item.URLSite = field.Value
+			case "Notes":
+				// the notes go before the other fields already appended
+				item.SafeNote = appendNote(field.Value, "", item.SafeNote)
+			default:
+				item.SafeNote = appendNote(item.SafeNote, field.Key, field.Value)
+			}
+		}
+		items = append(items, item)
+	}
+
+	for _, subgroup := range group.Groups {
+		items = appendKeePassGroup(items, subgroup, subgroup.Name, recycleBinUUID)
+	}
+	return items
+}
+
+// splitTags reads the KeePass tags, separated by ; or ,
+func splitTags(rawTags string) []string {
+	return strings.FieldsFunc(rawTags, func(r rune) bool { return r == ';' || r == ',' })
+}
@@ -0,0 +1,45 @@
+// Package jobs runs the periodic maintenance of the api in the background: every instance runs them,
+// so the jobs must be safe to run at the same time.
+package jobs
+
+import (
+	"context"
+	"time"
+)
+
+type Job struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Start calls run every interval until Stop, the first run is after one interval.
+func Start(interval time.Duration, run func()) *Job {
+	runCtx, cancel := context.WithCancel(context.Background())
+	job := &Job{cancel: cancel, done: make(chan struct{})}
+
+	go func() {
+		defer close(job.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-runCtx.Done():
+				return
+			case <-ticker.C:
+				run()
+			}
+		}
+	}()
+	return job
+}
+
+// Stop waits for the running call.
+func (j *Job) Stop() {
+	if j == nil {
+		return
+	}
+	j.cancel()
+	<-j.done
+}
@@ -0,0 +1,113 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type LocalStore struct {
+	dir string
+}
+
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &LocalStore{dir: dir}, nil
+}
+
+func (s *LocalStore) path(key string) (string, error) {
+	cleanKey := filepath.Clean("/" + key)
+	if cleanKey == "/" || strings.Contains(key, "..") {
+		return "", fmt.Errorf("objectstore: invalid key %q", key)
+	}
+	return filepath.Join(s.dir, cleanKey), nil
+}
+
+// Put writes to a temporary file and renames it, a failed Put doesn't leave a partial object.
+func (s *LocalStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	objectPath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(objectPath), 0700); err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(objectPath), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	written, err := io.Copy(tmpFile, r)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && size >= 0 && written != size {
+		err = fmt.Errorf("objectstore: wrote %d bytes, expected %d", written, size)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), objectPath)
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	objectPath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(objectPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	objectPath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(objectPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStore) List(ctx context.Context, prefix string) ([]Object, error) {
+	objects := make([]Object, 0)
+
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".tmp-") {
+			return nil
+		}
+
+		relativePath, _ := filepath.Rel(s.dir, path)
+		key := filepath.ToSlash(relativePath)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, Object{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+		return nil
+	})
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, err
+}
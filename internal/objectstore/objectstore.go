@@ -0,0 +1,52 @@
+// Package objectstore saves files by key in a local directory or in an S3-compatible bucket.
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrNotFound = errors.New("objectstore: object not found")
+
+type Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+type Store interface {
+	// Put saves the size bytes of r, the key can have slashes: users/1/backup.zip
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get returns ErrNotFound when the key doesn't exist.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// List returns the objects with the key prefix sorted by key.
+	List(ctx context.Context, prefix string) ([]Object, error)
+}
+
+// Config is the store of the configuration file: Dir for the local directory or the S3 fields.
+type Config struct {
+	Dir         string `json:"DIR"`
+	S3Endpoint  string `json:"S3_ENDPOINT"` // ex: https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	S3Region    string `json:"S3_REGION"`
+	S3Bucket    string `json:"S3_BUCKET"`
+	S3AccessKey string `json:"S3_ACCESS_KEY"`
+	S3SecretKey string `json:"S3_SECRET_KEY"`
+}
+
+func (c Config) Enabled() bool {
+	return c.Dir != "" || c.S3Endpoint != ""
+}
+
+// New returns the S3 store when S3Endpoint is set, otherwise the local store.
+func New(config Config) (Store, error) {
+	if config.S3Endpoint != "" {
+		return NewS3Store(config.S3Endpoint, config.S3Region, config.S3Bucket, config.S3AccessKey, config.S3SecretKey)
+	}
+	if config.Dir == "" {
+		return nil, errors.New("objectstore: DIR or S3_ENDPOINT is required")
+	}
+	return NewLocalStore(config.Dir)
+}
@@ -0,0 +1,309 @@
+// Package objectstoretest is an in-memory S3 stand-in for the tests of the S3 store, it checks
+// the signature V4 of every request like MinIO and answers the same xml.
+package objectstoretest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxClockSkew is the difference between x-amz-date and the server clock accepted by S3.
+const MaxClockSkew = 15 * time.Minute
+
+type object struct {
+	content      []byte
+	lastModified time.Time
+}
+
+type S3Server struct {
+	*httptest.Server
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	MaxKeys   int // objects per page of the list, 1000 like S3
+
+	mu       sync.Mutex
+	objects  map[string]object
+	requests int
+}
+
+// NewS3Server starts the stand-in, Close must be called.
+func NewS3Server(region, bucket, accessKey, secretKey string) *S3Server {
+	s := &S3Server{
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		MaxKeys:   1000,
+		objects:   make(map[string]object),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Keys are the keys of the bucket sorted.
+func (s *S3Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SetLastModified changes the date of the object, false when the key doesn't exist.
+func (s *S3Server) SetLastModified(key string, lastModified time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.objects[key]
+	if ok {
+		stored.lastModified = lastModified
+		s.objects[key] = stored
+	}
+	return ok
+}
+
+// Requests is the count of the signed requests received.
+func (s *S3Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *S3Server) handle(w http.ResponseWriter, r *http.Request) {
+	if err := s.verifySignature(r); err != nil {
+		writeError(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+
+	bucketPath := "/" + s.Bucket
+	if r.URL.Path != bucketPath && !strings.HasPrefix(r.URL.Path, bucketPath+"/") {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "the bucket doesn't exist")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, bucketPath), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+
+	switch {
+	case key == "" && r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		s.list(w, r.URL.Query())
+	case key == "":
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "the method isn't allowed on the bucket")
+	case r.Method == http.MethodPut:
+		content, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(content)) != r.ContentLength {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", "the body doesn't have Content-Length bytes")
+			return
+		}
+		s.objects[key] = object{content: content, lastModified: time.Now().UTC()}
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet:
+		stored, ok := s.objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "the key doesn't exist")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(stored.content)))
+		_, _ = w.Write(stored.content)
+	case r.Method == http.MethodDelete:
+		// like S3: deleting a missing key isn't an error
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "the method isn't allowed on the object")
+	}
+}
+
+type listContent struct {
+	Key          string `xml:"Key"`
+	Size         int    `xml:"Size"`
+	LastModified string `xml:"LastModified"`
+}
+
+type listResult struct {
+	XMLName               xml.Name      `xml:"ListBucketResult"`
+	Name                  string        `xml:"Name"`
+	Prefix                string        `xml:"Prefix"`
+	KeyCount              int           `xml:"KeyCount"`
+	IsTruncated           bool          `xml:"IsTruncated"`
+	NextContinuationToken string        `xml:"NextContinuationToken,omitempty"`
+	Contents              []listContent `xml:"Contents"`
+}
+
+// list answers the ListObjectsV2 pages, the continuation token is the last key of the page.
+func (s *S3Server) list(w http.ResponseWriter, query url.Values) {
+	prefix := query.Get("prefix")
+	after := query.Get("continuation-token")
+
+	keys := make([]string, 0)
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := listResult{Name: s.Bucket, Prefix: prefix, Contents: make([]listContent, 0)}
+	if len(keys) > s.MaxKeys {
+		keys = keys[:s.MaxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, listContent{
+			Key:          key,
+			Size:         len(s.objects[key].content),
+			LastModified: s.objects[key].lastModified.Format(time.RFC3339Nano),
+		})
+	}
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write([]byte(xml.Header))
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, message)
+}
+
+// verifySignature recomputes the signature V4 of the request with the headers it says it signed.
+func (s *S3Server) verifySignature(r *http.Request) error {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 ") {
+		return fmt.Errorf("missing AWS4-HMAC-SHA256 authorization")
+	}
+
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(authorization, "AWS4-HMAC-SHA256 "), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		fields[name] = value
+	}
+
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[0] != s.AccessKey {
+		return fmt.Errorf("invalid access key")
+	}
+	if credential[2] != s.Region || credential[3] != "s3" || credential[4] != "aws4_request" {
+		return fmt.Errorf("invalid credential scope %q", fields["Credential"])
+	}
+
+	amzDate := r.Header.Get("x-amz-date")
+	requestTime, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || credential[1] != requestTime.Format("20060102") {
+		return fmt.Errorf("invalid x-amz-date %q", amzDate)
+	}
+	if skew := time.Since(requestTime); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return fmt.Errorf("x-amz-date is too far from the server time")
+	}
+
+	payloadHash := r.Header.Get("x-amz-content-sha256")
+	if payloadHash == "" {
+		return fmt.Errorf("missing x-amz-content-sha256")
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	if !sort.StringsAreSorted(signedHeaders) {
+		return fmt.Errorf("the signed headers must be sorted")
+	}
+	signed := make(map[string]bool)
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		signed[name] = true
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	for _, required := range []string{"host", "x-amz-content-sha256", "x-amz-date"} {
+		if !signed[required] {
+			return fmt.Errorf("%s must be signed", required)
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		canonicalURI(r.URL.Path),
+		canonicalQueryString(r.URL.Query()),
+		canonicalHeaders.String(),
+		fields["SignedHeaders"],
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join(credential[1:], "/")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	signingKey := []byte("AWS4" + s.SecretKey)
+	for _, part := range credential[1:] {
+		signingKey = sign(signingKey, part)
+	}
+	expected := hex.EncodeToString(sign(signingKey, stringToSign))
+
+	if !hmac.Equal([]byte(expected), []byte(fields["Signature"])) {
+		return fmt.Errorf("the signature doesn't match")
+	}
+	return nil
+}
+
+// uriEncode is the encoding of the signature: everything but the unreserved characters of RFC 3986.
+func uriEncode(value string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+func canonicalURI(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return uriEncode(path, false)
+}
+
+func canonicalQueryString(query url.Values) string {
+	parts := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			parts = append(parts, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "&")
+}
+
+func sign(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
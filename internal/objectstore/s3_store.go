@@ -0,0 +1,223 @@
+package objectstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Store is a minimal S3 client with path-style urls (endpoint/bucket/key) and signature V4,
+// it works with AWS and the S3-compatible servers (MinIO, Ceph, R2...).
+type S3Store struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// unsignedPayload is the body hash of the signature: the body is streamed, it isn't hashed first.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+func NewS3Store(endpoint, region, bucket, accessKey, secretKey string) (*S3Store, error) {
+	endpointURL, err := url.Parse(strings.TrimRight(endpoint, "/"))
+	if err != nil || endpointURL.Host == "" {
+		return nil, fmt.Errorf("objectstore: invalid S3 endpoint %q", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("objectstore: S3_BUCKET is required")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &S3Store{
+		endpoint:  endpointURL,
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 30 * time.Minute},
+	}, nil
+}
+
+func (s *S3Store) objectURL(key string, query url.Values) *url.URL {
+	objectURL := *s.endpoint
+	objectURL.Path = s.endpoint.Path + "/" + s.bucket
+	if key != "" {
+		objectURL.Path += "/" + key
+	}
+	objectURL.RawQuery = query.Encode()
+	return &objectURL
+}
+
+func (s *S3Store) do(ctx context.Context, method string, objectURL *url.URL, body io.Reader, size int64) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, objectURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.ContentLength = size
+	}
+	s.sign(request, time.Now().UTC())
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		if response.StatusCode == http.StatusNotFound {
+			return nil, ErrNotFound
+		}
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, fmt.Errorf("objectstore: %s %s: %s %s", method, objectURL.Path, response.Status, message)
+	}
+	return response, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("objectstore: S3 put needs the size")
+	}
+	response, err := s.do(ctx, http.MethodPut, s.objectURL(key, nil), r, size)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	response, err := s.do(ctx, http.MethodGet, s.objectURL(key, nil), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	response, err := s.do(ctx, http.MethodDelete, s.objectURL(key, nil), nil, 0)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]Object, error) {
+	objects := make([]Object, 0)
+	continuationToken := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		response, err := s.do(ctx, http.MethodGet, s.objectURL("", query), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, content := range result.Contents {
+			objects = append(objects, Object{Key: content.Key, Size: content.Size, LastModified: content.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		continuationToken = result.NextContinuationToken
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// sign adds the Authorization header of the AWS signature V4.
+func (s *S3Store) sign(request *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+
+	request.Header.Set("x-amz-date", amzDate)
+	request.Header.Set("x-amz-content-sha256", unsignedPayload)
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n",
+		request.URL.Host, unsignedPayload, amzDate)
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		canonicalQuery(request.URL.Query()),
+		canonicalHeaders,
+		strings.Join(signedHeaders, ";"),
+		unsignedPayload,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", shortDate, s.region)
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), shortDate)
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, awsEscape(key)+"="+awsEscape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape is the uri encoding of the signature: space is %20 and ~ isn't escaped.
+func awsEscape(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
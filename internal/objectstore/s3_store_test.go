@@ -0,0 +1,118 @@
+package objectstore_test
+
+import (
+	"app-ez-pwd/internal/objectstore"
+	"app-ez-pwd/internal/objectstore/objectstoretest"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestS3Store(t *testing.T, server *objectstoretest.S3Server, secretKey string) *objectstore.S3Store {
+	t.Helper()
+	store, err := objectstore.NewS3Store(server.URL, server.Region, server.Bucket, server.AccessKey, secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func putString(t *testing.T, store objectstore.Store, key, content string) {
+	t.Helper()
+	if err := store.Put(context.Background(), key, strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("put %s: %v", key, err)
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	server := objectstoretest.NewS3Server("eu-west-1", "ez-pwd", "access", "secret")
+	defer server.Close()
+	store := newTestS3Store(t, server, server.SecretKey)
+	ctx := context.Background()
+
+	content := bytes.Repeat([]byte("backup "), 10000)
+	if err := store.Put(ctx, "users/1/20260101T000000Z.zip", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	putString(t, store, "users/1/with space.zip", "space")
+	putString(t, store, "users/2/20260101T000000Z.zip", "two")
+	putString(t, store, "database/20260101T000000Z.zip", "database")
+
+	r, err := store.Get(ctx, "users/1/20260101T000000Z.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("get: the content is different (%v)", err)
+	}
+
+	if _, err = store.Get(ctx, "users/3/missing.zip"); !errors.Is(err, objectstore.ErrNotFound) {
+		t.Fatalf("get missing: expected ErrNotFound, got %v", err)
+	}
+
+	objects, err := store.List(ctx, "users/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0)
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	expected := []string{"users/1/20260101T000000Z.zip", "users/1/with space.zip", "users/2/20260101T000000Z.zip"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("list: expected %v, got %v", expected, keys)
+	}
+	if objects[0].Size != int64(len(content)) || objects[0].LastModified.IsZero() {
+		t.Fatalf("list: invalid size or date %+v", objects[0])
+	}
+
+	if err = store.Delete(ctx, "users/1/with space.zip"); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Delete(ctx, "users/1/with space.zip"); err != nil {
+		t.Fatalf("delete missing: %v", err)
+	}
+	expected = []string{"database/20260101T000000Z.zip", "users/1/20260101T000000Z.zip", "users/2/20260101T000000Z.zip"}
+	if keys = server.Keys(); !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("delete: expected %v, got %v", expected, keys)
+	}
+}
+
+func TestS3StoreListPages(t *testing.T) {
+	server := objectstoretest.NewS3Server("us-east-1", "ez-pwd", "access", "secret")
+	defer server.Close()
+	server.MaxKeys = 2
+	store := newTestS3Store(t, server, server.SecretKey)
+
+	for _, key := range []string{"users/1/a", "users/1/b", "users/1/c", "users/2/a", "users/2/b", "other/a"} {
+		putString(t, store, key, key)
+	}
+
+	objects, err := store.List(context.Background(), "users/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 5 || objects[0].Key != "users/1/a" || objects[4].Key != "users/2/b" {
+		t.Fatalf("expected the 5 objects of the 3 pages, got %+v", objects)
+	}
+}
+
+func TestS3StoreWrongSecret(t *testing.T) {
+	server := objectstoretest.NewS3Server("us-east-1", "ez-pwd", "access", "secret")
+	defer server.Close()
+	store := newTestS3Store(t, server, "wrong secret")
+
+	err := store.Put(context.Background(), "users/1/a.zip", strings.NewReader("a"), 1)
+	if err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Fatalf("expected SignatureDoesNotMatch, got %v", err)
+	}
+	if len(server.Keys()) != 0 || server.Requests() != 0 {
+		t.Fatal("the request without valid signature was accepted")
+	}
+}
@@ -0,0 +1,418 @@
+package secrets
+
+import (
+	"app-ez-pwd/internal/events"
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/objectstore"
+	"app-ez-pwd/internal/settings"
+	"app-ez-pwd/internal/storage"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+	"io"
+	"time"
+)
+
+// AttachmentStore saves the encrypted content of the attachments, nil when the attachments are disabled.
+var AttachmentStore objectstore.Store
+
+const (
+	defaultAttachmentMaxFileMB = 25
+	defaultAttachmentQuotaMB   = 100
+)
+
+func AttachmentMaxFileSize() int64 {
+	if settings.Settings.Attachments.MaxFileMB > 0 {
+		return int64(settings.Settings.Attachments.MaxFileMB) << 20
+	}
+	return defaultAttachmentMaxFileMB << 20
+}
+
+func attachmentQuota() int64 {
+	if settings.Settings.Attachments.QuotaMB > 0 {
+		return int64(settings.Settings.Attachments.QuotaMB) << 20
+	}
+	return defaultAttachmentQuotaMB << 20
+}
+
+type AttachmentModel struct {
+	Id                int             `json:"id"`
+	SecretId          int             `json:"secretId"`
+	FileNameEncrypted json.RawMessage `json:"fileNameEncrypted"`
+	Size              int64           `json:"size"`
+	SHA256            string          `json:"sha256"` // of the encrypted content
+	CreatedAt         time.Time       `json:"createdAt"`
+	objectKey         string
+}
+
+type ListAttachmentsModel struct {
+	Attachments []AttachmentModel `json:"attachments"`
+	UsedBytes   int64             `json:"usedBytes"` // every attachment of the user
+	QuotaBytes  int64             `json:"quotaBytes"`
+}
+
+var attachmentColumns = []string{"id", "secret_id", "file_name_json", "size", "sha256", "created_at", "object_key"}
+
+func scanAttachment(row pgx.Row, attachment *AttachmentModel) error {
+	return row.Scan(
+		&attachment.Id,
+		&attachment.SecretId,
+		&attachment.FileNameEncrypted,
+		&attachment.Size,
+		&attachment.SHA256,
+		&attachment.CreatedAt,
+		&attachment.objectKey,
+	)
+}
+
+func ListAttachmentsDB(userId, secretId int) (ListAttachmentsModel, error) {
+	result := ListAttachmentsModel{Attachments: make([]AttachmentModel, 0), QuotaBytes: attachmentQuota()}
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return result, internalError(err)
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	if err = existsUserSecretTx(tx, userId, secretId); err != nil {
+		return result, err
+	}
+
+	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.
+		Select(attachmentColumns...).
+		From("secret_attachments").
+		Where(sq.Eq{
+			"user_id":   userId,
+			"secret_id": secretId,
+		}).OrderBy("id").ToSql()
+
+	rows, err := tx.Query(context.Background(), selectQry, selectQryArgs...)
+	if err != nil {
+		logger.Logger.Error("err query attachments", zap.Error(err))
+		return result, internalError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var attachment AttachmentModel
+		if err = scanAttachment(rows, &attachment); err != nil {
+			logger.Logger.Error("err scan attachment", zap.Error(err))
+			return result, internalError(err)
+		}
+		result.Attachments = append(result.Attachments, attachment)
+	}
+
+	if result.UsedBytes, err = attachmentsUsageTx(tx, userId); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+type NewAttachmentModel struct {
+	UserId            int
+	SecretId          int
+	FileNameEncrypted []byte
+	Size              int64
+}
+
+// SaveAttachmentDB uploads the content to the attachments store and saves the row when the quota allows it,
+// the upload is before the transaction so the user row isn't locked while the file is sent.
+func SaveAttachmentDB(newAttachment NewAttachmentModel, content io.Reader) (AttachmentModel, error) {
+	attachment := AttachmentModel{
+		SecretId:          newAttachment.SecretId,
+		FileNameEncrypted: newAttachment.FileNameEncrypted,
+		Size:              newAttachment.Size,
+	}
+
+	objectKey, err := newAttachmentKey(newAttachment.UserId)
+	if err != nil {
+		return attachment, internalError(err)
+	}
+
+	hasher := sha256.New()
+	err = AttachmentStore.Put(context.Background(), objectKey, io.TeeReader(content, hasher), newAttachment.Size)
+	if err != nil {
+		logger.Logger.Error("err put attachment", zap.Error(err))
+		return attachment, internalError(err)
+	}
+	attachment.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		removeAttachmentBlobs([]string{objectKey})
+		return attachment, internalError(err)
+	}
+
+	err = insertAttachmentTx(tx, newAttachment.UserId, objectKey, &attachment)
+	if err == nil {
+		err = checkAttachmentsQuotaTx(tx, newAttachment.UserId)
+	}
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		removeAttachmentBlobs([]string{objectKey})
+		return attachment, err
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		removeAttachmentBlobs([]string{objectKey})
+		return attachment, internalError(err)
+	}
+
+	events.Hub.Publish(events.Event{Type: events.AttachmentsChanged, UserId: newAttachment.UserId, EntityId: newAttachment.SecretId})
+	return attachment, nil
+}
+
+// insertAttachmentTx inserts the attachment of the secret, the user row is locked so the quota is checked
+// without the concurrent uploads of the same user.
+func insertAttachmentTx(tx pgx.Tx, userId int, objectKey string, attachment *AttachmentModel) error {
+	lockUser, lockUserArgs, _ := storage.ApplicationDB.Psql.
+		Select("id").
+		From("users").
+		Where(sq.Eq{
+			"id": userId,
+		}).Suffix("FOR UPDATE").ToSql()
+
+	var lockedId int
+	if err := tx.QueryRow(context.Background(), lockUser, lockUserArgs...).Scan(&lockedId); err != nil {
+		logger.Logger.Error("err lock user", zap.Error(err))
+		return internalError(err)
+	}
+
+	if err := existsUserSecretTx(tx, userId, attachment.SecretId); err != nil {
+		return err
+	}
+
+	insertQry, insertQryArgs, _ := storage.ApplicationDB.Psql.Insert("secret_attachments").
+		SetMap(map[string]interface{}{
+			"secret_id":      attachment.SecretId,
+			"user_id":        userId,
+			"file_name_json": []byte(attachment.FileNameEncrypted),
+			"size":           attachment.Size,
+			"sha256":         attachment.SHA256,
+			"object_key":     objectKey,
+		}).Suffix("RETURNING id, created_at").ToSql()
+
+	err := tx.QueryRow(context.Background(), insertQry, insertQryArgs...).Scan(&attachment.Id, &attachment.CreatedAt)
+	if err != nil {
+		logger.Logger.Error("err insert attachment", zap.Error(err))
+		return internalError(err)
+	}
+	attachment.objectKey = objectKey
+	return nil
+}
+
+func checkAttachmentsQuotaTx(tx pgx.Tx, userId int) error {
+	usedBytes, err := attachmentsUsageTx(tx, userId)
+	if err != nil {
+		return err
+	}
+	if quota := attachmentQuota(); usedBytes > quota {
+		return quotaError(fmt.Sprintf("the attachments exceed the quota of %d MB", quota>>20))
+	}
+	return nil
+}
+
+// attachmentsUsageTx is the size of the attachments of the user, the ones of deleted secrets aren't counted.
+func attachmentsUsageTx(tx pgx.Tx, userId int) (int64, error) {
+	selectUsage, selectUsageArgs, _ := storage.ApplicationDB.Psql.
+		Select("COALESCE(SUM(size), 0)").
+		From("secret_attachments").
+		Where(sq.Eq{
+			"user_id": userId,
+		}).
+		Where(sq.NotEq{
+			"secret_id": nil,
+		}).ToSql()
+
+	var usedBytes int64
+	if err := tx.QueryRow(context.Background(), selectUsage, selectUsageArgs...).Scan(&usedBytes); err != nil {
+		logger.Logger.Error("err scan attachments usage", zap.Error(err))
+		return 0, internalError(err)
+	}
+	return usedBytes, nil
+}
+
+// OpenAttachmentDB returns the attachment and its encrypted content, the caller closes the content.
+func OpenAttachmentDB(userId, secretId, attachmentId int) (AttachmentModel, io.ReadCloser, error) {
+	attachment, err := selectAttachment(userId, secretId, attachmentId)
+	if err != nil {
+		return attachment, nil, err
+	}
+
+	content, err := AttachmentStore.Get(context.Background(), attachment.objectKey)
+	if err != nil {
+		logger.Logger.Error("err get attachment", zap.Int("attachmentId", attachmentId), zap.Error(err))
+		return attachment, nil, internalError(err)
+	}
+	return attachment, content, nil
+}
+
+func selectAttachment(userId, secretId, attachmentId int) (attachment AttachmentModel, err error) {
+	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.
+		Select(attachmentColumns...).
+		From("secret_attachments").
+		Where(sq.Eq{
+			"id":        attachmentId,
+			"user_id":   userId,
+			"secret_id": secretId,
+		}).ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return attachment, internalError(err)
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	err = scanAttachment(tx.QueryRow(context.Background(), selectQry, selectQryArgs...), &attachment)
+	if err == pgx.ErrNoRows {
+		return attachment, notFoundError(fmt.Sprintf("attachment %d not found", attachmentId))
+	}
+	if err != nil {
+		logger.Logger.Error("err scan attachment", zap.Error(err))
+		return attachment, internalError(err)
+	}
+	return attachment, nil
+}
+
+func DeleteAttachmentDB(userId, secretId, attachmentId int) error {
+	deleteQry, deleteQryArgs, _ := storage.ApplicationDB.Psql.Delete("secret_attachments").
+		Where(sq.Eq{
+			"id":        attachmentId,
+			"user_id":   userId,
+			"secret_id": secretId,
+		}).Suffix("RETURNING object_key").ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return internalError(err)
+	}
+
+	var objectKey string
+	err = tx.QueryRow(context.Background(), deleteQry, deleteQryArgs...).Scan(&objectKey)
+	if err == pgx.ErrNoRows {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return notFoundError(fmt.Sprintf("attachment %d not found", attachmentId))
+	}
+	if err != nil {
+		logger.Logger.Error("err delete attachment", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return internalError(err)
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return internalError(err)
+	}
+
+	removeAttachmentBlobs([]string{objectKey})
+	events.Hub.Publish(events.Event{Type: events.AttachmentsChanged, UserId: userId, EntityId: secretId})
+	return nil
+}
+
+// RemoveOrphanAttachments deletes the attachments of the deleted secrets: the row is deleted after the blob
+// so a failed delete is retried the next time. Call it after the commit of the deletes.
+func RemoveOrphanAttachments(userId int) {
+	if AttachmentStore == nil {
+		return
+	}
+
+	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.
+		Select("id", "object_key").
+		From("secret_attachments").
+		Where(sq.Eq{
+			"user_id":   userId,
+			"secret_id": nil,
+		}).ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return
+	}
+
+	rows, err := tx.Query(context.Background(), selectQry, selectQryArgs...)
+	if err != nil {
+		logger.Logger.Error("err query orphan attachments", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return
+	}
+	removedIds := make([]int, 0)
+	objectKeys := make(map[int]string)
+	for rows.Next() {
+		var attachmentId int
+		var objectKey string
+		if err = rows.Scan(&attachmentId, &objectKey); err != nil {
+			logger.Logger.Error("err scan orphan attachment", zap.Error(err))
+			break
+		}
+		objectKeys[attachmentId] = objectKey
+	}
+	rows.Close()
+
+	for attachmentId, objectKey := range objectKeys {
+		err = AttachmentStore.Delete(context.Background(), objectKey)
+		if err != nil && err != objectstore.ErrNotFound {
+			logger.Logger.Error("err delete attachment blob", zap.String("key", objectKey), zap.Error(err))
+			continue
+		}
+		removedIds = append(removedIds, attachmentId)
+	}
+
+	if len(removedIds) > 0 {
+		deleteQry, deleteQryArgs, _ := storage.ApplicationDB.Psql.Delete("secret_attachments").
+			Where(sq.Eq{
+				"id": removedIds,
+			}).ToSql()
+
+		if _, err = tx.Exec(context.Background(), deleteQry, deleteQryArgs...); err != nil {
+			logger.Logger.Error("err delete orphan attachments", zap.Error(err))
+			_ = storage.ApplicationDB.Rollback(cn, tx)
+			return
+		}
+	}
+	_ = storage.ApplicationDB.Commit(cn, tx)
+}
+
+// removeAttachmentBlobs deletes the uploaded blobs that don't have a row, ex: the transaction failed.
+func removeAttachmentBlobs(objectKeys []string) {
+	for _, objectKey := range objectKeys {
+		err := AttachmentStore.Delete(context.Background(), objectKey)
+		if err != nil && err != objectstore.ErrNotFound {
+			logger.Logger.Error("err delete attachment blob", zap.String("key", objectKey), zap.Error(err))
+		}
+	}
+}
+
+// newAttachmentKey is the random key of the blob, the attachment id isn't known before the upload.
+func newAttachmentKey(userId int) (string, error) {
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("attachments/%d/%s", userId, hex.EncodeToString(randomBytes)), nil
+}
+
+func existsUserSecretTx(tx pgx.Tx, userId, secretId int) error {
+	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.
+		Select("1").
+		From("user_secrets").
+		Where(sq.Eq{
+			"user_id": userId,
+			"id":      secretId,
+		}).ToSql()
+
+	var found int
+	err := tx.QueryRow(context.Background(), selectQry, selectQryArgs...).Scan(&found)
+	if err == pgx.ErrNoRows {
+		return notFoundError(fmt.Sprintf("user secret %d not found", secretId))
+	}
+	if err != nil {
+		logger.Logger.Error("err query", zap.Error(err))
+		return internalError(err)
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+package secrets
+
+import (
+	"app-ez-pwd/internal/backupcrypt"
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/objectstore"
+	"app-ez-pwd/internal/settings"
+	"app-ez-pwd/internal/storage"
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+	"io"
+	"strings"
+	"time"
+)
+
+// BackupFormatVersion is written in the manifest, restore reads this version and the legacy zip (1.csv, 2.csv, 3.csv).
+const BackupFormatVersion = 2
+
+const backupManifestName = "manifest.json"
+
+type BackupManifestFile struct {
+	Name   string `json:"name"`
+	Rows   int64  `json:"rows"`
+	SHA256 string `json:"sha256"`
+}
+
+// BackupManifestAttachment is the encrypted content of an attachment: attachments/<id> of attachments.csv
+type BackupManifestAttachment struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type BackupManifest struct {
+	FormatVersion     int                  `json:"formatVersion"`
+	AppVersion        string               `json:"appVersion"`
+	CreatedAt         time.Time            `json:"createdAt"`
+	Username          string               `json:"username"`
+	IncludesLoginHash bool                 `json:"includesLoginHash"`
+	Files             []BackupManifestFile `json:"files"`
+	// the attachments without content (attachments disabled or missing blob) are skipped by the restore
+	Attachments []BackupManifestAttachment `json:"attachments,omitempty"`
+}
+
+type BackupOptions struct {
+	ExcludeLoginHash bool
+}
+
+// backupFile is a csv file of the backup: the COPY of the query with the header row.
+type backupFile struct {
+	Name  string
+	Query string
+}
+
+// backupSecretColumns are the columns of secrets.csv, restore reads them by the header name.
+var backupSecretColumns = []string{
+	"s.id",
+	"s.category_id",
+	"s.description",
+	"s.username",
+	"s.password_json",
+	"s.safe_note_json",
+	"s.url_site",
+	"s.item_type",
+	"s.type_data_json",
+	"s.custom_fields_json",
+	"s.totp_json",
+	"s.created_at",
+	"s.updated_at",
+	"COALESCE((SELECT json_agg(t.name ORDER BY t.name) FROM user_secret_tags t WHERE t.secret_id = s.id), '[]') AS tags",
+}
+
+func backupFiles(userId int, options BackupOptions) []backupFile {
+	// the wrapped vault key and its kdf params: the secrets of the backup can't be decrypted without them
+	userColumns := "id, username, password_hash, wrapped_vault_key, kdf_params_json, created_at"
+	if options.ExcludeLoginHash {
+		userColumns = "id, username, wrapped_vault_key, kdf_params_json, created_at"
+	}
+
+	return []backupFile{
+		{
+			Name:  "user.csv",
+			Query: fmt.Sprintf("SELECT %s FROM users WHERE id = %d", userColumns, userId),
+		},
+		{
+			Name:  "categories.csv",
+			Query: fmt.Sprintf("SELECT id, name FROM secret_categories WHERE user_id = %d ORDER BY id", userId),
+		},
+		{
+			Name: "secrets.csv",
+			Query: fmt.Sprintf("SELECT %s FROM user_secrets s WHERE s.user_id = %d ORDER BY s.id",
+				strings.Join(backupSecretColumns, ", "), userId),
+		},
+		{
+			Name: "attachments.csv",
+			Query: fmt.Sprintf("SELECT id, secret_id, file_name_json, size, sha256, created_at FROM secret_attachments "+
+				"WHERE user_id = %d AND secret_id IS NOT NULL ORDER BY id", userId),
+		},
+	}
+}
+
+// BackupExport is the snapshot of the user vault for the backup, the rows are streamed
+// from COPY to the zip so the vault is never held in memory. Close must be called.
+type BackupExport struct {
+	Username string
+
+	userId          int
+	options         BackupOptions
+	encryption      string
+	passphrase      string
+	publicKey       []byte
+	cn              *pgx.Conn
+	tx              pgx.Tx
+	closed          bool
+	writtenManifest BackupManifest
+}
+
+// OpenBackupExport opens the repeatable read transaction of the backup and reads the username,
+// nothing is written yet: the caller can still answer with an error.
+func OpenBackupExport(userId int, options BackupOptions) (*BackupExport, error) {
+	cn, tx, err := storage.ApplicationDB.BeginTx(pgx.TxOptions{
+		IsoLevel:   pgx.RepeatableRead,
+		AccessMode: pgx.ReadOnly,
+	})
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	export := &BackupExport{userId: userId, options: options, cn: cn, tx: tx}
+
+	selectUsername, selectUsernameArgs, _ := storage.ApplicationDB.Psql.
+		Select("username").
+		From("users").
+		Where(sq.Eq{
+			"id": userId,
+		}).ToSql()
+
+	if err = tx.QueryRow(context.Background(), selectUsername, selectUsernameArgs...).Scan(&export.Username); err != nil {
+		logger.Logger.Error("err scan", zap.Error(err))
+		export.Close()
+		return nil, internalError(err)
+	}
+
+	return export, nil
+}
+
+// EncryptToPublicKey makes Write encrypt the zip to the X25519 public key.
+func (e *BackupExport) EncryptToPublicKey(publicKey []byte) {
+	e.encryption = BackupEncryptionPublicKey
+	e.publicKey = publicKey
+}
+
+// Encrypted reports if Write writes the backupcrypt file instead of the zip.
+func (e *BackupExport) Encrypted() bool {
+	return e.encryption != ""
+}
+
+// Write streams the backup zip to w: the csv files with header and the manifest.json at the end,
+// the manifest has the rows and the SHA-256 of every file. On error w has a truncated backup.
+func (e *BackupExport) Write(w io.Writer) error {
+	if e.Encrypted() {
+		var encryptWriter io.WriteCloser
+		var err error
+		if e.encryption == BackupEncryptionPassphrase {
+			encryptWriter, err = backupcrypt.NewPassphraseWriter(w, e.passphrase)
+		} else {
+			encryptWriter, err = backupcrypt.NewPublicKeyWriter(w, e.publicKey)
+		}
+		if err != nil {
+			return internalError(err)
+		}
+		if err = e.writeZip(encryptWriter); err != nil {
+			return err
+		}
+		if err = encryptWriter.Close(); err != nil {
+			return internalError(err)
+		}
+		return nil
+	}
+
+	return e.writeZip(w)
+}
+
+func (e *BackupExport) writeZip(w io.Writer) error {
+	manifest := BackupManifest{
+		FormatVersion:     BackupFormatVersion,
+		AppVersion:        settings.AppVersion,
+		CreatedAt:         time.Now().UTC(),
+		Username:          e.Username,
+		IncludesLoginHash: !e.options.ExcludeLoginHash,
+		Files:             make([]BackupManifestFile, 0),
+	}
+
+	zipWriter := zip.NewWriter(w)
+
+	for _, file := range backupFiles(e.userId, e.options) {
+		fileWriter, err := zipWriter.Create(file.Name)
+		if err != nil {
+			logger.Logger.Error("err writing zip file", zap.Error(err))
+			return internalError(err)
+		}
+
+		hasher := sha256.New()
+		copyQuery := fmt.Sprintf("COPY (%s) TO STDOUT WITH (FORMAT csv, HEADER true)", file.Query)
+
+		result, err := e.cn.PgConn().CopyTo(context.Background(), io.MultiWriter(fileWriter, hasher), copyQuery)
+		if err != nil {
+			logger.Logger.Error("err copy to", zap.String("file", file.Name), zap.Error(err))
+			return internalError(err)
+		}
+
+		manifest.Files = append(manifest.Files, BackupManifestFile{
+			Name:   file.Name,
+			Rows:   result.RowsAffected(),
+			SHA256: hex.EncodeToString(hasher.Sum(nil)),
+		})
+	}
+
+	if err := e.writeAttachments(zipWriter, &manifest); err != nil {
+		return err
+	}
+
+	manifestWriter, err := zipWriter.Create(backupManifestName)
+	if err == nil {
+		encoder := json.NewEncoder(manifestWriter)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(manifest)
+	}
+	if err == nil {
+		err = zipWriter.Close()
+	}
+	if err != nil {
+		logger.Logger.Error("err writing zip file", zap.Error(err))
+		return internalError(err)
+	}
+
+	e.writtenManifest = manifest
+	return nil
+}
+
+// writeAttachments adds the content of the attachments of attachments.csv, they are already encrypted
+// by the client so they are stored without compression.
+func (e *BackupExport) writeAttachments(zipWriter *zip.Writer, manifest *BackupManifest) error {
+	if AttachmentStore == nil {
+		return nil
+	}
+
+	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.
+		Select("id", "object_key").
+		From("secret_attachments").
+		Where(sq.Eq{
+			"user_id": e.userId,
+		}).
+		Where(sq.NotEq{
+			"secret_id": nil,
+		}).OrderBy("id").ToSql()
+
+	rows, err := e.tx.Query(context.Background(), selectQry, selectQryArgs...)
+	if err != nil {
+		logger.Logger.Error("err query attachments", zap.Error(err))
+		return internalError(err)
+	}
+	objectKeys := make(map[int]string)
+	attachmentIds := make([]int, 0)
+	for rows.Next() {
+		var attachmentId int
+		var objectKey string
+		if err = rows.Scan(&attachmentId, &objectKey); err != nil {
+			rows.Close()
+			logger.Logger.Error("err scan attachment", zap.Error(err))
+			return internalError(err)
+		}
+		objectKeys[attachmentId] = objectKey
+		attachmentIds = append(attachmentIds, attachmentId)
+	}
+	rows.Close()
+
+	for _, attachmentId := range attachmentIds {
+		content, err := AttachmentStore.Get(context.Background(), objectKeys[attachmentId])
+		if err == objectstore.ErrNotFound {
+			logger.Logger.Error("attachment blob not found", zap.Int("attachmentId", attachmentId))
+			continue
+		}
+		if err != nil {
+			logger.Logger.Error("err get attachment", zap.Int("attachmentId", attachmentId), zap.Error(err))
+			return internalError(err)
+		}
+
+		name := fmt.Sprintf("attachments/%d", attachmentId)
+		fileWriter, err := zipWriter.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: manifest.CreatedAt})
+		if err != nil {
+			_ = content.Close()
+			logger.Logger.Error("err writing zip file", zap.Error(err))
+			return internalError(err)
+		}
+
+		hasher := sha256.New()
+		size, err := io.Copy(io.MultiWriter(fileWriter, hasher), content)
+		_ = content.Close()
+		if err != nil {
+			logger.Logger.Error("err copy attachment", zap.Int("attachmentId", attachmentId), zap.Error(err))
+			return internalError(err)
+		}
+
+		manifest.Attachments = append(manifest.Attachments, BackupManifestAttachment{
+			Name:   name,
+			Size:   size,
+			SHA256: hex.EncodeToString(hasher.Sum(nil)),
+		})
+	}
+	return nil
+}
+
+// Manifest is the manifest written by the last Write.
+func (e *BackupExport) Manifest() BackupManifest {
+	return e.writtenManifest
+}
+
+func (e *BackupExport) Close() {
+	if e.closed {
+		return
+	}
+	e.closed = true
+	_ = storage.ApplicationDB.Rollback(e.cn, e.tx)
+}
+
+func GetBackupPublicKeyDB(userId int) (string, error) {
+	selectKey, selectKeyArgs, _ := storage.ApplicationDB.Psql.
+		Select("COALESCE(backup_public_key, '')").
+		From("users").
+		Where(sq.Eq{
+			"id": userId,
+		}).ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return "", internalError(err)
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	var publicKey string
+	if err = tx.QueryRow(context.Background(), selectKey, selectKeyArgs...).Scan(&publicKey); err != nil {
+		logger.Logger.Error("err scan", zap.Error(err))
+		return "", internalError(err)
+	}
+	return publicKey, nil
+}
+
+// SaveBackupPublicKeyDB saves the key for the encrypted backups, the empty key deletes it.
+func SaveBackupPublicKeyDB(userId int, publicKey string) error {
+	var keyValue interface{}
+	if publicKey != "" {
+		keyValue = publicKey
+	}
+
+	updateKey, updateKeyArgs, _ := storage.ApplicationDB.Psql.Update("users").
+		Set("backup_public_key", keyValue).
+		Where(sq.Eq{
+			"id": userId,
+		}).ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return internalError(err)
+	}
+
+	if _, err = tx.Exec(context.Background(), updateKey, updateKeyArgs...); err != nil {
+		logger.Logger.Error("err update backup key", zap.Error(err))
+
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return internalError(err)
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return internalError(err)
+	}
+	return nil
+}
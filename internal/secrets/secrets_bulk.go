@@ -0,0 +1,188 @@
+package secrets
+
+import (
+	"app-ez-pwd/internal/events"
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/storage"
+	"context"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	BulkMove   = "move"
+	BulkDelete = "delete"
+	BulkTag    = "tag"
+	BulkUntag  = "untag"
+)
+
+const (
+	BulkStatusOk       = "ok"
+	BulkStatusNotFound = "not_found"
+	BulkStatusConflict = "conflict"
+)
+
+type BulkUserSecretsModel struct {
+	UserId     int
+	Action     string
+	SecretIds  []int
+	Versions   []int // for delete, the version of every secret of SecretIds
+	CategoryId int
+	Tags       []string
+}
+
+type BulkItemResultModel struct {
+	Id      int              `json:"id"`
+	Status  string           `json:"status"`
+	Version int              `json:"version,omitempty"` // the new version, not for deleted secrets
+	Current *UserSecretModel `json:"current,omitempty"` // only for conflict: the server copy
+}
+
+// BulkUserSecretsDB applies the action to every secret in one transaction,
+// the secrets that don't exist or belong to other user are reported as not_found, the deletes
+// of other version as conflict, and the rest is applied.
+func BulkUserSecretsDB(bulkModel BulkUserSecretsModel) ([]BulkItemResultModel, error) {
+	results := make([]BulkItemResultModel, 0, len(bulkModel.SecretIds))
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return results, internalError(err)
+	}
+
+	if bulkModel.Action == BulkMove {
+		if _, err = prepareCategoryTx(tx, bulkModel.UserId, bulkModel.CategoryId, ""); err != nil {
+			_ = storage.ApplicationDB.Rollback(cn, tx)
+			return results, err
+		}
+	}
+
+	seen := make(map[int]bool)
+	shareEvents := make([]events.Event, 0)
+	for i, secretId := range bulkModel.SecretIds {
+		if seen[secretId] {
+			continue
+		}
+		seen[secretId] = true
+
+		var version int
+		if bulkModel.Action == BulkDelete {
+			version = bulkModel.Versions[i]
+
+			// only the shares of the secrets deleted below: the conflicts keep theirs
+			revoked, err := revokeSharesTx(tx, sq.Expr(
+				"secret_id IN (SELECT id FROM user_secrets WHERE id = ? AND user_id = ? AND version = ?)",
+				secretId, bulkModel.UserId, version))
+			if err != nil {
+				_ = storage.ApplicationDB.Rollback(cn, tx)
+				return results, err
+			}
+			shareEvents = append(shareEvents, revoked...)
+		}
+
+		result, err := bulkItemTx(tx, bulkModel, secretId, version)
+		if err != nil {
+			logger.Logger.Error("err bulk user secret", zap.String("action", bulkModel.Action), zap.Error(err))
+
+			_ = storage.ApplicationDB.Rollback(cn, tx)
+			return results, internalError(err)
+		}
+		results = append(results, result)
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return results, internalError(err)
+	}
+
+	if bulkModel.Action == BulkDelete {
+		RemoveOrphanAttachments(bulkModel.UserId)
+	}
+	for _, result := range results {
+		if result.Status != BulkStatusOk {
+			continue
+		}
+		if bulkModel.Action == BulkDelete {
+			events.Hub.Publish(events.Event{Type: events.SecretDeleted, UserId: bulkModel.UserId, EntityId: result.Id})
+		} else {
+			events.Hub.Publish(events.Event{Type: events.SecretUpdated, UserId: bulkModel.UserId, EntityId: result.Id, Version: result.Version})
+		}
+	}
+	for _, event := range shareEvents {
+		events.Hub.Publish(event)
+	}
+
+	return results, nil
+}
+
+func bulkItemTx(tx pgx.Tx, bulkModel BulkUserSecretsModel, secretId, version int) (BulkItemResultModel, error) {
+	result := BulkItemResultModel{Id: secretId, Status: BulkStatusOk}
+	secretFilter := sq.Eq{
+		"id":      secretId,
+		"user_id": bulkModel.UserId,
+	}
+
+	if bulkModel.Action == BulkDelete {
+		deleteQry, deleteArgs, _ := storage.ApplicationDB.Psql.Delete("user_secrets").
+			Where(secretFilter).
+			Where(sq.Eq{"version": version}).ToSql()
+
+		deleteResult, err := tx.Exec(context.Background(), deleteQry, deleteArgs...)
+		if err != nil {
+			return result, err
+		}
+		if deleteResult.RowsAffected() == 0 {
+			// like DeleteUserSecretDB: the secret was modified by other client since it was read
+			current, err := selectUserSecretTx(tx, bulkModel.UserId, secretId)
+			if KindOf(err) == KindNotFound {
+				result.Status = BulkStatusNotFound
+				return result, nil
+			}
+			if err != nil {
+				return result, err
+			}
+			result.Status, result.Current = BulkStatusConflict, &current
+			return result, nil
+		}
+		return result, insertTombstoneTx(tx, bulkModel.UserId, tombstoneSecret, secretId)
+	}
+
+	updatedColumns := make(map[string]interface{})
+	if bulkModel.Action == BulkMove {
+		updatedColumns["category_id"] = bulkModel.CategoryId
+	}
+
+	// the tags are part of the secret: the version changes so the other clients sync them
+	updateQry, updateArgs, _ := storage.ApplicationDB.Psql.Update("user_secrets").
+		SetMap(touchedColumns(updatedColumns)).
+		Where(secretFilter).
+		Suffix("RETURNING version").ToSql()
+
+	err := tx.QueryRow(context.Background(), updateQry, updateArgs...).Scan(&result.Version)
+	if err == pgx.ErrNoRows {
+		result.Status = BulkStatusNotFound
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+
+	switch bulkModel.Action {
+	case BulkTag:
+		insertTags := storage.ApplicationDB.Psql.Insert("user_secret_tags").Columns("secret_id", "name")
+		for _, tag := range bulkModel.Tags {
+			insertTags = insertTags.Values(secretId, tag)
+		}
+		insertTagsQry, insertTagsArgs, _ := insertTags.Suffix("ON CONFLICT DO NOTHING").ToSql()
+
+		_, err = tx.Exec(context.Background(), insertTagsQry, insertTagsArgs...)
+	case BulkUntag:
+		deleteTagsQry, deleteTagsArgs, _ := storage.ApplicationDB.Psql.Delete("user_secret_tags").Where(sq.Eq{
+			"secret_id": secretId,
+			"name":      bulkModel.Tags,
+		}).ToSql()
+
+		_, err = tx.Exec(context.Background(), deleteTagsQry, deleteTagsArgs...)
+	}
+
+	return result, err
+}
@@ -1,75 +1,87 @@
 package secrets
 
 import (
+	"app-ez-pwd/internal/events"
 	"app-ez-pwd/internal/logger"
 	"app-ez-pwd/internal/storage"
-	"archive/zip"
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
 	"go.uber.org/zap"
-	"io"
+	"time"
 )
 
 type ListCategoryModel struct {
-	Id   int    `json:"id"`
-	Name string `json:"name"`
+	Id             int    `json:"id"`
+	Name           string `json:"name"`
+	OrganizationId *int   `json:"organizationId,omitempty"` // the categories of the organizations of the user
 }
 
 func ListCategorySecretsDB(userId int) ([]ListCategoryModel, error) {
 	itemsCategory := make([]ListCategoryModel, 0)
 
 	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.
-		Select("id", "name").
-		From("secret_categories").Where(sq.Eq{
-		"user_id": userId,
-	}).OrderBy("name DESC").ToSql()
+		Select("id", "name", "organization_id").
+		From("secret_categories").Where(personalOrMemberScope(userId)).
+		OrderBy("name DESC").ToSql()
 
-	cn, tx, _ := storage.ApplicationDB.Begin()
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return nil, internalError(err)
+	}
 	defer storage.ApplicationDB.Rollback(cn, tx)
 
 	rows, err := tx.Query(context.Background(), selectQry, selectQryArgs...)
 	if err != nil {
 		logger.Logger.Error("err query", zap.Error(err))
-		return itemsCategory, err
+		return itemsCategory, internalError(err)
 	}
 
 	defer rows.Close()
 	for rows.Next() {
 		var item ListCategoryModel
-		err = rows.Scan(&item.Id, &item.Name)
+		err = rows.Scan(&item.Id, &item.Name, &item.OrganizationId)
 		if err != nil {
 			logger.Logger.Error("err scan", zap.Error(err))
-			return itemsCategory, err
+			return itemsCategory, internalError(err)
 		}
 
 		itemsCategory = append(itemsCategory, item)
 	}
 
-	return itemsCategory, err
+	return itemsCategory, nil
 }
 
 type ListUserSecretModel struct {
-	Id                int             `json:"id"`
-	Description       string          `json:"description"`
-	Username          string          `json:"username"`
-	PasswordEncrypted json.RawMessage `json:"passwordEncrypted"`
-	SafeNoteEncrypted json.RawMessage `json:"safeNoteEncrypted"`
-	URLSite           string          `json:"URLSite"`
+	Id                int              `json:"id"`
+	Description       string           `json:"description"`
+	Username          string           `json:"username"`
+	PasswordEncrypted json.RawMessage  `json:"passwordEncrypted"`
+	SafeNoteEncrypted json.RawMessage  `json:"safeNoteEncrypted"`
+	URLSite           string           `json:"URLSite"`
+	Type              string           `json:"type"`
+	TypeData          json.RawMessage  `json:"typeData"`
+	Version           int              `json:"version"`
+	Tags              []string         `json:"tags"`
+	OrganizationId    *int             `json:"organizationId,omitempty"` // the secrets of the organizations of the user
+	Shared            *SharedInfoModel `json:"shared,omitempty"`         // only in the secrets shared with the user
 }
 
-func ListUserSecretDB(userId, categoryId int) ([]ListUserSecretModel, error) {
+// ListUserSecretDB lists the secrets of the user, categoryId and itemType filter when they aren't empty.
+// The secrets of the organizations of the user are merged, without category the secrets shared with the user are at the end.
+func ListUserSecretDB(userId, categoryId int, itemType string) ([]ListUserSecretModel, error) {
 	itemsUserSecrets := make([]ListUserSecretModel, 0)
 
-	whereFilters := sq.Eq{
-		"user_id": userId,
-	}
+	whereFilters := sq.Eq{}
 
 	if categoryId > 0 {
 		whereFilters["category_id"] = categoryId
 	}
+	if itemType != "" {
+		whereFilters["item_type"] = itemType
+	}
 
 	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.Select(
 		"id",
@@ -78,15 +90,23 @@ func ListUserSecretDB(userId, categoryId int) ([]ListUserSecretModel, error) {
 		"password_json",
 		"safe_note_json",
 		"url_site",
-	).From("user_secrets").Where(whereFilters).OrderBy("id DESC").ToSql()
-
-	cn, tx, _ := storage.ApplicationDB.Begin()
+		"item_type",
+		"type_data_json",
+		"version",
+		tagsColumn,
+		"organization_id",
+	).From("user_secrets").Where(personalOrMemberScope(userId)).Where(whereFilters).OrderBy("id DESC").ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return nil, internalError(err)
+	}
 	defer storage.ApplicationDB.Rollback(cn, tx)
 
 	rows, err := tx.Query(context.Background(), selectQry, selectQryArgs...)
 	if err != nil {
 		logger.Logger.Error("err select qry", zap.Error(err))
-		return itemsUserSecrets, err
+		return itemsUserSecrets, internalError(err)
 	}
 
 	defer rows.Close()
@@ -99,16 +119,30 @@ func ListUserSecretDB(userId, categoryId int) ([]ListUserSecretModel, error) {
 			&userSecret.PasswordEncrypted,
 			&userSecret.SafeNoteEncrypted,
 			&userSecret.URLSite,
+			&userSecret.Type,
+			&userSecret.TypeData,
+			&userSecret.Version,
+			&userSecret.Tags,
+			&userSecret.OrganizationId,
 		)
 		if err != nil {
 			logger.Logger.Error("err scan item", zap.Error(err))
-			return itemsUserSecrets, err
+			return itemsUserSecrets, internalError(err)
 		}
 
 		itemsUserSecrets = append(itemsUserSecrets, userSecret)
 	}
+	rows.Close()
 
-	return itemsUserSecrets, err
+	if categoryId == 0 {
+		itemsShared, err := listSharedWithUserTx(tx, userId, itemType)
+		if err != nil {
+			return itemsUserSecrets, err
+		}
+		itemsUserSecrets = append(itemsUserSecrets, itemsShared...)
+	}
+
+	return itemsUserSecrets, nil
 }
 
 type UserSecretModel struct {
@@ -119,43 +153,138 @@ type UserSecretModel struct {
 	PasswordEncrypted json.RawMessage `json:"passwordEncrypted"`
 	SafeNoteEncrypted json.RawMessage `json:"safeNoteEncrypted"`
 	URLSite           string          `json:"urlSite"`
+	Type              string          `json:"type"`
+	TypeData          json.RawMessage `json:"typeData"`
+	CustomFields      json.RawMessage `json:"customFields"`
+	TOTP              json.RawMessage `json:"totp"` // null without totp
+	Version           int             `json:"version"`
+	UpdatedAt         time.Time       `json:"updatedAt"`
+	Tags              []string        `json:"tags"`
 }
 
-func GetUserSecretByIdDB(userId, secretId int) (userSecret UserSecretModel, err error) {
-	selectSecret, selectSecretArgs, _ := storage.ApplicationDB.Psql.Select(
-		"id",
-		"description",
-		"username",
-		"password_json",
-		"safe_note_json",
-		"url_site",
-		"category_id",
-	).From("user_secrets").Where(sq.Eq{
-		"user_id": userId,
-		"id":      secretId,
-	}).ToSql()
+var userSecretColumns = []string{
+	"id",
+	"description",
+	"username",
+	"password_json",
+	"safe_note_json",
+	"url_site",
+	"item_type",
+	"type_data_json",
+	"COALESCE(custom_fields_json, '[]')",
+	"totp_json",
+	"category_id",
+	"version",
+	"updated_at",
+	tagsColumn,
+}
 
-	cn, tx, _ := storage.ApplicationDB.Begin()
-	defer storage.ApplicationDB.Rollback(cn, tx)
+// tagsColumn selects the tags of the user_secrets row as text[].
+const tagsColumn = "COALESCE((SELECT array_agg(t.name ORDER BY t.name) FROM user_secret_tags t WHERE t.secret_id = user_secrets.id), '{}') AS tags"
+
+// scanUserSecret scans the userSecretColumns.
+func scanUserSecret(row pgx.Row, userSecret *UserSecretModel) error {
+	return row.Scan(userSecretFields(userSecret)...)
+}
 
-	err = tx.QueryRow(context.Background(), selectSecret, selectSecretArgs...).Scan(
+// userSecretFields are the scan destinations of userSecretColumns.
+func userSecretFields(userSecret *UserSecretModel) []interface{} {
+	return []interface{}{
 		&userSecret.Id,
 		&userSecret.Description,
 		&userSecret.Username,
 		&userSecret.PasswordEncrypted,
 		&userSecret.SafeNoteEncrypted,
 		&userSecret.URLSite,
+		&userSecret.Type,
+		&userSecret.TypeData,
+		&userSecret.CustomFields,
+		&userSecret.TOTP,
 		&userSecret.CategoryId,
-	)
+		&userSecret.Version,
+		&userSecret.UpdatedAt,
+		&userSecret.Tags,
+	}
+}
+
+func selectUserSecretTx(tx pgx.Tx, userId, secretId int) (userSecret UserSecretModel, err error) {
+	return selectSecretTx(tx, sq.Eq{"user_id": userId}, secretId)
+}
+
+// selectSecretTx selects the secret in the scope: the user or the organization.
+func selectSecretTx(tx pgx.Tx, scope sq.Eq, secretId int) (userSecret UserSecretModel, err error) {
+	selectSecret, selectSecretArgs, _ := storage.ApplicationDB.Psql.
+		Select(userSecretColumns...).
+		From("user_secrets").
+		Where(scope).
+		Where(sq.Eq{
+			"id": secretId,
+		}).ToSql()
+
+	err = scanUserSecret(tx.QueryRow(context.Background(), selectSecret, selectSecretArgs...), &userSecret)
+	if err == pgx.ErrNoRows {
+		return userSecret, notFoundError(fmt.Sprintf("user secret %d not found", secretId))
+	}
+	if err != nil {
+		return userSecret, internalError(err)
+	}
+	return userSecret, nil
+}
+
+func GetUserSecretByIdDB(userId, secretId int) (userSecret UserSecretModel, err error) {
+	cn, tx, err := storage.ApplicationDB.Begin()
 	if err != nil {
+		return userSecret, internalError(err)
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	userSecret, err = selectUserSecretTx(tx, userId, secretId)
+	if err != nil && KindOf(err) == KindInternal {
 		logger.Logger.Error("err query", zap.Error(err))
-		return userSecret, err
 	}
 	return userSecret, err
 }
 
+// prepareCategoryTx returns the category for the secret: the new category is created when categoryId is 0,
+// otherwise the category must belong to the user.
+func prepareCategoryTx(tx pgx.Tx, userId, categoryId int, newCategoryName string) (int, error) {
+	if categoryId == 0 {
+		insertNewCategory, insertNewCategoryArgs, _ := storage.ApplicationDB.Psql.Insert("secret_categories").
+			SetMap(map[string]interface{}{
+				"name":    newCategoryName,
+				"user_id": userId,
+			}).Suffix("RETURNING id").ToSql()
+
+		err := tx.QueryRow(context.Background(), insertNewCategory, insertNewCategoryArgs...).Scan(&categoryId)
+		if err != nil {
+			logger.Logger.Error("err insert new category", zap.Error(err))
+			return 0, internalError(err)
+		}
+		return categoryId, nil
+	}
+
+	selectCategory, selectCategoryArgs, _ := storage.ApplicationDB.Psql.
+		Select("id").
+		From("secret_categories").
+		Where(sq.Eq{
+			"id":      categoryId,
+			"user_id": userId,
+		}).ToSql()
+
+	err := tx.QueryRow(context.Background(), selectCategory, selectCategoryArgs...).Scan(&categoryId)
+	if err == pgx.ErrNoRows {
+		return 0, FieldError("categoryId", "category does not exists")
+	}
+	if err != nil {
+		logger.Logger.Error("err select category", zap.Error(err))
+		return 0, internalError(err)
+	}
+	return categoryId, nil
+}
+
 type NewUserSecretModel struct {
 	UserId            int
+	OrganizationId    int // the secret of the organization instead of the user
 	CategoryId        int
 	NewCategoryName   string
 	Description       string
@@ -163,57 +292,94 @@ type NewUserSecretModel struct {
 	PasswordEncrypted []byte
 	SafeNoteEncrypted []byte
 	URLSite           string
+	Type              string
+	TypeData          []byte
+	CustomFields      []byte
+	TOTP              []byte
+	Tags              []string
 }
 
-func SaveNewUserSecretDB(newUserSecret NewUserSecretModel) (int, error) {
-	cn, tx, _ := storage.ApplicationDB.Begin()
-
-	if newUserSecret.CategoryId == 0 {
-		insertNewCategory, insertNewCategoryArgs, _ := storage.ApplicationDB.Psql.Insert("secret_categories").
-			SetMap(map[string]interface{}{
-				"name":    newUserSecret.NewCategoryName,
-				"user_id": newUserSecret.UserId,
-			}).Suffix("RETURNING id").ToSql()
-
-		err := tx.QueryRow(context.Background(), insertNewCategory, insertNewCategoryArgs...).Scan(&newUserSecret.CategoryId)
-		if err != nil {
-			logger.Logger.Error("err insert new category", zap.Error(err))
-
-			_ = storage.ApplicationDB.Rollback(cn, tx)
-
-			return 0, err
-		}
-
+// insertUserSecretTx inserts the secret in the category already prepared and its tags.
+func insertUserSecretTx(tx pgx.Tx, newUserSecret NewUserSecretModel) (int, error) {
+	var ownerId, organizationId interface{} = newUserSecret.UserId, nil
+	if newUserSecret.OrganizationId != 0 {
+		ownerId, organizationId = nil, newUserSecret.OrganizationId
 	}
 
 	insertSecret, insertSecretArgs, _ := storage.ApplicationDB.Psql.Insert("user_secrets").
 		SetMap(map[string]interface{}{
-			"description":    newUserSecret.Description,
-			"username":       newUserSecret.Username,
-			"password_json":  newUserSecret.PasswordEncrypted,
-			"safe_note_json": newUserSecret.SafeNoteEncrypted,
-			"url_site":       newUserSecret.URLSite,
-			"category_id":    newUserSecret.CategoryId,
-			"user_id":        newUserSecret.UserId,
+			"description":        newUserSecret.Description,
+			"username":           newUserSecret.Username,
+			"password_json":      newUserSecret.PasswordEncrypted,
+			"safe_note_json":     newUserSecret.SafeNoteEncrypted,
+			"url_site":           newUserSecret.URLSite,
+			"item_type":          newUserSecret.Type,
+			"type_data_json":     newUserSecret.TypeData,
+			"custom_fields_json": newUserSecret.CustomFields,
+			"totp_json":          newUserSecret.TOTP,
+			"category_id":        newUserSecret.CategoryId,
+			"user_id":            ownerId,
+			"organization_id":    organizationId,
 		}).Suffix("RETURNING id").ToSql()
 
 	var newSecretId int
 	err := tx.QueryRow(context.Background(), insertSecret, insertSecretArgs...).Scan(&newSecretId)
 	if err != nil {
 		logger.Logger.Error("err insert user secret", zap.Error(err))
+		return 0, internalError(err)
+	}
+
+	if len(newUserSecret.Tags) > 0 {
+		insertTags := storage.ApplicationDB.Psql.Insert("user_secret_tags").Columns("secret_id", "name")
+		for _, tag := range newUserSecret.Tags {
+			insertTags = insertTags.Values(newSecretId, tag)
+		}
+		insertTagsQry, insertTagsArgs, _ := insertTags.Suffix("ON CONFLICT DO NOTHING").ToSql()
+
+		if _, err = tx.Exec(context.Background(), insertTagsQry, insertTagsArgs...); err != nil {
+			logger.Logger.Error("err insert tags", zap.Error(err))
+			return 0, internalError(err)
+		}
+	}
+	return newSecretId, nil
+}
+
+func SaveNewUserSecretDB(newUserSecret NewUserSecretModel) (int, error) {
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return 0, internalError(err)
+	}
+
+	newCategory := newUserSecret.CategoryId == 0
+
+	newUserSecret.CategoryId, err = prepareCategoryTx(tx, newUserSecret.UserId, newUserSecret.CategoryId, newUserSecret.NewCategoryName)
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return 0, err
+	}
 
+	newSecretId, err := insertUserSecretTx(tx, newUserSecret)
+	if err != nil {
 		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return 0, err
+	}
 
-	} else {
-		_ = storage.ApplicationDB.Commit(cn, tx)
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return 0, internalError(err)
 	}
 
-	return newSecretId, err
+	if newCategory {
+		events.Hub.Publish(events.Event{Type: events.CategoryCreated, UserId: newUserSecret.UserId, EntityId: newUserSecret.CategoryId})
+	}
+	events.Hub.Publish(events.Event{Type: events.SecretCreated, UserId: newUserSecret.UserId, EntityId: newSecretId, Version: 1})
+
+	return newSecretId, nil
 }
 
 type UpdateUserSecretModel struct {
 	UserId            int
 	SecretId          int
+	Version           int
 	CategoryId        int
 	NewCategoryName   string
 	Description       string
@@ -221,146 +387,212 @@ type UpdateUserSecretModel struct {
 	PasswordEncrypted []byte
 	SafeNoteEncrypted []byte
 	URLSite           string
+	Type              string
+	TypeData          []byte
+	CustomFields      []byte
+	TOTP              []byte
 }
 
-func UpdateUserSecretDB(userSecretModel UpdateUserSecretModel) error {
-	cn, tx, _ := storage.ApplicationDB.Begin()
+func UpdateUserSecretDB(userSecretModel UpdateUserSecretModel) (int, error) {
+	return updateUserSecretVersioned(
+		userSecretModel.UserId,
+		userSecretModel.SecretId,
+		userSecretModel.Version,
+		&categoryChange{CategoryId: userSecretModel.CategoryId, NewCategoryName: userSecretModel.NewCategoryName},
+		map[string]interface{}{
+			"description":        userSecretModel.Description,
+			"username":           userSecretModel.Username,
+			"password_json":      userSecretModel.PasswordEncrypted,
+			"safe_note_json":     userSecretModel.SafeNoteEncrypted,
+			"url_site":           userSecretModel.URLSite,
+			"item_type":          userSecretModel.Type,
+			"type_data_json":     userSecretModel.TypeData,
+			"custom_fields_json": userSecretModel.CustomFields,
+			"totp_json":          userSecretModel.TOTP,
+		})
+}
 
-	if userSecretModel.CategoryId == 0 {
-		insertNewCategory, insertNewCategoryArgs, _ := storage.ApplicationDB.Psql.Insert("secret_categories").
-			SetMap(map[string]interface{}{
-				"name":    userSecretModel.NewCategoryName,
-				"user_id": userSecretModel.UserId,
-			}).Suffix("RETURNING id").ToSql()
+// PatchUserSecretModel only has the fields to change, nil keeps the stored value.
+type PatchUserSecretModel struct {
+	UserId            int
+	SecretId          int
+	Version           int
+	CategoryId        *int
+	NewCategoryName   *string
+	Description       *string
+	Username          *string
+	PasswordEncrypted []byte
+	SafeNoteEncrypted []byte
+	URLSite           *string
+	Type              *string // set with TypeData, the type data of the old type is replaced
+	TypeData          []byte
+	CustomFields      []byte // the whole list, nil keeps it
+	TOTP              []byte
+	ClearTOTP         bool
+}
 
-		err := tx.QueryRow(context.Background(), insertNewCategory, insertNewCategoryArgs...).Scan(&userSecretModel.CategoryId)
-		if err != nil {
-			logger.Logger.Error("err insert new category", zap.Error(err))
+func PatchUserSecretDB(patchModel PatchUserSecretModel) (int, error) {
+	columns := make(map[string]interface{})
+	if patchModel.Description != nil {
+		columns["description"] = *patchModel.Description
+	}
+	if patchModel.Username != nil {
+		columns["username"] = *patchModel.Username
+	}
+	if patchModel.PasswordEncrypted != nil {
+		columns["password_json"] = patchModel.PasswordEncrypted
+	}
+	if patchModel.SafeNoteEncrypted != nil {
+		columns["safe_note_json"] = patchModel.SafeNoteEncrypted
+	}
+	if patchModel.URLSite != nil {
+		columns["url_site"] = *patchModel.URLSite
+	}
+	if patchModel.Type != nil {
+		columns["item_type"] = *patchModel.Type
+		columns["type_data_json"] = patchModel.TypeData
+	}
+	if patchModel.CustomFields != nil {
+		columns["custom_fields_json"] = patchModel.CustomFields
+	}
+	if patchModel.TOTP != nil || patchModel.ClearTOTP {
+		columns["totp_json"] = patchModel.TOTP
+	}
 
-			_ = storage.ApplicationDB.Rollback(cn, tx)
+	var category *categoryChange
+	if patchModel.NewCategoryName != nil {
+		category = &categoryChange{NewCategoryName: *patchModel.NewCategoryName}
+	} else if patchModel.CategoryId != nil {
+		category = &categoryChange{CategoryId: *patchModel.CategoryId}
+	}
 
-			return err
+	return updateUserSecretVersioned(patchModel.UserId, patchModel.SecretId, patchModel.Version, category, columns)
+}
+
+type categoryChange struct {
+	CategoryId      int
+	NewCategoryName string // the category is created when CategoryId is 0
+}
+
+// updateUserSecretVersioned updates the columns when the secret is at the version,
+// the category is only changed when category isn't nil. It returns the new version.
+func updateUserSecretVersioned(userId, secretId, version int, category *categoryChange, columns map[string]interface{}) (int, error) {
+	contentChanged := len(columns) > 0
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return 0, internalError(err)
+	}
+
+	newCategory := category != nil && category.CategoryId == 0
+	if category != nil {
+		category.CategoryId, err = prepareCategoryTx(tx, userId, category.CategoryId, category.NewCategoryName)
+		if err != nil {
+			_ = storage.ApplicationDB.Rollback(cn, tx)
+			return 0, err
 		}
+		columns["category_id"] = category.CategoryId
 	}
 
 	updateUserSecret, updateUserSecretArgs, _ := storage.ApplicationDB.Psql.Update("user_secrets").
-		SetMap(map[string]interface{}{
-			"description":    userSecretModel.Description,
-			"username":       userSecretModel.Username,
-			"password_json":  userSecretModel.PasswordEncrypted,
-			"safe_note_json": userSecretModel.SafeNoteEncrypted,
-			"url_site":       userSecretModel.URLSite,
-			"category_id":    userSecretModel.CategoryId,
-		}).Where(sq.Eq{
-		"id":      userSecretModel.SecretId,
-		"user_id": userSecretModel.UserId,
-	}).ToSql()
-
-	_, err := tx.Exec(context.Background(), updateUserSecret, updateUserSecretArgs...)
-	if err != nil {
+		SetMap(touchedColumns(columns)).
+		Where(sq.Eq{
+			"id":      secretId,
+			"user_id": userId,
+			"version": version,
+		}).Suffix("RETURNING version").ToSql()
+
+	var newVersion int
+	var shareEvents []events.Event
+	err = tx.QueryRow(context.Background(), updateUserSecret, updateUserSecretArgs...).Scan(&newVersion)
+	if err == pgx.ErrNoRows {
+		err = versionConflictTx(tx, userId, secretId)
+	} else if err != nil {
 		logger.Logger.Error("err updating user secret", zap.Error(err))
-
+		err = internalError(err)
+	} else if contentChanged {
+		shareEvents, err = markSharesStaleTx(tx, secretId)
+	}
+	if err != nil {
 		_ = storage.ApplicationDB.Rollback(cn, tx)
-	} else {
-		_ = storage.ApplicationDB.Commit(cn, tx)
+		return 0, err
 	}
 
-	return err
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return 0, internalError(err)
+	}
+
+	if newCategory {
+		events.Hub.Publish(events.Event{Type: events.CategoryCreated, UserId: userId, EntityId: category.CategoryId})
+	}
+	events.Hub.Publish(events.Event{Type: events.SecretUpdated, UserId: userId, EntityId: secretId, Version: newVersion})
+	for _, event := range shareEvents {
+		events.Hub.Publish(event)
+	}
+
+	return newVersion, nil
 }
 
-func DeleteUserSecretDB(userId, secretId int) error {
+func DeleteUserSecretDB(userId, secretId, version int) error {
 	deleteQry, deleteArgs, _ := storage.ApplicationDB.Psql.Delete("user_secrets").Where(sq.Eq{
 		"user_id": userId,
 		"id":      secretId,
+		"version": version,
 	}).ToSql()
 
-	cn, tx, _ := storage.ApplicationDB.Begin()
-
-	_, err := tx.Exec(context.Background(), deleteQry, deleteArgs...)
+	cn, tx, err := storage.ApplicationDB.Begin()
 	if err != nil {
-
-		logger.Logger.Error("err deleting secret", zap.Error(err))
-		_ = storage.ApplicationDB.Rollback(cn, tx)
-
-	} else {
-		_ = storage.ApplicationDB.Commit(cn, tx)
+		return internalError(err)
 	}
 
-	return err
-}
-
-func QueryUserSecretsForExportAsBackup(userId int) (string, []byte) {
-	cn, tx, _ := storage.ApplicationDB.Begin()
-	defer storage.ApplicationDB.Rollback(cn, tx)
-
-	selectUsername, selectUsernameArgs, _ := storage.ApplicationDB.Psql.
-		Select("username").
-		From("users").
-		Where(sq.Eq{
-			"id": userId,
-		}).ToSql()
-
-	var username string
-	if err := tx.QueryRow(context.Background(), selectUsername, selectUsernameArgs...).Scan(&username); err != nil {
-		logger.Logger.Error("err scan", zap.Error(err))
-	}
-
-	copyUserQuery := fmt.Sprintf("COPY (SELECT id, username, password_hash, created_at FROM users WHERE id = %d) TO STDOUT", userId)
-	outputWriterUserQuery := bytes.NewBuffer(make([]byte, 0))
-	result, err := cn.PgConn().CopyTo(context.Background(), outputWriterUserQuery, copyUserQuery)
+	// rolled back with the secret when the version doesn't match
+	shareEvents, err := revokeSharesTx(tx, sq.Eq{"secret_id": secretId, "owner_id": userId})
 	if err != nil {
-		logger.Logger.Error("err copy to", zap.Error(err))
-	} else {
-		logger.Logger.Info("result copy users to", zap.Int64("RowsAffected", result.RowsAffected()))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return err
 	}
 
-	copySecretCategoriesQuery := fmt.Sprintf("COPY (SELECT id, name, user_id FROM secret_categories WHERE user_id = %d) TO STDOUT", userId)
-	outputWriterCategoryQuery := bytes.NewBuffer(make([]byte, 0))
-	result, err = cn.PgConn().CopyTo(context.Background(), outputWriterCategoryQuery, copySecretCategoriesQuery)
+	result, err := tx.Exec(context.Background(), deleteQry, deleteArgs...)
 	if err != nil {
-		logger.Logger.Error("err copy to", zap.Error(err))
+		logger.Logger.Error("err deleting secret", zap.Error(err))
+		err = internalError(err)
+	} else if result.RowsAffected() == 0 {
+		err = versionConflictTx(tx, userId, secretId)
 	} else {
-		logger.Logger.Info("result copy secret_categories to", zap.Int64("RowsAffected", result.RowsAffected()))
+		err = insertTombstoneTx(tx, userId, tombstoneSecret, secretId)
 	}
-
-	copyUserSecretsQuery := fmt.Sprintf("COPY (SELECT id, description, username, password_json, safe_note_json, url_site, created_at, category_id, user_id FROM user_secrets WHERE user_id = %d) TO STDOUT", userId)
-	outputWriterSecretsQuery := bytes.NewBuffer(make([]byte, 0))
-	result, err = cn.PgConn().CopyTo(context.Background(), outputWriterSecretsQuery, copyUserSecretsQuery)
 	if err != nil {
-		logger.Logger.Error("err copy to", zap.Error(err))
-	} else {
-		logger.Logger.Info("result copy user_secrets to", zap.Int64("RowsAffected", result.RowsAffected()))
-	}
-
-	zipMemoryFile := bytes.NewBuffer(make([]byte, 0))
-	zipWriter := zip.NewWriter(zipMemoryFile)
-	// defer zipWriter.Close() // don't use defer we need to flush
-
-	userCSVWriter, _ := zipWriter.Create("1.csv")
-	if _, err = userCSVWriter.Write(outputWriterUserQuery.Bytes()); err != nil {
-		logger.Logger.Error("err writing zip file", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return err
 	}
 
-	secretCategoriesCSVWriter, _ := zipWriter.Create("2.csv")
-	if _, err = secretCategoriesCSVWriter.Write(outputWriterCategoryQuery.Bytes()); err != nil {
-		logger.Logger.Error("err writing zip file", zap.Error(err))
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return internalError(err)
 	}
 
-	secretsCSVWriter, _ := zipWriter.Create("3.csv")
-	// SAME AS: secretsCSVWriter.Write(outputWriterSecretsQuery.Bytes()) // ---> yep
-	if _, err = io.Copy(secretsCSVWriter, outputWriterSecretsQuery); err != nil {
-		logger.Logger.Error("err writing zip file", zap.Error(err))
+	RemoveOrphanAttachments(userId)
+	events.Hub.Publish(events.Event{Type: events.SecretDeleted, UserId: userId, EntityId: secretId})
+	for _, event := range shareEvents {
+		events.Hub.Publish(event)
 	}
+	return nil
+}
 
-	_ = zipWriter.Close()
-
-	/*
-		// test the zip file:
-		err = os.WriteFile("/tmp/the-user.csv.zip", zipMemoryFile.Bytes(), 0777)
-		if err != nil {
-			logger.Logger.Error("err writing file", zap.Error(err))
-		}
-	*/
+// touchedColumns adds the columns changed on every update of user_secrets:
+// the version for the optimistic concurrency and the transaction for the sync.
+func touchedColumns(values map[string]interface{}) map[string]interface{} {
+	values["version"] = sq.Expr("version + 1")
+	values["updated_at"] = sq.Expr("CURRENT_TIMESTAMP")
+	values["sync_txid"] = sq.Expr("txid_current()")
+	return values
+}
 
-	return username, zipMemoryFile.Bytes()
+// versionConflictTx is called when a versioned write didn't match any row:
+// the secret doesn't exist (KindNotFound) or it has another version (KindConflict).
+func versionConflictTx(tx pgx.Tx, userId, secretId int) error {
+	current, err := selectUserSecretTx(tx, userId, secretId)
+	if err != nil {
+		return err
+	}
+	return conflictError(current)
 }
@@ -0,0 +1,548 @@
+package secrets
+
+import (
+	"app-ez-pwd/internal/events"
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/storage"
+	"context"
+	"fmt"
+	sq "github.com/Masterminds/squirrel"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+	"time"
+)
+
+// The emergency access of a trusted contact (the grantee) to the vault of the grantor:
+// granted -> requested by the grantee -> approved by the grantor or after the waiting days,
+// the grantor rejects the request back to granted.
+const (
+	EmergencyGranted   = "granted"
+	EmergencyRequested = "requested"
+	EmergencyApproved  = "approved"
+)
+
+// The actions of the audit entries, the timeout entries don't have actor.
+const (
+	EmergencyActionGranted  = "granted"
+	EmergencyActionRequest  = "requested"
+	EmergencyActionApproved = "approved"
+	EmergencyActionRejected = "rejected"
+	EmergencyActionTimeout  = "approved_by_timeout"
+	EmergencyActionViewed   = "viewed"
+	EmergencyActionRevoked  = "revoked"
+	EmergencyActionReset    = "reset" // granting again cancelled the request or the approved access
+)
+
+const maxEmergencyWaitDays = 90
+
+// EmergencyTimeoutInterval is how often the requests with the waiting days elapsed are approved.
+const EmergencyTimeoutInterval = 10 * time.Minute
+
+type EmergencyAccessModel struct {
+	Id              int        `json:"id"`
+	GrantorUsername string     `json:"grantorUsername"`
+	GranteeUsername string     `json:"granteeUsername"`
+	WaitDays        int        `json:"waitDays"`
+	Status          string     `json:"status"`
+	RequestedAt     *time.Time `json:"requestedAt"`
+	CreatedAt       time.Time  `json:"createdAt"`
+}
+
+// ListEmergencyAccessModel has the contacts the user trusts and the users that trust the user.
+type ListEmergencyAccessModel struct {
+	Granted []EmergencyAccessModel `json:"granted"` // the user is the grantor
+	Trusted []EmergencyAccessModel `json:"trusted"` // the user is the grantee
+}
+
+type EmergencyAuditModel struct {
+	Action        string    `json:"action"`
+	ActorUsername *string   `json:"actorUsername"` // null for the timeout
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// EmergencyVaultModel is the vault of the grantor for the grantee, the client unwraps WrappedKey
+// with its private key and decrypts the secrets with it.
+type EmergencyVaultModel struct {
+	GrantorUsername string              `json:"grantorUsername"`
+	WrappedKey      string              `json:"wrappedKey"`
+	Categories      []ListCategoryModel `json:"categories"`
+	Secrets         []UserSecretModel   `json:"secrets"`
+}
+
+// emergencyAccessRow is the access with the ids, for the checks of the changes.
+type emergencyAccessRow struct {
+	id        int
+	grantorId int
+	granteeId int
+	status    string
+}
+
+// GrantEmergencyAccessDB adds the trusted contact, granting again updates the wrapped key and the waiting days
+// and goes back to granted: the grantee must request the access with the new key.
+func GrantEmergencyAccessDB(grantorId int, granteeUsername string, waitDays int, wrappedKey string) (EmergencyAccessModel, error) {
+	access := EmergencyAccessModel{WaitDays: waitDays}
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return access, internalError(err)
+	}
+
+	grantee, err := selectPublicKeyTx(tx, granteeUsername)
+	if KindOf(err) == KindNotFound {
+		err = FieldError("granteeUsername", "the user doesn't exist or doesn't have keys")
+	} else if err == nil && grantee.UserId == grantorId {
+		err = FieldError("granteeUsername", "the emergency access can't be granted to yourself")
+	}
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return access, err
+	}
+	access.GranteeUsername = grantee.Username
+
+	selectStatus, selectStatusArgs, _ := storage.ApplicationDB.Psql.
+		Select("status").
+		From("emergency_access").
+		Where(sq.Eq{
+			"grantor_id": grantorId,
+			"grantee_id": grantee.UserId,
+		}).
+		Suffix("FOR UPDATE").ToSql()
+
+	var previousStatus string
+	err = tx.QueryRow(context.Background(), selectStatus, selectStatusArgs...).Scan(&previousStatus)
+	if err != nil && err != pgx.ErrNoRows {
+		logger.Logger.Error("err select emergency access", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return access, internalError(err)
+	}
+
+	insertAccess, insertAccessArgs, _ := storage.ApplicationDB.Psql.Insert("emergency_access").
+		SetMap(map[string]interface{}{
+			"grantor_id":  grantorId,
+			"grantee_id":  grantee.UserId,
+			"wait_days":   waitDays,
+			"status":      EmergencyGranted,
+			"wrapped_key": wrappedKey,
+		}).
+		Suffix("ON CONFLICT (grantor_id, grantee_id) DO UPDATE SET " +
+			"wait_days = EXCLUDED.wait_days, wrapped_key = EXCLUDED.wrapped_key, status = EXCLUDED.status, " +
+			"requested_at = NULL, updated_at = CURRENT_TIMESTAMP " +
+			"RETURNING id, status, requested_at, created_at, " +
+			"(SELECT username FROM users WHERE id = emergency_access.grantor_id)").ToSql()
+
+	err = tx.QueryRow(context.Background(), insertAccess, insertAccessArgs...).
+		Scan(&access.Id, &access.Status, &access.RequestedAt, &access.CreatedAt, &access.GrantorUsername)
+	accessRow := emergencyAccessRow{id: access.Id, grantorId: grantorId, granteeId: grantee.UserId}
+	if err == nil && (previousStatus == EmergencyRequested || previousStatus == EmergencyApproved) {
+		err = insertEmergencyAuditTx(tx, accessRow, EmergencyActionReset, &grantorId)
+	}
+	if err == nil {
+		err = insertEmergencyAuditTx(tx, accessRow, EmergencyActionGranted, &grantorId)
+	}
+	if err != nil {
+		logger.Logger.Error("err insert emergency access", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return access, internalError(err)
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return access, internalError(err)
+	}
+
+	events.Hub.Publish(events.Event{Type: events.EmergencyAccessChanged, UserId: grantee.UserId, EntityId: access.Id})
+	return access, nil
+}
+
+func ListEmergencyAccessDB(userId int) (ListEmergencyAccessModel, error) {
+	result := ListEmergencyAccessModel{
+		Granted: make([]EmergencyAccessModel, 0),
+		Trusted: make([]EmergencyAccessModel, 0),
+	}
+
+	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.
+		Select("e.id", "e.grantor_id", "g.username", "r.username", "e.wait_days", "e.status", "e.requested_at", "e.created_at").
+		From("emergency_access e").
+		Join("users g ON g.id = e.grantor_id").
+		Join("users r ON r.id = e.grantee_id").
+		Where(sq.Or{
+			sq.Eq{"e.grantor_id": userId},
+			sq.Eq{"e.grantee_id": userId},
+		}).OrderBy("e.id").ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return result, internalError(err)
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	rows, err := tx.Query(context.Background(), selectQry, selectQryArgs...)
+	if err != nil {
+		logger.Logger.Error("err query emergency access", zap.Error(err))
+		return result, internalError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var access EmergencyAccessModel
+		var grantorId int
+		err = rows.Scan(&access.Id, &grantorId, &access.GrantorUsername, &access.GranteeUsername,
+			&access.WaitDays, &access.Status, &access.RequestedAt, &access.CreatedAt)
+		if err != nil {
+			logger.Logger.Error("err scan emergency access", zap.Error(err))
+			return result, internalError(err)
+		}
+		if grantorId == userId {
+			result.Granted = append(result.Granted, access)
+		} else {
+			result.Trusted = append(result.Trusted, access)
+		}
+	}
+	return result, nil
+}
+
+// selectEmergencyAccessTx locks the access of the user (grantor or grantee).
+func selectEmergencyAccessTx(tx pgx.Tx, userId, accessId int) (emergencyAccessRow, error) {
+	var access emergencyAccessRow
+
+	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.
+		Select("id", "grantor_id", "grantee_id", "status").
+		From("emergency_access").
+		Where(sq.Eq{
+			"id": accessId,
+		}).
+		Where(sq.Or{
+			sq.Eq{"grantor_id": userId},
+			sq.Eq{"grantee_id": userId},
+		}).
+		Suffix("FOR UPDATE").ToSql()
+
+	err := tx.QueryRow(context.Background(), selectQry, selectQryArgs...).
+		Scan(&access.id, &access.grantorId, &access.granteeId, &access.status)
+	if err == pgx.ErrNoRows {
+		return access, notFoundError(fmt.Sprintf("emergency access %d not found", accessId))
+	}
+	if err != nil {
+		logger.Logger.Error("err scan emergency access", zap.Error(err))
+		return access, internalError(err)
+	}
+	return access, nil
+}
+
+func insertEmergencyAuditTx(tx pgx.Tx, access emergencyAccessRow, action string, actorId *int) error {
+	insertAudit, insertAuditArgs, _ := storage.ApplicationDB.Psql.Insert("emergency_access_audit").
+		SetMap(map[string]interface{}{
+			"access_id":  access.id,
+			"grantor_id": access.grantorId,
+			"grantee_id": access.granteeId,
+			"action":     action,
+			"actor_id":   actorId,
+		}).ToSql()
+
+	_, err := tx.Exec(context.Background(), insertAudit, insertAuditArgs...)
+	return err
+}
+
+// RequestEmergencyAccessDB starts the waiting days, the grantee asks it.
+func RequestEmergencyAccessDB(granteeId, accessId int) error {
+	return changeEmergencyAccess(granteeId, accessId, func(access emergencyAccessRow) (map[string]interface{}, string, error) {
+		if access.granteeId != granteeId {
+			return nil, "", &Error{Kind: KindForbidden, Message: "only the trusted contact requests the access"}
+		}
+		if access.status != EmergencyGranted {
+			return nil, "", &Error{Kind: KindConflict, Message: fmt.Sprintf("the emergency access is %s", access.status)}
+		}
+		return map[string]interface{}{
+			"status":       EmergencyRequested,
+			"requested_at": sq.Expr("CURRENT_TIMESTAMP"),
+		}, EmergencyActionRequest, nil
+	})
+}
+
+// DecideEmergencyAccessDB approves the request or rejects it, the grantor decides.
+// Rejecting an approved access takes it back too.
+func DecideEmergencyAccessDB(grantorId, accessId int, approve bool) error {
+	return changeEmergencyAccess(grantorId, accessId, func(access emergencyAccessRow) (map[string]interface{}, string, error) {
+		if access.grantorId != grantorId {
+			return nil, "", &Error{Kind: KindForbidden, Message: "only the grantor approves or rejects the access"}
+		}
+		if access.status == EmergencyGranted || (approve && access.status == EmergencyApproved) {
+			return nil, "", &Error{Kind: KindConflict, Message: fmt.Sprintf("the emergency access is %s", access.status)}
+		}
+		if approve {
+			return map[string]interface{}{"status": EmergencyApproved}, EmergencyActionApproved, nil
+		}
+		return map[string]interface{}{
+			"status":       EmergencyGranted,
+			"requested_at": nil,
+		}, EmergencyActionRejected, nil
+	})
+}
+
+// changeEmergencyAccess updates the access with the columns of change and writes the audit entry.
+func changeEmergencyAccess(userId, accessId int, change func(access emergencyAccessRow) (map[string]interface{}, string, error)) error {
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return internalError(err)
+	}
+
+	access, err := selectEmergencyAccessTx(tx, userId, accessId)
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return err
+	}
+
+	columns, action, err := change(access)
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return err
+	}
+	columns["updated_at"] = sq.Expr("CURRENT_TIMESTAMP")
+
+	updateQry, updateQryArgs, _ := storage.ApplicationDB.Psql.Update("emergency_access").
+		SetMap(columns).
+		Where(sq.Eq{"id": accessId}).ToSql()
+
+	_, err = tx.Exec(context.Background(), updateQry, updateQryArgs...)
+	if err == nil {
+		err = insertEmergencyAuditTx(tx, access, action, &userId)
+	}
+	if err != nil {
+		logger.Logger.Error("err update emergency access", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return internalError(err)
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return internalError(err)
+	}
+
+	publishEmergencyChange(access)
+	return nil
+}
+
+func publishEmergencyChange(access emergencyAccessRow) {
+	for _, userId := range []int{access.grantorId, access.granteeId} {
+		events.Hub.Publish(events.Event{Type: events.EmergencyAccessChanged, UserId: userId, EntityId: access.id})
+	}
+}
+
+// RevokeEmergencyAccessDB deletes the access: the grantor revokes it or the grantee leaves it.
+// The audit entries are kept.
+func RevokeEmergencyAccessDB(userId, accessId int) error {
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return internalError(err)
+	}
+
+	access, err := selectEmergencyAccessTx(tx, userId, accessId)
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return err
+	}
+
+	deleteQry, deleteQryArgs, _ := storage.ApplicationDB.Psql.Delete("emergency_access").
+		Where(sq.Eq{"id": accessId}).ToSql()
+
+	_, err = tx.Exec(context.Background(), deleteQry, deleteQryArgs...)
+	if err == nil {
+		err = insertEmergencyAuditTx(tx, access, EmergencyActionRevoked, &userId)
+	}
+	if err != nil {
+		logger.Logger.Error("err delete emergency access", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return internalError(err)
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return internalError(err)
+	}
+
+	publishEmergencyChange(access)
+	return nil
+}
+
+// GetEmergencyVaultDB returns the vault of the grantor to the grantee of an approved access.
+func GetEmergencyVaultDB(granteeId, accessId int) (EmergencyVaultModel, error) {
+	var vault EmergencyVaultModel
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return vault, internalError(err)
+	}
+
+	access, err := selectEmergencyAccessTx(tx, granteeId, accessId)
+	if err == nil && (access.granteeId != granteeId || access.status != EmergencyApproved) {
+		err = &Error{Kind: KindForbidden, Message: "the emergency access isn't approved"}
+	}
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return vault, err
+	}
+
+	selectKey, selectKeyArgs, _ := storage.ApplicationDB.Psql.
+		Select("e.wrapped_key", "u.username").
+		From("emergency_access e").
+		Join("users u ON u.id = e.grantor_id").
+		Where(sq.Eq{"e.id": accessId}).ToSql()
+
+	err = tx.QueryRow(context.Background(), selectKey, selectKeyArgs...).Scan(&vault.WrappedKey, &vault.GrantorUsername)
+	if err == nil {
+		err = insertEmergencyAuditTx(tx, access, EmergencyActionViewed, &granteeId)
+	}
+	if err != nil {
+		logger.Logger.Error("err select emergency vault", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return vault, internalError(err)
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return vault, internalError(err)
+	}
+
+	grantorVault, err := SyncUserSecretsDB(access.grantorId, 0)
+	if err != nil {
+		return vault, err
+	}
+	// only the personal vault: the organization and shared secrets are encrypted with keys the grantee doesn't get
+	vault.Categories = make([]ListCategoryModel, 0)
+	for _, category := range grantorVault.Categories {
+		if category.OrganizationId == nil {
+			vault.Categories = append(vault.Categories, category)
+		}
+	}
+	vault.Secrets = make([]UserSecretModel, 0)
+	for _, syncSecret := range grantorVault.Secrets {
+		if syncSecret.OrganizationId == nil {
+			vault.Secrets = append(vault.Secrets, syncSecret.UserSecretModel)
+		}
+	}
+	return vault, nil
+}
+
+// ListEmergencyAuditDB lists the audit entries of the access for the grantor and the grantee,
+// also after the access was revoked.
+func ListEmergencyAuditDB(userId, accessId int) ([]EmergencyAuditModel, error) {
+	entries := make([]EmergencyAuditModel, 0)
+
+	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.
+		Select("a.action", "u.username", "a.created_at").
+		From("emergency_access_audit a").
+		LeftJoin("users u ON u.id = a.actor_id").
+		Where(sq.Eq{
+			"a.access_id": accessId,
+		}).
+		Where(sq.Or{
+			sq.Eq{"a.grantor_id": userId},
+			sq.Eq{"a.grantee_id": userId},
+		}).OrderBy("a.id").ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return entries, internalError(err)
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	rows, err := tx.Query(context.Background(), selectQry, selectQryArgs...)
+	if err != nil {
+		logger.Logger.Error("err query emergency audit", zap.Error(err))
+		return entries, internalError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry EmergencyAuditModel
+		if err = rows.Scan(&entry.Action, &entry.ActorUsername, &entry.CreatedAt); err != nil {
+			logger.Logger.Error("err scan emergency audit", zap.Error(err))
+			return entries, internalError(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return entries, notFoundError(fmt.Sprintf("emergency access %d not found", accessId))
+	}
+	return entries, nil
+}
+
+// ApproveEmergencyTimeoutsDB approves the requests that the grantor didn't reject in the waiting days.
+// The update only takes the requested rows, so the instances can run it at the same time.
+func ApproveEmergencyTimeoutsDB() ([]int, error) {
+	updateQry, updateQryArgs, _ := storage.ApplicationDB.Psql.Update("emergency_access").
+		SetMap(map[string]interface{}{
+			"status":     EmergencyApproved,
+			"updated_at": sq.Expr("CURRENT_TIMESTAMP"),
+		}).
+		Where(sq.Eq{"status": EmergencyRequested}).
+		Where("requested_at + wait_days * INTERVAL '1 day' <= CURRENT_TIMESTAMP").
+		Suffix("RETURNING id, grantor_id, grantee_id").ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	rows, err := tx.Query(context.Background(), updateQry, updateQryArgs...)
+	if err != nil {
+		logger.Logger.Error("err approve emergency timeouts", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return nil, internalError(err)
+	}
+
+	approved := make([]emergencyAccessRow, 0)
+	for rows.Next() {
+		access := emergencyAccessRow{status: EmergencyApproved}
+		if err = rows.Scan(&access.id, &access.grantorId, &access.granteeId); err != nil {
+			rows.Close()
+			_ = storage.ApplicationDB.Rollback(cn, tx)
+			return nil, internalError(err)
+		}
+		approved = append(approved, access)
+	}
+	rows.Close()
+
+	approvedIds := make([]int, 0, len(approved))
+	for _, access := range approved {
+		if err = insertEmergencyAuditTx(tx, access, EmergencyActionTimeout, nil); err != nil {
+			logger.Logger.Error("err insert emergency audit", zap.Error(err))
+			_ = storage.ApplicationDB.Rollback(cn, tx)
+			return nil, internalError(err)
+		}
+		approvedIds = append(approvedIds, access.id)
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return nil, internalError(err)
+	}
+
+	for _, access := range approved {
+		publishEmergencyChange(access)
+	}
+	return approvedIds, nil
+}
+
+// ProcessEmergencyTimeouts is the job of ApproveEmergencyTimeoutsDB.
+func ProcessEmergencyTimeouts() {
+	approvedIds, err := ApproveEmergencyTimeoutsDB()
+	if err != nil {
+		logger.Logger.Error("err emergency timeouts", zap.Error(err))
+	} else if len(approvedIds) > 0 {
+		logger.Logger.Info("emergency access approved by timeout", zap.Ints("ids", approvedIds))
+	}
+}
+
+type EmergencyAccessForm struct {
+	GranteeUsername string `json:"granteeUsername"`
+	WaitDays        int    `json:"waitDays"`
+	WrappedKey      string `json:"wrappedKey"` // the vault key wrapped with the grantee public key
+}
+
+func (f EmergencyAccessForm) ValidateFront() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.GranteeUsername, validation.Required, validation.Length(3, 50)),
+		validation.Field(&f.WaitDays, validation.Required, validation.Min(1), validation.Max(maxEmergencyWaitDays)),
+		validation.Field(&f.WrappedKey, validation.Required, validation.Length(0, 2000), base64Rule))
+}
+
+func (f EmergencyAccessForm) Save(grantorId int) (EmergencyAccessModel, error) {
+	return GrantEmergencyAccessDB(grantorId, f.GranteeUsername, f.WaitDays, f.WrappedKey)
+}
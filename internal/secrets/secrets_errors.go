@@ -0,0 +1,73 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+)
+
+type ErrorKind string
+
+const (
+	KindInternal   ErrorKind = "internal"
+	KindNotFound   ErrorKind = "not_found"
+	KindConflict   ErrorKind = "conflict"
+	KindForbidden  ErrorKind = "forbidden"
+	KindValidation ErrorKind = "validation"
+	KindQuota      ErrorKind = "quota_exceeded"
+)
+
+// Error is the error returned by the secrets package, the apis layer maps the Kind to the http status.
+type Error struct {
+	Kind    ErrorKind
+	Message string
+	Fields  map[string]string // only for KindValidation
+	Current interface{}       // only for KindConflict: the server copy, the secret or the shared secret
+	Version int               // only for KindConflict: the version of Current
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Kind, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Kind, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// KindOf returns KindInternal for errors not created by this package.
+func KindOf(err error) ErrorKind {
+	var secretsErr *Error
+	if errors.As(err, &secretsErr) {
+		return secretsErr.Kind
+	}
+	return KindInternal
+}
+
+func notFoundError(message string) *Error {
+	return &Error{Kind: KindNotFound, Message: message}
+}
+
+func conflictError(current UserSecretModel) *Error {
+	return &Error{
+		Kind:    KindConflict,
+		Message: fmt.Sprintf("the secret was modified, current version is %d", current.Version),
+		Current: &current,
+		Version: current.Version,
+	}
+}
+
+func quotaError(message string) *Error {
+	return &Error{Kind: KindQuota, Message: message}
+}
+
+func internalError(err error) *Error {
+	return &Error{Kind: KindInternal, Message: "internal error", Err: err}
+}
+
+// FieldError is a KindValidation error for a single field.
+func FieldError(field, message string) *Error {
+	return &Error{Kind: KindValidation, Message: "invalid fields", Fields: map[string]string{field: message}}
+}
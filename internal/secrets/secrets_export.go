@@ -0,0 +1,389 @@
+package secrets
+
+import (
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/settings"
+	"app-ez-pwd/internal/storage"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+	"io"
+	"strings"
+	"time"
+)
+
+// The exports for other password managers are client-assisted: the server doesn't have the key, so the
+// secret fields are empty and the encrypted payloads go in the ezPwd fields. The client decrypts them,
+// fills the fields and removes the ezPwd ones, for KeePass it saves the xml as KDBX (ex: with kdbxweb).
+const (
+	ExportBitwardenJSON = "bitwarden-json"
+	ExportKeePassXML    = "keepass-xml"
+)
+
+const exportFormatVersion = 1
+
+// exportVault is the vault of the user read in the same snapshot.
+type exportVault struct {
+	Username   string
+	Categories []ListCategoryModel
+	Secrets    []UserSecretModel
+}
+
+func selectExportVault(userId int) (exportVault, error) {
+	vault := exportVault{Secrets: make([]UserSecretModel, 0)}
+
+	cn, tx, err := storage.ApplicationDB.BeginTx(pgx.TxOptions{
+		IsoLevel:   pgx.RepeatableRead,
+		AccessMode: pgx.ReadOnly,
+	})
+	if err != nil {
+		return vault, internalError(err)
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	selectUsername, selectUsernameArgs, _ := storage.ApplicationDB.Psql.
+		Select("username").
+		From("users").
+		Where(sq.Eq{
+			"id": userId,
+		}).ToSql()
+
+	if err = tx.QueryRow(context.Background(), selectUsername, selectUsernameArgs...).Scan(&vault.Username); err != nil {
+		logger.Logger.Error("err scan", zap.Error(err))
+		return vault, internalError(err)
+	}
+
+	if vault.Categories, err = selectCategoriesTx(tx, userId); err != nil {
+		return vault, err
+	}
+
+	selectSecrets, selectSecretsArgs, _ := storage.ApplicationDB.Psql.
+		Select(userSecretColumns...).
+		From("user_secrets").
+		Where(sq.Eq{
+			"user_id": userId,
+		}).OrderBy("id").ToSql()
+
+	rows, err := tx.Query(context.Background(), selectSecrets, selectSecretsArgs...)
+	if err != nil {
+		logger.Logger.Error("err query", zap.Error(err))
+		return vault, internalError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userSecret UserSecretModel
+		if err = scanUserSecret(rows, &userSecret); err != nil {
+			logger.Logger.Error("err scan", zap.Error(err))
+			return vault, internalError(err)
+		}
+		vault.Secrets = append(vault.Secrets, userSecret)
+	}
+	if err = rows.Err(); err != nil {
+		return vault, internalError(err)
+	}
+	return vault, nil
+}
+
+// UserSecretsExport is the vault read for the export, Write can be called once the headers are sent.
+type UserSecretsExport struct {
+	FileName string
+
+	format string
+	vault  exportVault
+}
+
+// OpenUserSecretsExport reads the vault, nothing is written yet: the caller can still answer with an error.
+func OpenUserSecretsExport(userId int, format string) (*UserSecretsExport, error) {
+	vault, err := selectExportVault(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	fileName := fmt.Sprintf("the-%s-secrets.json", vault.Username)
+	if format == ExportKeePassXML {
+		fileName = fmt.Sprintf("the-%s-secrets.xml", vault.Username)
+	}
+	return &UserSecretsExport{FileName: fileName, format: format, vault: vault}, nil
+}
+
+// Write writes the vault in the format, on error w has a truncated export.
+func (e *UserSecretsExport) Write(w io.Writer) error {
+	if e.format == ExportKeePassXML {
+		return writeKeePassXML(w, e.vault)
+	}
+	return writeBitwardenJSON(w, e.vault)
+}
+
+// ExportMetadata is in both formats, clients check it before the decryption.
+type ExportMetadata struct {
+	FormatVersion  int       `json:"formatVersion"`
+	AppVersion     string    `json:"appVersion"`
+	ExportedAt     time.Time `json:"exportedAt"`
+	Username       string    `json:"username"`
+	ClientAssisted bool      `json:"clientAssisted"` // the encrypted fields must be decrypted by the client
+}
+
+func newExportMetadata(vault exportVault) ExportMetadata {
+	return ExportMetadata{
+		FormatVersion:  exportFormatVersion,
+		AppVersion:     settings.AppVersion,
+		ExportedAt:     time.Now().UTC(),
+		Username:       vault.Username,
+		ClientAssisted: true,
+	}
+}
+
+type bitwardenExport struct {
+	Encrypted bool              `json:"encrypted"`
+	EzPwd     ExportMetadata    `json:"ezPwd"`
+	Folders   []bitwardenFolder `json:"folders"`
+	Items     []bitwardenItem   `json:"items"`
+}
+
+type bitwardenFolder struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type bitwardenField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Type  int    `json:"type"` // 0: text
+}
+
+type bitwardenURI struct {
+	Match *int   `json:"match"`
+	URI   string `json:"uri"`
+}
+
+type bitwardenLogin struct {
+	Username string         `json:"username"`
+	Password *string        `json:"password"` // filled by the client
+	Totp     *string        `json:"totp"`
+	URIs     []bitwardenURI `json:"uris"`
+}
+
+// bitwardenEncrypted has the payloads that the client decrypts into login.password and notes,
+// and the type data for the card, identity and sshKey fields.
+type bitwardenEncrypted struct {
+	Password     json.RawMessage `json:"password"`
+	SafeNote     json.RawMessage `json:"safeNote"`
+	Type         string          `json:"type"`
+	TypeData     json.RawMessage `json:"typeData"`
+	CustomFields json.RawMessage `json:"customFields"` // the client adds them to fields
+	TOTP         json.RawMessage `json:"totp"`         // the client writes the otpauth url in login.totp
+}
+
+// bitwardenTypes are the item types of Bitwarden, the api keys are logins.
+var bitwardenTypes = map[string]int{
+	ItemLogin:      1,
+	ItemAPIKey:     1,
+	ItemSecureNote: 2,
+	ItemCard:       3,
+	ItemIdentity:   4,
+	ItemSSHKey:     5,
+}
+
+type bitwardenItem struct {
+	Id             string             `json:"id"`
+	OrganizationId *string            `json:"organizationId"`
+	FolderId       string             `json:"folderId"`
+	Type           int                `json:"type"` // see bitwardenTypes
+	Reprompt       int                `json:"reprompt"`
+	Name           string             `json:"name"`
+	Notes          *string            `json:"notes"` // filled by the client
+	Favorite       bool               `json:"favorite"`
+	Login          bitwardenLogin     `json:"login"`
+	Fields         []bitwardenField   `json:"fields"`
+	CollectionIds  []string           `json:"collectionIds"`
+	RevisionDate   time.Time          `json:"revisionDate"`
+	EzPwdEncrypted bitwardenEncrypted `json:"ezPwdEncrypted"`
+}
+
+func writeBitwardenJSON(w io.Writer, vault exportVault) error {
+	export := bitwardenExport{
+		EzPwd:   newExportMetadata(vault),
+		Folders: make([]bitwardenFolder, 0, len(vault.Categories)),
+		Items:   make([]bitwardenItem, 0, len(vault.Secrets)),
+	}
+
+	for _, category := range vault.Categories {
+		export.Folders = append(export.Folders, bitwardenFolder{Id: exportUUID("category", category.Id), Name: category.Name})
+	}
+
+	for _, secret := range vault.Secrets {
+		item := bitwardenItem{
+			Id:           exportUUID("secret", secret.Id),
+			FolderId:     exportUUID("category", secret.CategoryId),
+			Type:         bitwardenTypes[secret.Type],
+			Name:         secret.Description,
+			Login:        bitwardenLogin{Username: secret.Username, URIs: make([]bitwardenURI, 0)},
+			Fields:       make([]bitwardenField, 0),
+			RevisionDate: secret.UpdatedAt.UTC(),
+			EzPwdEncrypted: bitwardenEncrypted{
+				Password:     secret.PasswordEncrypted,
+				SafeNote:     secret.SafeNoteEncrypted,
+				Type:         secret.Type,
+				TypeData:     secret.TypeData,
+				CustomFields: secret.CustomFields,
+				TOTP:         secret.TOTP,
+			},
+		}
+		if secret.URLSite != "" {
+			item.Login.URIs = append(item.Login.URIs, bitwardenURI{URI: secret.URLSite})
+		}
+		if len(secret.Tags) > 0 {
+			// Bitwarden doesn't have tags
+			item.Fields = append(item.Fields, bitwardenField{Name: "tags", Value: strings.Join(secret.Tags, ", ")})
+		}
+		export.Items = append(export.Items, item)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(export); err != nil {
+		logger.Logger.Error("err writing export", zap.Error(err))
+		return internalError(err)
+	}
+	return nil
+}
+
+// exportUUID is the same id in every export of the entity, the other managers detect the same item.
+func exportUUID(entity string, id int) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("ez-pwd:%s:%d", entity, id)))
+	uuid := hash[:16]
+	uuid[6] = (uuid[6] & 0x0f) | 0x50 // version 5 like, from a name
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+// keePassUUID is the uuid of the KeePass xml: the 16 bytes in base64.
+func keePassUUID(entity string, id int) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("ez-pwd:%s:%d", entity, id)))
+	return base64.StdEncoding.EncodeToString(hash[:16])
+}
+
+const (
+	keePassPasswordEncryptedKey = "EzPwdPasswordEncrypted"
+	keePassSafeNoteEncryptedKey = "EzPwdSafeNoteEncrypted"
+	keePassTypeKey              = "EzPwdType"
+	keePassTypeDataKey          = "EzPwdTypeData"
+	keePassCustomFieldsKey      = "EzPwdCustomFields"
+	keePassTOTPKey              = "EzPwdTOTP"
+)
+
+type keePassFile struct {
+	XMLName xml.Name    `xml:"KeePassFile"`
+	Meta    keePassMeta `xml:"Meta"`
+	Root    struct {
+		Group keePassGroup `xml:"Group"`
+	} `xml:"Root"`
+}
+
+// keePassMeta has the ExportMetadata as json in the custom data "ez-pwd".
+type keePassMeta struct {
+	Generator    string              `xml:"Generator"`
+	DatabaseName string              `xml:"DatabaseName"`
+	CustomData   []keePassCustomItem `xml:"CustomData>Item"`
+}
+
+type keePassCustomItem struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+type keePassGroup struct {
+	UUID    string         `xml:"UUID"`
+	Name    string         `xml:"Name"`
+	Entries []keePassEntry `xml:"Entry"`
+	Groups  []keePassGroup `xml:"Group"`
+}
+
+type keePassValue struct {
+	Value           string `xml:",chardata"`
+	ProtectInMemory string `xml:"ProtectInMemory,attr,omitempty"`
+}
+
+type keePassString struct {
+	Key   string       `xml:"Key"`
+	Value keePassValue `xml:"Value"`
+}
+
+type keePassEntry struct {
+	UUID  string `xml:"UUID"`
+	Tags  string `xml:"Tags"`
+	Times struct {
+		LastModificationTime string `xml:"LastModificationTime"`
+	} `xml:"Times"`
+	Strings []keePassString `xml:"String"`
+}
+
+// writeKeePassXML writes the KeePass 2 xml, a group per category. The Password and Notes are empty,
+// the client fills them from the EzPwd strings and removes those before saving the KDBX.
+func writeKeePassXML(w io.Writer, vault exportVault) error {
+	metadata, _ := json.Marshal(newExportMetadata(vault))
+
+	file := keePassFile{
+		Meta: keePassMeta{
+			Generator:    "ez-pwd",
+			DatabaseName: vault.Username,
+			CustomData:   []keePassCustomItem{{Key: "ez-pwd", Value: string(metadata)}},
+		},
+	}
+	file.Root.Group = keePassGroup{UUID: keePassUUID("root", 0), Name: "ez-pwd"}
+
+	groupIndexes := make(map[int]int) // category id -> index in the root groups
+	for _, category := range vault.Categories {
+		groupIndexes[category.Id] = len(file.Root.Group.Groups)
+		file.Root.Group.Groups = append(file.Root.Group.Groups, keePassGroup{
+			UUID: keePassUUID("category", category.Id),
+			Name: category.Name,
+		})
+	}
+
+	for _, secret := range vault.Secrets {
+		entry := keePassEntry{
+			UUID: keePassUUID("secret", secret.Id),
+			Tags: strings.Join(secret.Tags, ";"),
+			Strings: []keePassString{
+				{Key: "Title", Value: keePassValue{Value: secret.Description}},
+				{Key: "UserName", Value: keePassValue{Value: secret.Username}},
+				{Key: "Password", Value: keePassValue{ProtectInMemory: "True"}},
+				{Key: "URL", Value: keePassValue{Value: secret.URLSite}},
+				{Key: "Notes"},
+				{Key: keePassPasswordEncryptedKey, Value: keePassValue{Value: string(secret.PasswordEncrypted)}},
+				{Key: keePassSafeNoteEncryptedKey, Value: keePassValue{Value: string(secret.SafeNoteEncrypted)}},
+				{Key: keePassTypeKey, Value: keePassValue{Value: secret.Type}},
+				{Key: keePassTypeDataKey, Value: keePassValue{Value: string(secret.TypeData)}},
+				{Key: keePassCustomFieldsKey, Value: keePassValue{Value: string(secret.CustomFields)}},
+				{Key: keePassTOTPKey, Value: keePassValue{Value: string(secret.TOTP)}},
+			},
+		}
+		entry.Times.LastModificationTime = secret.UpdatedAt.UTC().Format(time.RFC3339)
+
+		groupIndex, ok := groupIndexes[secret.CategoryId]
+		if !ok {
+			file.Root.Group.Entries = append(file.Root.Group.Entries, entry)
+			continue
+		}
+		file.Root.Group.Groups[groupIndex].Entries = append(file.Root.Group.Groups[groupIndex].Entries, entry)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return internalError(err)
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(file); err != nil {
+		logger.Logger.Error("err writing export", zap.Error(err))
+		return internalError(err)
+	}
+	return nil
+}
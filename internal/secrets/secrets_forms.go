@@ -1,9 +1,16 @@
 package secrets
 
 import (
+	"app-ez-pwd/internal/backupcrypt"
+	"app-ez-pwd/internal/importer"
+	"archive/zip"
 	"encoding/json"
+	"errors"
+	"fmt"
 	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/go-ozzo/ozzo-validation/v4/is"
+	"io"
+	"os"
 )
 
 type EncryptedPayloadForm struct {
@@ -19,6 +26,38 @@ func (f EncryptedPayloadForm) Validate() error {
 		validation.Field(&f.IV, validation.When(len(f.Encrypted) > 0, validation.Required)))
 }
 
+const (
+	CustomFieldText   = "text"
+	CustomFieldHidden = "hidden" // shown masked, ex: PIN
+	CustomFieldURL    = "url"
+	CustomFieldTOTP   = "totp"
+)
+
+const maxCustomFields = 50
+
+// CustomFieldForm is a field defined by the user, ex: security questions, the value is encrypted by the client.
+type CustomFieldForm struct {
+	Name           string               `json:"name"`
+	Type           string               `json:"type"`
+	ValueEncrypted EncryptedPayloadForm `json:"valueEncrypted"`
+}
+
+func (f CustomFieldForm) Validate() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Name, validation.Required, validation.Length(1, 100)),
+		validation.Field(&f.Type, validation.Required, validation.In(CustomFieldText, CustomFieldHidden, CustomFieldURL, CustomFieldTOTP)),
+		validation.Field(&f.ValueEncrypted))
+}
+
+// customFieldsValue is the custom_fields_json column, NULL without fields.
+func customFieldsValue(customFields []CustomFieldForm) []byte {
+	if len(customFields) == 0 {
+		return nil
+	}
+	bytesCustomFields, _ := json.Marshal(customFields)
+	return bytesCustomFields
+}
+
 type UserSecretForm struct {
 	CategoryId        int                  `json:"categoryId"`
 	NewCategoryName   string               `json:"newCategoryName"`
@@ -27,6 +66,10 @@ type UserSecretForm struct {
 	PasswordEncrypted EncryptedPayloadForm `json:"passwordEncrypted"`
 	SafeNoteEncrypted EncryptedPayloadForm `json:"safeNoteEncrypted"`
 	URLSite           string               `json:"urlSite"`
+	Type              string               `json:"type"` // login when it's empty
+	TypeData          *TypeDataForm        `json:"typeData"`
+	CustomFields      []CustomFieldForm    `json:"customFields"`
+	TOTP              *TOTPForm            `json:"totp"`
 }
 
 func (f UserSecretForm) ValidateFront() error {
@@ -36,13 +79,18 @@ func (f UserSecretForm) ValidateFront() error {
 		validation.Field(&f.Description, validation.When(f.Description != "", validation.Length(0, 250))),
 		validation.Field(&f.Username, validation.When(f.Username != "", validation.Length(0, 250))),
 		validation.Field(&f.PasswordEncrypted),
-		validation.Field(&f.SafeNoteEncrypted),
-		validation.Field(&f.URLSite, validation.When(f.URLSite != "", is.URL, validation.Length(0, 250))))
+		validation.Field(&f.SafeNoteEncrypted, validation.When(f.Type == ItemSecureNote, requiredPayload)),
+		validation.Field(&f.URLSite, validation.When(f.URLSite != "", is.URL, validation.Length(0, 250))),
+		validation.Field(&f.Type, validation.In(itemTypes...)),
+		validation.Field(&f.TypeData, typeDataRule(f.Type)),
+		validation.Field(&f.CustomFields, validation.Length(0, maxCustomFields)),
+		validation.Field(&f.TOTP))
 }
 
 func (f UserSecretForm) Save(userId int) (int, error) {
 	bytesPasswordEncrypted, _ := json.Marshal(f.PasswordEncrypted)
 	bytesSafeNoteEncrypted, _ := json.Marshal(f.SafeNoteEncrypted)
+	itemType, bytesTypeData := itemTypeValues(f.Type, f.TypeData)
 
 	newSecretId, err := SaveNewUserSecretDB(NewUserSecretModel{
 		UserId:            userId,
@@ -53,6 +101,10 @@ func (f UserSecretForm) Save(userId int) (int, error) {
 		PasswordEncrypted: bytesPasswordEncrypted,
 		SafeNoteEncrypted: bytesSafeNoteEncrypted,
 		URLSite:           f.URLSite,
+		Type:              itemType,
+		TypeData:          bytesTypeData,
+		CustomFields:      customFieldsValue(f.CustomFields),
+		TOTP:              totpValue(f.TOTP),
 	})
 
 	return newSecretId, err
@@ -60,6 +112,7 @@ func (f UserSecretForm) Save(userId int) (int, error) {
 
 type UpdateUserSecretForm struct {
 	Id                int                  `json:"id"`
+	Version           int                  `json:"version"` // the version the client edited
 	CategoryId        int                  `json:"categoryId"`
 	NewCategoryName   string               `json:"newCategoryName"`
 	Description       string               `json:"description"`
@@ -67,27 +120,38 @@ type UpdateUserSecretForm struct {
 	PasswordEncrypted EncryptedPayloadForm `json:"passwordEncrypted"`
 	SafeNoteEncrypted EncryptedPayloadForm `json:"safeNoteEncrypted"`
 	URLSite           string               `json:"urlSite"`
+	Type              string               `json:"type"`
+	TypeData          *TypeDataForm        `json:"typeData"`
+	CustomFields      []CustomFieldForm    `json:"customFields"`
+	TOTP              *TOTPForm            `json:"totp"`
 }
 
 func (f UpdateUserSecretForm) ValidateFront() error {
 	return validation.ValidateStruct(&f,
 		validation.Field(&f.Id, validation.Required),
+		validation.Field(&f.Version, validation.Required),
 		validation.Field(&f.CategoryId, validation.When(f.NewCategoryName == "", validation.Required)),
 		validation.Field(&f.NewCategoryName, validation.When(f.CategoryId == 0, validation.Required, validation.Length(3, 50))),
 		validation.Field(&f.Description, validation.When(f.Description != "", validation.Length(0, 250))),
 		validation.Field(&f.Username, validation.When(f.Username != "", validation.Length(0, 250))),
 		validation.Field(&f.PasswordEncrypted),
-		validation.Field(&f.SafeNoteEncrypted),
-		validation.Field(&f.URLSite, validation.When(f.URLSite != "", is.URL, validation.Length(0, 250))))
+		validation.Field(&f.SafeNoteEncrypted, validation.When(f.Type == ItemSecureNote, requiredPayload)),
+		validation.Field(&f.URLSite, validation.When(f.URLSite != "", is.URL, validation.Length(0, 250))),
+		validation.Field(&f.Type, validation.In(itemTypes...)),
+		validation.Field(&f.TypeData, typeDataRule(f.Type)),
+		validation.Field(&f.CustomFields, validation.Length(0, maxCustomFields)),
+		validation.Field(&f.TOTP))
 }
 
-func (f UpdateUserSecretForm) Update(userId int) error {
+func (f UpdateUserSecretForm) Update(userId int) (int, error) {
 	bytesPasswordEncrypted, _ := json.Marshal(f.PasswordEncrypted)
 	bytesSafeNoteEncrypted, _ := json.Marshal(f.SafeNoteEncrypted)
+	itemType, bytesTypeData := itemTypeValues(f.Type, f.TypeData)
 
-	err := UpdateUserSecretDB(UpdateUserSecretModel{
+	newVersion, err := UpdateUserSecretDB(UpdateUserSecretModel{
 		UserId:            userId,
 		SecretId:          f.Id,
+		Version:           f.Version,
 		CategoryId:        f.CategoryId,
 		NewCategoryName:   f.NewCategoryName,
 		Description:       f.Description,
@@ -95,6 +159,393 @@ func (f UpdateUserSecretForm) Update(userId int) error {
 		PasswordEncrypted: bytesPasswordEncrypted,
 		SafeNoteEncrypted: bytesSafeNoteEncrypted,
 		URLSite:           f.URLSite,
+		Type:              itemType,
+		TypeData:          bytesTypeData,
+		CustomFields:      customFieldsValue(f.CustomFields),
+		TOTP:              totpValue(f.TOTP),
+	})
+	return newVersion, err
+}
+
+// PatchUserSecretForm is the partial update, the omitted fields keep the stored value,
+// ex: the encrypted payloads aren't sent to change the description.
+type PatchUserSecretForm struct {
+	Version           int                   `json:"version"`
+	CategoryId        *int                  `json:"categoryId"`
+	NewCategoryName   *string               `json:"newCategoryName"`
+	Description       *string               `json:"description"`
+	Username          *string               `json:"username"`
+	PasswordEncrypted *EncryptedPayloadForm `json:"passwordEncrypted"`
+	SafeNoteEncrypted *EncryptedPayloadForm `json:"safeNoteEncrypted"`
+	URLSite           *string               `json:"urlSite"`
+	Type              *string               `json:"type"` // with typeData, they replace both
+	TypeData          *TypeDataForm         `json:"typeData"`
+	CustomFields      *[]CustomFieldForm    `json:"customFields"` // the whole list, [] deletes the fields
+	TOTP              *TOTPForm             `json:"totp"`
+	ClearTOTP         bool                  `json:"clearTotp"` // deletes the totp, null can't be told apart from omitted
+}
+
+func (f PatchUserSecretForm) ValidateFront() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Version, validation.Required),
+		validation.Field(&f.CategoryId, validation.NilOrNotEmpty),
+		validation.Field(&f.NewCategoryName, validation.NilOrNotEmpty, validation.Length(3, 50)),
+		validation.Field(&f.Description, validation.Length(0, 250)),
+		validation.Field(&f.Username, validation.Length(0, 250)),
+		validation.Field(&f.PasswordEncrypted),
+		validation.Field(&f.SafeNoteEncrypted),
+		validation.Field(&f.URLSite, validation.When(f.URLSite != nil && *f.URLSite != "", is.URL), validation.Length(0, 250)),
+		validation.Field(&f.Type, validation.When(f.TypeData != nil, validation.NotNil), validation.In(itemTypes...)),
+		validation.Field(&f.TypeData, validation.When(f.Type != nil, typeDataRule(stringValue(f.Type)))),
+		validation.Field(&f.CustomFields, validation.Length(0, maxCustomFields)),
+		validation.Field(&f.TOTP),
+		validation.Field(&f.ClearTOTP, validation.When(f.TOTP != nil, validation.Empty.Error("can't be set with totp"))))
+}
+
+func (f PatchUserSecretForm) Patch(userId, secretId int) (int, error) {
+	patchModel := PatchUserSecretModel{
+		UserId:          userId,
+		SecretId:        secretId,
+		Version:         f.Version,
+		CategoryId:      f.CategoryId,
+		NewCategoryName: f.NewCategoryName,
+		Description:     f.Description,
+		Username:        f.Username,
+		URLSite:         f.URLSite,
+	}
+	if f.PasswordEncrypted != nil {
+		patchModel.PasswordEncrypted, _ = json.Marshal(f.PasswordEncrypted)
+	}
+	if f.SafeNoteEncrypted != nil {
+		patchModel.SafeNoteEncrypted, _ = json.Marshal(f.SafeNoteEncrypted)
+	}
+	if f.Type != nil {
+		itemType, bytesTypeData := itemTypeValues(*f.Type, f.TypeData)
+		patchModel.Type, patchModel.TypeData = &itemType, bytesTypeData
+	}
+	if f.CustomFields != nil {
+		// the empty list is stored as [], nil in the model keeps the fields
+		patchModel.CustomFields, _ = json.Marshal(*f.CustomFields)
+	}
+	patchModel.TOTP, patchModel.ClearTOTP = totpValue(f.TOTP), f.ClearTOTP
+
+	if patchModel.CategoryId == nil && patchModel.NewCategoryName == nil && patchModel.Description == nil &&
+		patchModel.Username == nil && patchModel.URLSite == nil && patchModel.Type == nil && patchModel.CustomFields == nil &&
+		patchModel.TOTP == nil && !patchModel.ClearTOTP &&
+		patchModel.PasswordEncrypted == nil && patchModel.SafeNoteEncrypted == nil {
+		return 0, &Error{Kind: KindValidation, Message: "there are no fields to update"}
+	}
+
+	return PatchUserSecretDB(patchModel)
+}
+
+type BulkUserSecretsForm struct {
+	Action     string   `json:"action"` // move, delete, tag, untag
+	SecretIds  []int    `json:"secretIds"`
+	Versions   []int    `json:"versions"`   // for delete, the version read of every secret in the order of secretIds
+	CategoryId int      `json:"categoryId"` // for move
+	Tags       []string `json:"tags"`       // for tag and untag
+}
+
+func (f BulkUserSecretsForm) ValidateFront() error {
+	withTags := f.Action == BulkTag || f.Action == BulkUntag
+
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Action, validation.Required, validation.In(BulkMove, BulkDelete, BulkTag, BulkUntag)),
+		validation.Field(&f.SecretIds, validation.Required, validation.Length(1, 1000), validation.Each(validation.Required)),
+		validation.Field(&f.Versions, validation.When(f.Action == BulkDelete, validation.Required, validation.By(func(value interface{}) error {
+			if len(f.Versions) != len(f.SecretIds) {
+				return errors.New("must have the version of every secret")
+			}
+			return nil
+		})), validation.Each(validation.Required)),
+		validation.Field(&f.CategoryId, validation.When(f.Action == BulkMove, validation.Required)),
+		validation.Field(&f.Tags, validation.When(withTags, validation.Required, validation.Length(1, 20)),
+			validation.Each(validation.Required, validation.Length(1, 50))))
+}
+
+func (f BulkUserSecretsForm) Apply(userId int) ([]BulkItemResultModel, error) {
+	return BulkUserSecretsDB(BulkUserSecretsModel{
+		UserId:     userId,
+		Action:     f.Action,
+		SecretIds:  f.SecretIds,
+		Versions:   f.Versions,
+		CategoryId: f.CategoryId,
+		Tags:       f.Tags,
 	})
+}
+
+type RestoreBackupForm struct {
+	Mode       string `form:"mode"`       // merge (default) or replace
+	Passphrase string `form:"passphrase"` // for the backup encrypted with passphrase
+	PrivateKey string `form:"privateKey"` // for the backup encrypted with the backup public key
+}
+
+func (f RestoreBackupForm) ValidateFront() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Mode, validation.In(RestoreMerge, RestoreReplace)))
+}
+
+// Restore reads the uploaded backup, the encrypted one is decrypted with the passphrase or private key.
+func (f RestoreBackupForm) Restore(userId int, backupFile io.ReaderAt, size int64) (RestoreResultModel, error) {
+	mode := f.Mode
+	if mode == "" {
+		mode = RestoreMerge
+	}
+
+	prefix := make([]byte, len(backupcrypt.Magic))
+	_, _ = backupFile.ReadAt(prefix, 0)
+
+	var zipReader *zip.Reader
+	var err error
+	if backupcrypt.IsEncrypted(prefix) {
+		identity := backupcrypt.Identity{Passphrase: f.Passphrase}
+		if f.PrivateKey != "" {
+			if identity.PrivateKey, err = backupcrypt.ParseKey(f.PrivateKey); err != nil {
+				return RestoreResultModel{}, FieldError("privateKey", "invalid X25519 private key")
+			}
+		}
+
+		var decryptedFile *os.File
+		var decryptedSize int64
+		decryptedFile, decryptedSize, err = spoolDecryptedBackup(io.NewSectionReader(backupFile, 0, size), identity)
+		if err != nil {
+			return RestoreResultModel{}, err
+		}
+		defer os.Remove(decryptedFile.Name())
+		defer decryptedFile.Close()
+		zipReader, err = zip.NewReader(decryptedFile, decryptedSize)
+	} else {
+		zipReader, err = zip.NewReader(backupFile, size)
+	}
+	if err != nil {
+		return RestoreResultModel{}, FieldError("file", "invalid zip file")
+	}
+
+	return RestoreUserSecretsBackup(userId, mode, zipReader)
+}
+
+// spoolDecryptedBackup decrypts to a temporary file: the zip reader needs random access and the
+// backup can be as big as the upload. The caller removes the file.
+func spoolDecryptedBackup(encrypted io.Reader, identity backupcrypt.Identity) (*os.File, int64, error) {
+	decryptedReader, err := backupcrypt.NewReader(encrypted, identity)
+	if err != nil {
+		return nil, 0, FieldError("passphrase", "wrong passphrase or key, or corrupted backup")
+	}
+
+	tmpFile, err := os.CreateTemp("", "ez-pwd-restore-*")
+	if err != nil {
+		return nil, 0, internalError(err)
+	}
+
+	size, err := io.Copy(tmpFile, decryptedReader)
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		if errors.Is(err, backupcrypt.ErrDecrypt) {
+			return nil, 0, FieldError("passphrase", "wrong passphrase or key, or corrupted backup")
+		}
+		return nil, 0, internalError(err)
+	}
+	return tmpFile, size, nil
+}
+
+const (
+	BackupEncryptionPassphrase = "passphrase"
+	BackupEncryptionPublicKey  = "publicKey"
+)
+
+type BackupExportForm struct {
+	Encryption       string // empty: plain zip
+	Passphrase       string // from the X-Backup-Passphrase header, never in the url
+	ExcludeLoginHash bool
+}
+
+func (f BackupExportForm) ValidateFront() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Encryption, validation.In(BackupEncryptionPassphrase, BackupEncryptionPublicKey)),
+		validation.Field(&f.Passphrase, validation.When(f.Encryption == BackupEncryptionPassphrase,
+			validation.Required, validation.Length(backupcrypt.MinPassphraseLen, 1024))))
+}
+
+// Open prepares the export of the backup, encrypted when Encryption is set.
+func (f BackupExportForm) Open(userId int) (*BackupExport, error) {
+	var publicKey []byte
+	if f.Encryption == BackupEncryptionPublicKey {
+		encodedKey, err := GetBackupPublicKeyDB(userId)
+		if err != nil {
+			return nil, err
+		}
+		if encodedKey == "" {
+			return nil, FieldError("encryption", "there is no backup public key")
+		}
+		publicKey, _ = backupcrypt.ParseKey(encodedKey)
+	}
+
+	export, err := OpenBackupExport(userId, BackupOptions{ExcludeLoginHash: f.ExcludeLoginHash})
+	if err != nil {
+		return nil, err
+	}
+	export.encryption = f.Encryption
+	export.passphrase = f.Passphrase
+	export.publicKey = publicKey
+	return export, nil
+}
+
+type BackupPublicKeyForm struct {
+	PublicKey string `json:"publicKey"` // raw X25519 public key in base64
+}
+
+func (f BackupPublicKeyForm) ValidateFront() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.PublicKey, validation.Required, validation.By(func(value interface{}) error {
+			_, err := backupcrypt.ParseKey(f.PublicKey)
+			return err
+		})))
+}
+
+func (f BackupPublicKeyForm) Save(userId int) error {
+	return SaveBackupPublicKeyDB(userId, f.PublicKey)
+}
+
+// maxImportFileSize limits the uploaded export of the other password manager.
+const maxImportFileSize = 32 << 20
+
+type ImportParseForm struct {
+	Format string `form:"format"` // bitwarden-json, keepass-xml, keepass-csv, 1password-csv, lastpass-csv
+}
+
+func (f ImportParseForm) ValidateFront() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Format, validation.Required, validation.In(importer.Formats...)))
+}
+
+// Parse reads the export into the plaintext items, nothing is saved: the client encrypts them and sends the batch.
+func (f ImportParseForm) Parse(exportFile io.Reader) (importer.Result, error) {
+	result, err := importer.Parse(f.Format, io.LimitReader(exportFile, maxImportFileSize))
+	if errors.Is(err, importer.ErrInvalidFile) {
+		return result, FieldError("file", err.Error())
+	}
+	if err != nil {
+		return result, internalError(err)
+	}
+	return result, nil
+}
+
+// ImportUserSecretForm is an item of the import encrypted by the client, the category is by name.
+type ImportUserSecretForm struct {
+	CategoryName      string               `json:"categoryName"`
+	Description       string               `json:"description"`
+	Username          string               `json:"username"`
+	PasswordEncrypted EncryptedPayloadForm `json:"passwordEncrypted"`
+	SafeNoteEncrypted EncryptedPayloadForm `json:"safeNoteEncrypted"`
+	URLSite           string               `json:"urlSite"`
+	Type              string               `json:"type"`
+	TypeData          *TypeDataForm        `json:"typeData"`
+	CustomFields      []CustomFieldForm    `json:"customFields"`
+	TOTP              *TOTPForm            `json:"totp"`
+	Tags              []string             `json:"tags"`
+}
+
+func (f ImportUserSecretForm) Validate() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.CategoryName, validation.Required, validation.Length(1, 50)),
+		validation.Field(&f.Description, validation.Length(0, 250)),
+		validation.Field(&f.Username, validation.Length(0, 250)),
+		validation.Field(&f.PasswordEncrypted),
+		validation.Field(&f.SafeNoteEncrypted, validation.When(f.Type == ItemSecureNote, requiredPayload)),
+		validation.Field(&f.URLSite, validation.When(f.URLSite != "", is.URL, validation.Length(0, 250))),
+		validation.Field(&f.Type, validation.In(itemTypes...)),
+		validation.Field(&f.TypeData, typeDataRule(f.Type)),
+		validation.Field(&f.CustomFields, validation.Length(0, maxCustomFields)),
+		validation.Field(&f.TOTP),
+		validation.Field(&f.Tags, validation.Length(0, 20), validation.Each(validation.Required, validation.Length(1, 50))))
+}
+
+type ImportUserSecretsForm struct {
+	Items []ImportUserSecretForm `json:"items"`
+}
+
+func (f ImportUserSecretsForm) ValidateFront() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Items, validation.Required, validation.Length(1, MaxImportItems)))
+}
+
+func (f ImportUserSecretsForm) Import(userId int) (ImportResultModel, error) {
+	newUserSecrets := make([]NewUserSecretModel, 0, len(f.Items))
+	for _, item := range f.Items {
+		bytesPasswordEncrypted, _ := json.Marshal(item.PasswordEncrypted)
+		bytesSafeNoteEncrypted, _ := json.Marshal(item.SafeNoteEncrypted)
+		itemType, bytesTypeData := itemTypeValues(item.Type, item.TypeData)
+
+		newUserSecrets = append(newUserSecrets, NewUserSecretModel{
+			UserId:            userId,
+			NewCategoryName:   item.CategoryName,
+			Description:       item.Description,
+			Username:          item.Username,
+			PasswordEncrypted: bytesPasswordEncrypted,
+			SafeNoteEncrypted: bytesSafeNoteEncrypted,
+			URLSite:           item.URLSite,
+			Type:              itemType,
+			TypeData:          bytesTypeData,
+			CustomFields:      customFieldsValue(item.CustomFields),
+			TOTP:              totpValue(item.TOTP),
+			Tags:              item.Tags,
+		})
+	}
+	return ImportUserSecretsDB(userId, newUserSecrets)
+}
+
+type ExportUserSecretsForm struct {
+	Format string
+}
+
+func (f ExportUserSecretsForm) ValidateFront() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Format, validation.Required, validation.In(ExportBitwardenJSON, ExportKeePassXML)))
+}
+
+// AttachmentForm is the multipart form of the upload with the file encrypted by the client,
+// fileNameEncrypted is the EncryptedPayloadForm as json.
+type AttachmentForm struct {
+	FileNameEncrypted string `form:"fileNameEncrypted"`
+}
+
+func (f AttachmentForm) ValidateFront() error {
+	_, err := f.fileName()
 	return err
 }
+
+func (f AttachmentForm) fileName() ([]byte, error) {
+	var fileName EncryptedPayloadForm
+	if err := json.Unmarshal([]byte(f.FileNameEncrypted), &fileName); err != nil {
+		return nil, FieldError("fileNameEncrypted", "must be the encrypted payload as json")
+	}
+	err := validation.Errors{"fileNameEncrypted": validation.Validate(fileName, requiredPayload)}.Filter()
+	if err != nil {
+		return nil, err
+	}
+	bytesFileName, _ := json.Marshal(fileName)
+	return bytesFileName, nil
+}
+
+func (f AttachmentForm) Save(userId, secretId int, content io.Reader, size int64) (AttachmentModel, error) {
+	if maxFileSize := AttachmentMaxFileSize(); size > maxFileSize {
+		return AttachmentModel{}, FieldError("file", fmt.Sprintf("the file is bigger than %d MB", maxFileSize>>20))
+	}
+	if size == 0 {
+		return AttachmentModel{}, FieldError("file", "the file is empty")
+	}
+
+	fileName, err := f.fileName()
+	if err != nil {
+		return AttachmentModel{}, err
+	}
+
+	return SaveAttachmentDB(NewAttachmentModel{
+		UserId:            userId,
+		SecretId:          secretId,
+		FileNameEncrypted: fileName,
+		Size:              size,
+	}, content)
+}
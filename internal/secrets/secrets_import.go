@@ -0,0 +1,71 @@
+package secrets
+
+import (
+	"app-ez-pwd/internal/events"
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/storage"
+	"go.uber.org/zap"
+	"strings"
+)
+
+// MaxImportItems limits the batch of one import, bigger exports are sent in more batches.
+const MaxImportItems = 5000
+
+type ImportResultModel struct {
+	CategoriesCreated int   `json:"categoriesCreated"`
+	SecretsCreated    int   `json:"secretsCreated"`
+	SecretIds         []int `json:"secretIds"` // in the order of the items
+}
+
+// ImportUserSecretsDB inserts the encrypted batch of the import in one transaction, NewCategoryName is the
+// category of every item: the categories of the user with the same name are reused, the others are created.
+func ImportUserSecretsDB(userId int, newUserSecrets []NewUserSecretModel) (ImportResultModel, error) {
+	result := ImportResultModel{SecretIds: make([]int, 0, len(newUserSecrets))}
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return result, internalError(err)
+	}
+
+	userCategories, err := selectCategoriesTx(tx, userId)
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return result, err
+	}
+	categoryIds := make(map[string]int)
+	for _, category := range userCategories {
+		categoryIds[strings.ToUpper(category.Name)] = category.Id
+	}
+
+	for _, newUserSecret := range newUserSecrets {
+		newUserSecret.UserId = userId
+
+		categoryId, ok := categoryIds[strings.ToUpper(newUserSecret.NewCategoryName)]
+		if !ok {
+			if categoryId, err = prepareCategoryTx(tx, userId, 0, newUserSecret.NewCategoryName); err != nil {
+				_ = storage.ApplicationDB.Rollback(cn, tx)
+				return result, err
+			}
+			categoryIds[strings.ToUpper(newUserSecret.NewCategoryName)] = categoryId
+			result.CategoriesCreated++
+		}
+		newUserSecret.CategoryId = categoryId
+
+		secretId, err := insertUserSecretTx(tx, newUserSecret)
+		if err != nil {
+			_ = storage.ApplicationDB.Rollback(cn, tx)
+			return result, err
+		}
+		result.SecretIds = append(result.SecretIds, secretId)
+		result.SecretsCreated++
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		logger.Logger.Error("err commit import", zap.Error(err))
+		return ImportResultModel{}, internalError(err)
+	}
+
+	// many changes: the clients sync instead of fetching every secret
+	events.Hub.Publish(events.Event{Type: events.VaultRestored, UserId: userId})
+	return result, nil
+}
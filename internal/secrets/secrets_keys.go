@@ -0,0 +1,172 @@
+package secrets
+
+import (
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/storage"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	sq "github.com/Masterminds/squirrel"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+	"strings"
+)
+
+// KeyAlgorithmRSAOAEP is the key pair of web crypto: RSA-OAEP with SHA-256, the public key is the SPKI in base64.
+const KeyAlgorithmRSAOAEP = "RSA-OAEP-256"
+
+// UserKeysModel is the key pair of the user to receive shared secrets, the private key is encrypted by the client.
+type UserKeysModel struct {
+	Algorithm           string          `json:"algorithm"`
+	PublicKey           string          `json:"publicKey"`
+	PrivateKeyEncrypted json.RawMessage `json:"privateKeyEncrypted"`
+}
+
+type PublicKeyModel struct {
+	UserId    int    `json:"userId"`
+	Username  string `json:"username"`
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"publicKey"`
+}
+
+// GetUserKeysDB returns the key pair of the user, not found when the user didn't create it yet.
+func GetUserKeysDB(userId int) (UserKeysModel, error) {
+	var userKeys UserKeysModel
+
+	selectKeys, selectKeysArgs, _ := storage.ApplicationDB.Psql.
+		Select("key_algorithm", "public_key", "private_key_json").
+		From("users").
+		Where(sq.Eq{
+			"id": userId,
+		}).
+		Where(sq.NotEq{
+			"public_key": nil,
+		}).ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return userKeys, internalError(err)
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	err = tx.QueryRow(context.Background(), selectKeys, selectKeysArgs...).
+		Scan(&userKeys.Algorithm, &userKeys.PublicKey, &userKeys.PrivateKeyEncrypted)
+	if err == pgx.ErrNoRows {
+		return userKeys, notFoundError("the user doesn't have keys")
+	}
+	if err != nil {
+		logger.Logger.Error("err scan user keys", zap.Error(err))
+		return userKeys, internalError(err)
+	}
+	return userKeys, nil
+}
+
+// SaveUserKeysDB saves the key pair once: the secrets already shared are wrapped with the public key.
+func SaveUserKeysDB(userId int, algorithm, publicKey string, privateKeyEncrypted []byte) error {
+	updateKeys, updateKeysArgs, _ := storage.ApplicationDB.Psql.Update("users").
+		SetMap(map[string]interface{}{
+			"key_algorithm":    algorithm,
+			"public_key":       publicKey,
+			"private_key_json": privateKeyEncrypted,
+		}).
+		Where(sq.Eq{
+			"id":         userId,
+			"public_key": nil,
+		}).ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return internalError(err)
+	}
+
+	result, err := tx.Exec(context.Background(), updateKeys, updateKeysArgs...)
+	if err != nil {
+		logger.Logger.Error("err update user keys", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return internalError(err)
+	}
+	if result.RowsAffected() == 0 {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return &Error{Kind: KindConflict, Message: "the user already has keys"}
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return internalError(err)
+	}
+	return nil
+}
+
+// GetPublicKeyDB returns the public key of other user by username, for the client that wraps a key for them.
+func GetPublicKeyDB(username string) (PublicKeyModel, error) {
+	var publicKey PublicKeyModel
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return publicKey, internalError(err)
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	return selectPublicKeyTx(tx, username)
+}
+
+func selectPublicKeyTx(tx pgx.Tx, username string) (PublicKeyModel, error) {
+	var publicKey PublicKeyModel
+
+	selectKey, selectKeyArgs, _ := storage.ApplicationDB.Psql.
+		Select("id", "username", "key_algorithm", "public_key").
+		From("users").
+		Where(sq.Eq{
+			"UPPER(username)": strings.ToUpper(username),
+		}).
+		Where(sq.NotEq{
+			"public_key": nil,
+		}).ToSql()
+
+	err := tx.QueryRow(context.Background(), selectKey, selectKeyArgs...).
+		Scan(&publicKey.UserId, &publicKey.Username, &publicKey.Algorithm, &publicKey.PublicKey)
+	if err == pgx.ErrNoRows {
+		return publicKey, notFoundError(fmt.Sprintf("the user %s doesn't exist or doesn't have keys", username))
+	}
+	if err != nil {
+		logger.Logger.Error("err scan public key", zap.Error(err))
+		return publicKey, internalError(err)
+	}
+	return publicKey, nil
+}
+
+type UserKeysForm struct {
+	Algorithm           string               `json:"algorithm"` // RSA-OAEP-256 when it's empty
+	PublicKey           string               `json:"publicKey"`
+	PrivateKeyEncrypted EncryptedPayloadForm `json:"privateKeyEncrypted"`
+}
+
+func (f UserKeysForm) ValidateFront() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Algorithm, validation.In(KeyAlgorithmRSAOAEP)),
+		validation.Field(&f.PublicKey, validation.Required, validation.Length(0, 1000), base64Rule),
+		validation.Field(&f.PrivateKeyEncrypted, requiredPayload))
+}
+
+func (f UserKeysForm) Save(userId int) error {
+	algorithm := f.Algorithm
+	if algorithm == "" {
+		algorithm = KeyAlgorithmRSAOAEP
+	}
+	bytesPrivateKey, _ := json.Marshal(f.PrivateKeyEncrypted)
+	return SaveUserKeysDB(userId, algorithm, f.PublicKey, bytesPrivateKey)
+}
+
+// base64Rule checks the standard base64 of the keys, the empty value is checked by Required.
+var base64Rule = validation.By(func(value interface{}) error {
+	rawValue, _ := value.(string)
+	if rawValue == "" {
+		return nil
+	}
+	if _, err := base64.StdEncoding.DecodeString(rawValue); err != nil {
+		return errors.New("must be base64")
+	}
+	return nil
+})
@@ -0,0 +1,735 @@
+package secrets
+
+import (
+	"app-ez-pwd/internal/events"
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/storage"
+	"context"
+	"encoding/json"
+	"fmt"
+	sq "github.com/Masterminds/squirrel"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+	"time"
+)
+
+// The roles of the organization members: owner and admin manage the members and the categories,
+// member writes the secrets and readonly only reads them.
+const (
+	OrgRoleOwner    = "owner"
+	OrgRoleAdmin    = "admin"
+	OrgRoleMember   = "member"
+	OrgRoleReadOnly = "readonly"
+)
+
+var orgRoles = []interface{}{OrgRoleOwner, OrgRoleAdmin, OrgRoleMember, OrgRoleReadOnly}
+
+var orgWriteRoles = []string{OrgRoleOwner, OrgRoleAdmin, OrgRoleMember}
+var orgManageRoles = []string{OrgRoleOwner, OrgRoleAdmin}
+
+// personalOrMemberScope is the filter of the categories and secrets the user reads:
+// the personal ones and the ones of the organizations where the user is member.
+func personalOrMemberScope(userId int) sq.Or {
+	return sq.Or{
+		sq.Eq{"user_id": userId},
+		sq.Expr("organization_id IN (SELECT m.organization_id FROM organization_members m WHERE m.user_id = ?)", userId),
+	}
+}
+
+// OrganizationModel is the organization of the user, the client unwraps WrappedOrgKey with its private key.
+type OrganizationModel struct {
+	Id            int       `json:"id"`
+	Name          string    `json:"name"`
+	Role          string    `json:"role"`
+	WrappedOrgKey string    `json:"wrappedOrgKey"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+type OrganizationMemberModel struct {
+	UserId    int       `json:"userId"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func CreateOrganizationDB(userId int, name, wrappedOrgKey string) (OrganizationModel, error) {
+	organization := OrganizationModel{Name: name, Role: OrgRoleOwner, WrappedOrgKey: wrappedOrgKey}
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return organization, internalError(err)
+	}
+
+	insertOrganization, insertOrganizationArgs, _ := storage.ApplicationDB.Psql.Insert("organizations").
+		SetMap(map[string]interface{}{
+			"name": name,
+		}).Suffix("RETURNING id, created_at").ToSql()
+
+	err = tx.QueryRow(context.Background(), insertOrganization, insertOrganizationArgs...).Scan(&organization.Id, &organization.CreatedAt)
+	if err == nil {
+		err = insertMemberTx(tx, organization.Id, userId, OrgRoleOwner, wrappedOrgKey)
+	}
+	if err != nil {
+		logger.Logger.Error("err insert organization", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return organization, internalError(err)
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return organization, internalError(err)
+	}
+	return organization, nil
+}
+
+func insertMemberTx(tx pgx.Tx, organizationId, userId int, role, wrappedOrgKey string) error {
+	insertMember, insertMemberArgs, _ := storage.ApplicationDB.Psql.Insert("organization_members").
+		SetMap(map[string]interface{}{
+			"organization_id": organizationId,
+			"user_id":         userId,
+			"role":            role,
+			"wrapped_org_key": wrappedOrgKey,
+		}).ToSql()
+
+	_, err := tx.Exec(context.Background(), insertMember, insertMemberArgs...)
+	return err
+}
+
+func ListOrganizationsDB(userId int) ([]OrganizationModel, error) {
+	organizations := make([]OrganizationModel, 0)
+
+	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.
+		Select("o.id", "o.name", "m.role", "m.wrapped_org_key", "o.created_at").
+		From("organizations o").
+		Join("organization_members m ON m.organization_id = o.id").
+		Where(sq.Eq{
+			"m.user_id": userId,
+		}).OrderBy("o.name").ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return organizations, internalError(err)
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	rows, err := tx.Query(context.Background(), selectQry, selectQryArgs...)
+	if err != nil {
+		logger.Logger.Error("err query organizations", zap.Error(err))
+		return organizations, internalError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var organization OrganizationModel
+		err = rows.Scan(&organization.Id, &organization.Name, &organization.Role, &organization.WrappedOrgKey, &organization.CreatedAt)
+		if err != nil {
+			logger.Logger.Error("err scan organization", zap.Error(err))
+			return organizations, internalError(err)
+		}
+		organizations = append(organizations, organization)
+	}
+	return organizations, nil
+}
+
+// memberRoleTx returns the role of the user in the organization, not found when the user isn't member,
+// forbidden when the role isn't in allowedRoles (empty allows every role).
+func memberRoleTx(tx pgx.Tx, userId, organizationId int, allowedRoles ...string) (string, error) {
+	selectRole, selectRoleArgs, _ := storage.ApplicationDB.Psql.
+		Select("role").
+		From("organization_members").
+		Where(sq.Eq{
+			"organization_id": organizationId,
+			"user_id":         userId,
+		}).ToSql()
+
+	var role string
+	err := tx.QueryRow(context.Background(), selectRole, selectRoleArgs...).Scan(&role)
+	if err == pgx.ErrNoRows {
+		return "", notFoundError(fmt.Sprintf("organization %d not found", organizationId))
+	}
+	if err != nil {
+		logger.Logger.Error("err scan member role", zap.Error(err))
+		return "", internalError(err)
+	}
+
+	if len(allowedRoles) == 0 {
+		return role, nil
+	}
+	for _, allowedRole := range allowedRoles {
+		if role == allowedRole {
+			return role, nil
+		}
+	}
+	return role, &Error{Kind: KindForbidden, Message: fmt.Sprintf("the %s role can't do it", role)}
+}
+
+// canManageRole: the owner manages every role, the admin only members and readonly.
+func canManageRole(actorRole, targetRole string) bool {
+	if actorRole == OrgRoleOwner {
+		return true
+	}
+	return actorRole == OrgRoleAdmin && (targetRole == OrgRoleMember || targetRole == OrgRoleReadOnly)
+}
+
+func organizationMemberIdsTx(tx pgx.Tx, organizationId int) ([]int, error) {
+	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.
+		Select("user_id").
+		From("organization_members").
+		Where(sq.Eq{
+			"organization_id": organizationId,
+		}).ToSql()
+
+	rows, err := tx.Query(context.Background(), selectQry, selectQryArgs...)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	defer rows.Close()
+
+	memberIds := make([]int, 0)
+	for rows.Next() {
+		var memberId int
+		if err = rows.Scan(&memberId); err != nil {
+			return nil, internalError(err)
+		}
+		memberIds = append(memberIds, memberId)
+	}
+	return memberIds, nil
+}
+
+// publishToMembers sends the event of the organization to every member.
+func publishToMembers(memberIds []int, event events.Event) {
+	for _, memberId := range memberIds {
+		event.UserId = memberId
+		events.Hub.Publish(event)
+	}
+}
+
+func ListOrganizationMembersDB(userId, organizationId int) ([]OrganizationMemberModel, error) {
+	members := make([]OrganizationMemberModel, 0)
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return members, internalError(err)
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	if _, err = memberRoleTx(tx, userId, organizationId); err != nil {
+		return members, err
+	}
+
+	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.
+		Select("u.id", "u.username", "m.role", "m.created_at").
+		From("organization_members m").
+		Join("users u ON u.id = m.user_id").
+		Where(sq.Eq{
+			"m.organization_id": organizationId,
+		}).OrderBy("u.username").ToSql()
+
+	rows, err := tx.Query(context.Background(), selectQry, selectQryArgs...)
+	if err != nil {
+		logger.Logger.Error("err query members", zap.Error(err))
+		return members, internalError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var member OrganizationMemberModel
+		if err = rows.Scan(&member.UserId, &member.Username, &member.Role, &member.CreatedAt); err != nil {
+			logger.Logger.Error("err scan member", zap.Error(err))
+			return members, internalError(err)
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// AddOrganizationMemberDB adds the user with the org key wrapped by the client with the user public key.
+func AddOrganizationMemberDB(userId, organizationId int, username, role, wrappedOrgKey string) (OrganizationMemberModel, error) {
+	member := OrganizationMemberModel{Role: role}
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return member, internalError(err)
+	}
+
+	actorRole, err := memberRoleTx(tx, userId, organizationId, orgManageRoles...)
+	if err == nil && !canManageRole(actorRole, role) {
+		err = &Error{Kind: KindForbidden, Message: fmt.Sprintf("the %s role can't add a %s", actorRole, role)}
+	}
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return member, err
+	}
+
+	publicKey, err := selectPublicKeyTx(tx, username)
+	if KindOf(err) == KindNotFound {
+		err = FieldError("username", "the user doesn't exist or doesn't have keys")
+	}
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return member, err
+	}
+	member.UserId, member.Username = publicKey.UserId, publicKey.Username
+
+	if _, err = memberRoleTx(tx, member.UserId, organizationId); err == nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return member, FieldError("username", "the user is already a member")
+	}
+
+	if err = insertMemberTx(tx, organizationId, member.UserId, role, wrappedOrgKey); err != nil {
+		logger.Logger.Error("err insert member", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return member, internalError(err)
+	}
+
+	// the secrets of the organization are older than the sync token of the new member
+	if err = insertTombstoneTx(tx, member.UserId, tombstoneFullSync, organizationId); err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return member, err
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return member, internalError(err)
+	}
+	member.CreatedAt = time.Now()
+
+	events.Hub.Publish(events.Event{Type: events.OrganizationChanged, UserId: member.UserId, EntityId: organizationId})
+	return member, nil
+}
+
+// ChangeOrganizationMemberDB changes the role of the member, or removes the member when role is empty.
+// The members can leave the organization, the last owner can't.
+func ChangeOrganizationMemberDB(userId, organizationId, memberId int, role string) error {
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return internalError(err)
+	}
+
+	err = changeMemberTx(tx, userId, organizationId, memberId, role)
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return err
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return internalError(err)
+	}
+
+	events.Hub.Publish(events.Event{Type: events.OrganizationChanged, UserId: memberId, EntityId: organizationId})
+	return nil
+}
+
+// changeMemberTx locks the organization row first: the concurrent changes of the members wait,
+// so two owners can't remove each other and leave the organization without owner.
+func changeMemberTx(tx pgx.Tx, userId, organizationId, memberId int, role string) error {
+	lockOrganization, lockOrganizationArgs, _ := storage.ApplicationDB.Psql.
+		Select("id").
+		From("organizations").
+		Where(sq.Eq{
+			"id": organizationId,
+		}).Suffix("FOR UPDATE").ToSql()
+
+	var lockedId int
+	err := tx.QueryRow(context.Background(), lockOrganization, lockOrganizationArgs...).Scan(&lockedId)
+	if err == pgx.ErrNoRows {
+		return notFoundError(fmt.Sprintf("organization %d not found", organizationId))
+	}
+	if err != nil {
+		logger.Logger.Error("err lock organization", zap.Error(err))
+		return internalError(err)
+	}
+
+	actorRole, err := memberRoleTx(tx, userId, organizationId)
+	if err != nil {
+		return err
+	}
+	memberRole, err := memberRoleTx(tx, memberId, organizationId)
+	if KindOf(err) == KindNotFound {
+		return notFoundError(fmt.Sprintf("member %d not found", memberId))
+	}
+	if err != nil {
+		return err
+	}
+
+	leaving := role == "" && memberId == userId
+	if !leaving && (!canManageRole(actorRole, memberRole) || (role != "" && !canManageRole(actorRole, role))) {
+		return &Error{Kind: KindForbidden, Message: fmt.Sprintf("the %s role can't change a %s", actorRole, memberRole)}
+	}
+
+	if memberRole == OrgRoleOwner && role != OrgRoleOwner {
+		selectOwners, selectOwnersArgs, _ := storage.ApplicationDB.Psql.
+			Select("COUNT(*)").
+			From("organization_members").
+			Where(sq.Eq{
+				"organization_id": organizationId,
+				"role":            OrgRoleOwner,
+			}).ToSql()
+
+		var owners int
+		if err = tx.QueryRow(context.Background(), selectOwners, selectOwnersArgs...).Scan(&owners); err != nil {
+			return internalError(err)
+		}
+		if owners <= 1 {
+			return &Error{Kind: KindConflict, Message: "the organization must have an owner"}
+		}
+	}
+
+	memberFilter := sq.Eq{
+		"organization_id": organizationId,
+		"user_id":         memberId,
+	}
+	var changeQry string
+	var changeQryArgs []interface{}
+	if role == "" {
+		changeQry, changeQryArgs, _ = storage.ApplicationDB.Psql.Delete("organization_members").Where(memberFilter).ToSql()
+	} else {
+		changeQry, changeQryArgs, _ = storage.ApplicationDB.Psql.Update("organization_members").
+			Set("role", role).Where(memberFilter).ToSql()
+	}
+
+	if _, err = tx.Exec(context.Background(), changeQry, changeQryArgs...); err != nil {
+		logger.Logger.Error("err change member", zap.Error(err))
+		return internalError(err)
+	}
+
+	if role == "" {
+		// the removed member doesn't get the tombstones of the organization anymore
+		return insertTombstoneTx(tx, memberId, tombstoneFullSync, organizationId)
+	}
+	return nil
+}
+
+func CreateOrganizationCategoryDB(userId, organizationId int, name string) (ListCategoryModel, error) {
+	category := ListCategoryModel{Name: name, OrganizationId: &organizationId}
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return category, internalError(err)
+	}
+
+	if _, err = memberRoleTx(tx, userId, organizationId, orgManageRoles...); err == nil {
+		category.Id, err = prepareOrganizationCategoryTx(tx, organizationId, 0, name)
+	}
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return category, err
+	}
+
+	memberIds, err := organizationMemberIdsTx(tx, organizationId)
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return category, err
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return category, internalError(err)
+	}
+
+	publishToMembers(memberIds, events.Event{Type: events.CategoryCreated, EntityId: category.Id})
+	return category, nil
+}
+
+// prepareOrganizationCategoryTx is prepareCategoryTx for the categories of the organization.
+func prepareOrganizationCategoryTx(tx pgx.Tx, organizationId, categoryId int, newCategoryName string) (int, error) {
+	if categoryId == 0 {
+		insertNewCategory, insertNewCategoryArgs, _ := storage.ApplicationDB.Psql.Insert("secret_categories").
+			SetMap(map[string]interface{}{
+				"name":            newCategoryName,
+				"organization_id": organizationId,
+			}).Suffix("RETURNING id").ToSql()
+
+		err := tx.QueryRow(context.Background(), insertNewCategory, insertNewCategoryArgs...).Scan(&categoryId)
+		if err != nil {
+			logger.Logger.Error("err insert organization category", zap.Error(err))
+			return 0, internalError(err)
+		}
+		return categoryId, nil
+	}
+
+	selectCategory, selectCategoryArgs, _ := storage.ApplicationDB.Psql.
+		Select("id").
+		From("secret_categories").
+		Where(sq.Eq{
+			"id":              categoryId,
+			"organization_id": organizationId,
+		}).ToSql()
+
+	err := tx.QueryRow(context.Background(), selectCategory, selectCategoryArgs...).Scan(&categoryId)
+	if err == pgx.ErrNoRows {
+		return 0, FieldError("categoryId", "category does not exists")
+	}
+	if err != nil {
+		logger.Logger.Error("err select category", zap.Error(err))
+		return 0, internalError(err)
+	}
+	return categoryId, nil
+}
+
+func GetOrganizationSecretDB(userId, organizationId, secretId int) (UserSecretModel, error) {
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return UserSecretModel{}, internalError(err)
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	if _, err = memberRoleTx(tx, userId, organizationId); err != nil {
+		return UserSecretModel{}, err
+	}
+	return selectSecretTx(tx, sq.Eq{"organization_id": organizationId}, secretId)
+}
+
+// SaveOrganizationSecretDB inserts the secret encrypted with the org key, UserId is the member that writes it.
+func SaveOrganizationSecretDB(newSecret NewUserSecretModel) (int, error) {
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return 0, internalError(err)
+	}
+
+	newSecretId, memberIds, err := saveOrganizationSecretTx(tx, newSecret)
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return 0, err
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return 0, internalError(err)
+	}
+
+	publishToMembers(memberIds, events.Event{Type: events.SecretCreated, EntityId: newSecretId, Version: 1})
+	return newSecretId, nil
+}
+
+func saveOrganizationSecretTx(tx pgx.Tx, newSecret NewUserSecretModel) (int, []int, error) {
+	if _, err := memberRoleTx(tx, newSecret.UserId, newSecret.OrganizationId, orgWriteRoles...); err != nil {
+		return 0, nil, err
+	}
+
+	var err error
+	newSecret.CategoryId, err = prepareOrganizationCategoryTx(tx, newSecret.OrganizationId, newSecret.CategoryId, newSecret.NewCategoryName)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	newSecretId, err := insertUserSecretTx(tx, newSecret)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	memberIds, err := organizationMemberIdsTx(tx, newSecret.OrganizationId)
+	return newSecretId, memberIds, err
+}
+
+// UpdateOrganizationSecretDB is UpdateUserSecretDB for the secret of the organization, UserId is the member.
+func UpdateOrganizationSecretDB(organizationId int, userSecretModel UpdateUserSecretModel) (int, error) {
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return 0, internalError(err)
+	}
+
+	newVersion, memberIds, err := updateOrganizationSecretTx(tx, organizationId, userSecretModel)
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return 0, err
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return 0, internalError(err)
+	}
+
+	publishToMembers(memberIds, events.Event{Type: events.SecretUpdated, EntityId: userSecretModel.SecretId, Version: newVersion})
+	return newVersion, nil
+}
+
+func updateOrganizationSecretTx(tx pgx.Tx, organizationId int, userSecretModel UpdateUserSecretModel) (int, []int, error) {
+	if _, err := memberRoleTx(tx, userSecretModel.UserId, organizationId, orgWriteRoles...); err != nil {
+		return 0, nil, err
+	}
+
+	categoryId, err := prepareOrganizationCategoryTx(tx, organizationId, userSecretModel.CategoryId, userSecretModel.NewCategoryName)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	updateSecret, updateSecretArgs, _ := storage.ApplicationDB.Psql.Update("user_secrets").
+		SetMap(touchedColumns(map[string]interface{}{
+			"description":        userSecretModel.Description,
+			"username":           userSecretModel.Username,
+			"password_json":      userSecretModel.PasswordEncrypted,
+			"safe_note_json":     userSecretModel.SafeNoteEncrypted,
+			"url_site":           userSecretModel.URLSite,
+			"item_type":          userSecretModel.Type,
+			"type_data_json":     userSecretModel.TypeData,
+			"custom_fields_json": userSecretModel.CustomFields,
+			"totp_json":          userSecretModel.TOTP,
+			"category_id":        categoryId,
+		})).
+		Where(sq.Eq{
+			"id":              userSecretModel.SecretId,
+			"organization_id": organizationId,
+			"version":         userSecretModel.Version,
+		}).Suffix("RETURNING version").ToSql()
+
+	var newVersion int
+	err = tx.QueryRow(context.Background(), updateSecret, updateSecretArgs...).Scan(&newVersion)
+	if err == pgx.ErrNoRows {
+		return 0, nil, organizationConflictTx(tx, organizationId, userSecretModel.SecretId)
+	}
+	if err != nil {
+		logger.Logger.Error("err updating organization secret", zap.Error(err))
+		return 0, nil, internalError(err)
+	}
+
+	memberIds, err := organizationMemberIdsTx(tx, organizationId)
+	return newVersion, memberIds, err
+}
+
+func DeleteOrganizationSecretDB(userId, organizationId, secretId, version int) error {
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return internalError(err)
+	}
+
+	memberIds, err := deleteOrganizationSecretTx(tx, userId, organizationId, secretId, version)
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return err
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return internalError(err)
+	}
+
+	publishToMembers(memberIds, events.Event{Type: events.SecretDeleted, EntityId: secretId})
+	return nil
+}
+
+func deleteOrganizationSecretTx(tx pgx.Tx, userId, organizationId, secretId, version int) ([]int, error) {
+	if _, err := memberRoleTx(tx, userId, organizationId, orgWriteRoles...); err != nil {
+		return nil, err
+	}
+
+	deleteQry, deleteArgs, _ := storage.ApplicationDB.Psql.Delete("user_secrets").Where(sq.Eq{
+		"organization_id": organizationId,
+		"id":              secretId,
+		"version":         version,
+	}).ToSql()
+
+	result, err := tx.Exec(context.Background(), deleteQry, deleteArgs...)
+	if err != nil {
+		logger.Logger.Error("err deleting organization secret", zap.Error(err))
+		return nil, internalError(err)
+	}
+	if result.RowsAffected() == 0 {
+		return nil, organizationConflictTx(tx, organizationId, secretId)
+	}
+
+	if err = insertOrganizationTombstoneTx(tx, organizationId, tombstoneSecret, secretId); err != nil {
+		return nil, err
+	}
+	return organizationMemberIdsTx(tx, organizationId)
+}
+
+// organizationConflictTx is versionConflictTx for the secrets of the organization.
+func organizationConflictTx(tx pgx.Tx, organizationId, secretId int) error {
+	current, err := selectSecretTx(tx, sq.Eq{"organization_id": organizationId}, secretId)
+	if err != nil {
+		return err
+	}
+	return conflictError(current)
+}
+
+type OrganizationForm struct {
+	Name          string `json:"name"`
+	WrappedOrgKey string `json:"wrappedOrgKey"` // the org key generated by the client, wrapped with the user public key
+}
+
+func (f OrganizationForm) ValidateFront() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Name, validation.Required, validation.Length(3, 100)),
+		validation.Field(&f.WrappedOrgKey, validation.Required, validation.Length(0, 2000), base64Rule))
+}
+
+func (f OrganizationForm) Save(userId int) (OrganizationModel, error) {
+	return CreateOrganizationDB(userId, f.Name, f.WrappedOrgKey)
+}
+
+type OrganizationMemberForm struct {
+	Username      string `json:"username"`
+	Role          string `json:"role"`
+	WrappedOrgKey string `json:"wrappedOrgKey"` // the org key wrapped with the public key of the new member
+}
+
+func (f OrganizationMemberForm) ValidateFront() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Username, validation.Required, validation.Length(3, 50)),
+		validation.Field(&f.Role, validation.Required, validation.In(orgRoles...)),
+		validation.Field(&f.WrappedOrgKey, validation.Required, validation.Length(0, 2000), base64Rule))
+}
+
+func (f OrganizationMemberForm) Save(userId, organizationId int) (OrganizationMemberModel, error) {
+	return AddOrganizationMemberDB(userId, organizationId, f.Username, f.Role, f.WrappedOrgKey)
+}
+
+type OrganizationMemberRoleForm struct {
+	Role string `json:"role"`
+}
+
+func (f OrganizationMemberRoleForm) ValidateFront() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Role, validation.Required, validation.In(orgRoles...)))
+}
+
+type OrganizationCategoryForm struct {
+	Name string `json:"name"`
+}
+
+func (f OrganizationCategoryForm) ValidateFront() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Name, validation.Required, validation.Length(3, 50)))
+}
+
+// SaveOrganization saves the secret in the organization, the payloads are encrypted with the org key.
+func (f UserSecretForm) SaveOrganization(userId, organizationId int) (int, error) {
+	bytesPasswordEncrypted, _ := json.Marshal(f.PasswordEncrypted)
+	bytesSafeNoteEncrypted, _ := json.Marshal(f.SafeNoteEncrypted)
+	itemType, bytesTypeData := itemTypeValues(f.Type, f.TypeData)
+
+	return SaveOrganizationSecretDB(NewUserSecretModel{
+		UserId:            userId,
+		OrganizationId:    organizationId,
+		CategoryId:        f.CategoryId,
+		NewCategoryName:   f.NewCategoryName,
+		Description:       f.Description,
+		Username:          f.Username,
+		PasswordEncrypted: bytesPasswordEncrypted,
+		SafeNoteEncrypted: bytesSafeNoteEncrypted,
+		URLSite:           f.URLSite,
+		Type:              itemType,
+		TypeData:          bytesTypeData,
+		CustomFields:      customFieldsValue(f.CustomFields),
+		TOTP:              totpValue(f.TOTP),
+	})
+}
+
+func (f UpdateUserSecretForm) UpdateOrganization(userId, organizationId int) (int, error) {
+	bytesPasswordEncrypted, _ := json.Marshal(f.PasswordEncrypted)
+	bytesSafeNoteEncrypted, _ := json.Marshal(f.SafeNoteEncrypted)
+	itemType, bytesTypeData := itemTypeValues(f.Type, f.TypeData)
+
+	return UpdateOrganizationSecretDB(organizationId, UpdateUserSecretModel{
+		UserId:            userId,
+		SecretId:          f.Id,
+		Version:           f.Version,
+		CategoryId:        f.CategoryId,
+		NewCategoryName:   f.NewCategoryName,
+		Description:       f.Description,
+		Username:          f.Username,
+		PasswordEncrypted: bytesPasswordEncrypted,
+		SafeNoteEncrypted: bytesSafeNoteEncrypted,
+		URLSite:           f.URLSite,
+		Type:              itemType,
+		TypeData:          bytesTypeData,
+		CustomFields:      customFieldsValue(f.CustomFields),
+		TOTP:              totpValue(f.TOTP),
+	})
+}
@@ -0,0 +1,823 @@
+package secrets
+
+import (
+	"app-ez-pwd/internal/events"
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/storage"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	sq "github.com/Masterminds/squirrel"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+const (
+	RestoreMerge   = "merge"   // keeps the vault, categories with the same name are reused
+	RestoreReplace = "replace" // deletes the vault before the restore
+)
+
+// maxBackupFileSize limits every file read from the uploaded zip.
+const maxBackupFileSize = 64 << 20
+
+type backupCategory struct {
+	Id   int
+	Name string
+}
+
+type backupSecret struct {
+	Id           int
+	CategoryId   int
+	Description  string
+	Username     string
+	PasswordJSON *string
+	SafeNoteJSON *string
+	URLSite      string
+	ItemType     string
+	TypeDataJSON *string
+	CustomFields *string
+	TOTPJSON     *string
+	CreatedAt    *string // as written by postgres, it's cast to timestamptz
+	Tags         []string
+}
+
+type backupAttachment struct {
+	Id           int
+	SecretId     int
+	FileNameJSON string
+	Size         int64
+	SHA256       string
+	CreatedAt    *string
+	Content      *zip.File // nil when the backup doesn't have the content
+}
+
+// backupArchive is the content of a backup zip, the ids are the ones of the exported database.
+type backupArchive struct {
+	UserId      int
+	Username    string
+	Categories  []backupCategory
+	Secrets     []backupSecret
+	Attachments []backupAttachment
+}
+
+type RestoreResultModel struct {
+	CategoriesCreated  int `json:"categoriesCreated"`
+	CategoriesMerged   int `json:"categoriesMerged"`
+	SecretsCreated     int `json:"secretsCreated"`
+	SecretsSkipped     int `json:"secretsSkipped"` // merge mode: the secret already exists
+	AttachmentsCreated int `json:"attachmentsCreated"`
+	// without content in the backup, the attachments are disabled or the secret was skipped
+	AttachmentsSkipped int `json:"attachmentsSkipped"`
+}
+
+func invalidBackupError(format string, args ...interface{}) *Error {
+	return &Error{Kind: KindValidation, Message: "invalid backup: " + fmt.Sprintf(format, args...)}
+}
+
+// RestoreUserSecretsBackup restores the zip produced by the backup export in one transaction,
+// the backup must be of the same user and the ids are remapped to new rows.
+func RestoreUserSecretsBackup(userId int, mode string, zipReader *zip.Reader) (RestoreResultModel, error) {
+	var result RestoreResultModel
+
+	archive, err := readBackupArchive(zipReader)
+	if err != nil {
+		return result, err
+	}
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return result, internalError(err)
+	}
+
+	// the replace deletes the secrets of the user with their shares (deleteVaultTx)
+	shareEvents := make([]events.Event, 0)
+	if mode == RestoreReplace {
+		shareEvents, err = revokeSharesTx(tx, sq.Eq{"owner_id": userId})
+	}
+	var secretIds map[int]int
+	if err == nil {
+		result, secretIds, err = restoreArchiveTx(tx, userId, mode, archive)
+	}
+	uploadedKeys := make([]string, 0)
+	if err == nil {
+		uploadedKeys, err = restoreAttachmentsTx(tx, userId, archive, secretIds, &result)
+	}
+	if err != nil {
+		if KindOf(err) == KindInternal {
+			logger.Logger.Error("err restoring backup", zap.Error(err))
+		}
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		removeAttachmentBlobs(uploadedKeys)
+		return result, err
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		removeAttachmentBlobs(uploadedKeys)
+		return result, internalError(err)
+	}
+
+	if mode == RestoreReplace {
+		RemoveOrphanAttachments(userId)
+	}
+	events.Hub.Publish(events.Event{Type: events.VaultRestored, UserId: userId})
+	for _, event := range shareEvents {
+		events.Hub.Publish(event)
+	}
+	return result, nil
+}
+
+// restoreArchiveTx restores the categories and secrets, it returns the restored secret id by the backup id.
+func restoreArchiveTx(tx pgx.Tx, userId int, mode string, archive backupArchive) (RestoreResultModel, map[int]int, error) {
+	var result RestoreResultModel
+	secretIds := make(map[int]int) // backup id -> restored id
+
+	selectUsername, selectUsernameArgs, _ := storage.ApplicationDB.Psql.
+		Select("username").
+		From("users").
+		Where(sq.Eq{
+			"id": userId,
+		}).ToSql()
+
+	var username string
+	if err := tx.QueryRow(context.Background(), selectUsername, selectUsernameArgs...).Scan(&username); err != nil {
+		return result, nil, internalError(err)
+	}
+	// the usernames aren't unique: the id must be the one of the user too
+	if archive.UserId != userId || !strings.EqualFold(username, archive.Username) {
+		return result, nil, invalidBackupError("it belongs to other user")
+	}
+
+	if mode == RestoreReplace {
+		if err := deleteVaultTx(tx, userId); err != nil {
+			return result, nil, err
+		}
+	}
+
+	existingCategories := make(map[string]int)
+	if mode == RestoreMerge {
+		userCategories, err := selectCategoriesTx(tx, userId)
+		if err != nil {
+			return result, nil, err
+		}
+		for _, category := range userCategories {
+			existingCategories[strings.ToUpper(category.Name)] = category.Id
+		}
+	}
+
+	categoryIds := make(map[int]int) // backup id -> restored id
+	for _, category := range archive.Categories {
+		if categoryId, ok := existingCategories[strings.ToUpper(category.Name)]; ok {
+			categoryIds[category.Id] = categoryId
+			result.CategoriesMerged++
+			continue
+		}
+
+		insertCategory, insertCategoryArgs, _ := storage.ApplicationDB.Psql.Insert("secret_categories").
+			SetMap(map[string]interface{}{
+				"name":    category.Name,
+				"user_id": userId,
+			}).Suffix("RETURNING id").ToSql()
+
+		var categoryId int
+		if err := tx.QueryRow(context.Background(), insertCategory, insertCategoryArgs...).Scan(&categoryId); err != nil {
+			return result, nil, internalError(err)
+		}
+		categoryIds[category.Id] = categoryId
+		existingCategories[strings.ToUpper(category.Name)] = categoryId
+		result.CategoriesCreated++
+	}
+
+	for _, secret := range archive.Secrets {
+		categoryId := categoryIds[secret.CategoryId]
+
+		if mode == RestoreMerge {
+			exists, err := existsSameSecretTx(tx, userId, categoryId, secret)
+			if err != nil {
+				return result, nil, err
+			}
+			if exists {
+				result.SecretsSkipped++
+				continue
+			}
+		}
+
+		secretColumns := map[string]interface{}{
+			"description":        secret.Description,
+			"username":           secret.Username,
+			"password_json":      jsonbValue(secret.PasswordJSON),
+			"safe_note_json":     jsonbValue(secret.SafeNoteJSON),
+			"url_site":           secret.URLSite,
+			"item_type":          secret.ItemType,
+			"type_data_json":     jsonbValue(secret.TypeDataJSON),
+			"custom_fields_json": jsonbValue(secret.CustomFields),
+			"totp_json":          jsonbValue(secret.TOTPJSON),
+			"category_id":        categoryId,
+			"user_id":            userId,
+		}
+		if secret.CreatedAt != nil {
+			secretColumns["created_at"] = sq.Expr("?::timestamptz", *secret.CreatedAt)
+		}
+
+		insertSecret, insertSecretArgs, _ := storage.ApplicationDB.Psql.Insert("user_secrets").
+			SetMap(secretColumns).Suffix("RETURNING id").ToSql()
+
+		var secretId int
+		if err := tx.QueryRow(context.Background(), insertSecret, insertSecretArgs...).Scan(&secretId); err != nil {
+			return result, nil, internalError(err)
+		}
+
+		if len(secret.Tags) > 0 {
+			insertTags := storage.ApplicationDB.Psql.Insert("user_secret_tags").Columns("secret_id", "name")
+			for _, tag := range secret.Tags {
+				insertTags = insertTags.Values(secretId, tag)
+			}
+			insertTagsQry, insertTagsArgs, _ := insertTags.Suffix("ON CONFLICT DO NOTHING").ToSql()
+
+			if _, err := tx.Exec(context.Background(), insertTagsQry, insertTagsArgs...); err != nil {
+				return result, nil, internalError(err)
+			}
+		}
+		secretIds[secret.Id] = secretId
+		result.SecretsCreated++
+	}
+
+	return result, secretIds, nil
+}
+
+// restoreAttachmentsTx uploads the content of the attachments of the restored secrets and inserts their rows,
+// it returns the uploaded keys so the caller deletes them when the transaction isn't committed.
+func restoreAttachmentsTx(tx pgx.Tx, userId int, archive backupArchive, secretIds map[int]int, result *RestoreResultModel) ([]string, error) {
+	uploadedKeys := make([]string, 0)
+	if len(archive.Attachments) == 0 {
+		return uploadedKeys, nil
+	}
+
+	for _, backupAttachment := range archive.Attachments {
+		secretId, restored := secretIds[backupAttachment.SecretId]
+		if !restored || backupAttachment.Content == nil || AttachmentStore == nil {
+			result.AttachmentsSkipped++
+			continue
+		}
+
+		objectKey, err := newAttachmentKey(userId)
+		if err != nil {
+			return uploadedKeys, internalError(err)
+		}
+
+		content, err := backupAttachment.Content.Open()
+		if err != nil {
+			return uploadedKeys, invalidBackupError("%s: %v", backupAttachment.Content.Name, err)
+		}
+		hasher := sha256.New()
+		err = AttachmentStore.Put(context.Background(), objectKey, io.TeeReader(content, hasher), backupAttachment.Size)
+		_ = content.Close()
+		if err != nil {
+			logger.Logger.Error("err put attachment", zap.Error(err))
+			return uploadedKeys, internalError(err)
+		}
+		uploadedKeys = append(uploadedKeys, objectKey)
+
+		if !strings.EqualFold(hex.EncodeToString(hasher.Sum(nil)), backupAttachment.SHA256) {
+			return uploadedKeys, invalidBackupError("%s: the SHA-256 doesn't match", backupAttachment.Content.Name)
+		}
+
+		attachmentColumns := map[string]interface{}{
+			"secret_id":      secretId,
+			"user_id":        userId,
+			"file_name_json": backupAttachment.FileNameJSON,
+			"size":           backupAttachment.Size,
+			"sha256":         strings.ToLower(backupAttachment.SHA256),
+			"object_key":     objectKey,
+		}
+		if backupAttachment.CreatedAt != nil {
+			attachmentColumns["created_at"] = sq.Expr("?::timestamptz", *backupAttachment.CreatedAt)
+		}
+
+		insertAttachment, insertAttachmentArgs, _ := storage.ApplicationDB.Psql.Insert("secret_attachments").
+			SetMap(attachmentColumns).ToSql()
+
+		if _, err = tx.Exec(context.Background(), insertAttachment, insertAttachmentArgs...); err != nil {
+			return uploadedKeys, internalError(err)
+		}
+		result.AttachmentsCreated++
+	}
+
+	if result.AttachmentsCreated > 0 {
+		return uploadedKeys, checkAttachmentsQuotaTx(tx, userId)
+	}
+	return uploadedKeys, nil
+}
+
+// deleteVaultTx deletes the secrets and categories of the user, the clients get the tombstones in the next sync.
+// The shares are revoked before by RestoreUserSecretsBackup.
+func deleteVaultTx(tx pgx.Tx, userId int) error {
+	for _, vaultTable := range []struct {
+		table  string
+		entity string
+	}{
+		{"user_secrets", tombstoneSecret},
+		{"secret_categories", tombstoneCategory},
+	} {
+		insertTombstones, insertTombstonesArgs, _ := storage.ApplicationDB.Psql.Insert("sync_tombstones").
+			Columns("entity", "entity_id", "user_id").
+			Select(sq.Select().
+				Column("?::VARCHAR", vaultTable.entity).
+				Columns("id", "user_id").
+				From(vaultTable.table).
+				Where(sq.Eq{"user_id": userId})).ToSql()
+
+		if _, err := tx.Exec(context.Background(), insertTombstones, insertTombstonesArgs...); err != nil {
+			return internalError(err)
+		}
+
+		deleteRows, deleteRowsArgs, _ := storage.ApplicationDB.Psql.Delete(vaultTable.table).
+			Where(sq.Eq{"user_id": userId}).ToSql()
+
+		if _, err := tx.Exec(context.Background(), deleteRows, deleteRowsArgs...); err != nil {
+			return internalError(err)
+		}
+	}
+	return nil
+}
+
+func selectCategoriesTx(tx pgx.Tx, userId int) ([]ListCategoryModel, error) {
+	itemsCategory := make([]ListCategoryModel, 0)
+
+	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.
+		Select("id", "name").
+		From("secret_categories").
+		Where(sq.Eq{
+			"user_id": userId,
+		}).ToSql()
+
+	rows, err := tx.Query(context.Background(), selectQry, selectQryArgs...)
+	if err != nil {
+		return itemsCategory, internalError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item ListCategoryModel
+		if err = rows.Scan(&item.Id, &item.Name); err != nil {
+			return itemsCategory, internalError(err)
+		}
+		itemsCategory = append(itemsCategory, item)
+	}
+	return itemsCategory, nil
+}
+
+// existsSameSecretTx is for the merge: restoring the same backup twice doesn't duplicate the secrets.
+func existsSameSecretTx(tx pgx.Tx, userId, categoryId int, secret backupSecret) (bool, error) {
+	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.
+		Select("1").
+		From("user_secrets").
+		Where(sq.Eq{
+			"user_id":     userId,
+			"category_id": categoryId,
+			"description": secret.Description,
+			"username":    secret.Username,
+			"url_site":    secret.URLSite,
+		}).
+		Where(sq.Expr("password_json IS NOT DISTINCT FROM ?::jsonb", jsonbValue(secret.PasswordJSON))).
+		Limit(1).ToSql()
+
+	var found int
+	err := tx.QueryRow(context.Background(), selectQry, selectQryArgs...).Scan(&found)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, internalError(err)
+	}
+	return true, nil
+}
+
+func jsonbValue(rawJSON *string) interface{} {
+	if rawJSON == nil {
+		return nil
+	}
+	return *rawJSON
+}
+
+// readBackupArchive reads the versioned backup, or the legacy one when the zip doesn't have the manifest.
+func readBackupArchive(zipReader *zip.Reader) (backupArchive, error) {
+	if _, err := fs.Stat(zipReader, backupManifestName); err == nil {
+		return readVersionedBackupArchive(zipReader)
+	}
+	return readLegacyBackupArchive(zipReader)
+}
+
+// readLegacyBackupArchive reads the first backup format:
+// 1.csv users, 2.csv secret_categories, 3.csv user_secrets in the COPY text format.
+func readLegacyBackupArchive(zipReader *zip.Reader) (backupArchive, error) {
+	var archive backupArchive
+
+	userRows, err := readCopyTextFile(zipReader, "1.csv", 4)
+	if err != nil {
+		return archive, err
+	}
+	if len(userRows) != 1 {
+		return archive, invalidBackupError("1.csv must have one user")
+	}
+	if archive.UserId, err = copyTextInt(userRows[0][0]); err != nil {
+		return archive, invalidBackupError("1.csv invalid user id")
+	}
+	archive.Username = copyTextString(userRows[0][1])
+
+	categoryRows, err := readCopyTextFile(zipReader, "2.csv", 3)
+	if err != nil {
+		return archive, err
+	}
+	categoryExists := make(map[int]bool)
+	for line, row := range categoryRows {
+		var category backupCategory
+		category.Id, err = copyTextInt(row[0])
+		if err != nil {
+			return archive, invalidBackupError("2.csv line %d: invalid id", line+1)
+		}
+		category.Name = copyTextString(row[1])
+		if category.Name == "" || len(category.Name) > 50 {
+			return archive, invalidBackupError("2.csv line %d: invalid name", line+1)
+		}
+		if ownerId, err := copyTextInt(row[2]); err != nil || ownerId != archive.UserId {
+			return archive, invalidBackupError("2.csv line %d: the category belongs to other user", line+1)
+		}
+
+		categoryExists[category.Id] = true
+		archive.Categories = append(archive.Categories, category)
+	}
+
+	secretRows, err := readCopyTextFile(zipReader, "3.csv", 9)
+	if err != nil {
+		return archive, err
+	}
+	for line, row := range secretRows {
+		secret := backupSecret{
+			Description:  copyTextString(row[1]),
+			Username:     copyTextString(row[2]),
+			PasswordJSON: row[3],
+			SafeNoteJSON: row[4],
+			URLSite:      copyTextString(row[5]),
+			ItemType:     ItemLogin, // the first format only had logins
+			CreatedAt:    row[6],
+		}
+		if secret.Id, err = copyTextInt(row[0]); err != nil {
+			return archive, invalidBackupError("3.csv line %d: invalid id", line+1)
+		}
+		if secret.CategoryId, err = copyTextInt(row[7]); err != nil || !categoryExists[secret.CategoryId] {
+			return archive, invalidBackupError("3.csv line %d: invalid category", line+1)
+		}
+		if ownerId, err := copyTextInt(row[8]); err != nil || ownerId != archive.UserId {
+			return archive, invalidBackupError("3.csv line %d: the secret belongs to other user", line+1)
+		}
+		if err = validateBackupSecret(secret); err != nil {
+			return archive, invalidBackupError("3.csv line %d: %v", line+1, err)
+		}
+
+		archive.Secrets = append(archive.Secrets, secret)
+	}
+
+	return archive, nil
+}
+
+func validateBackupSecret(secret backupSecret) error {
+	if len(secret.Description) > 250 || len(secret.Username) > 250 || len(secret.URLSite) > 250 {
+		return errors.New("value too long")
+	}
+	for _, tag := range secret.Tags {
+		if tag == "" || len(tag) > 50 {
+			return errors.New("invalid tag")
+		}
+	}
+	if validation.Validate(secret.ItemType, validation.In(itemTypes...)) != nil {
+		return errors.New("invalid item type")
+	}
+	for _, rawJSON := range []*string{secret.PasswordJSON, secret.SafeNoteJSON, secret.TypeDataJSON, secret.CustomFields, secret.TOTPJSON} {
+		if rawJSON != nil && !json.Valid([]byte(*rawJSON)) {
+			return errors.New("invalid encrypted payload")
+		}
+	}
+	return nil
+}
+
+func openBackupFile(zipReader *zip.Reader, name string) (io.ReadCloser, error) {
+	zipFile, err := zipReader.Open(name)
+	if err != nil {
+		return nil, invalidBackupError("%s not found", name)
+	}
+	return zipFile, nil
+}
+
+// readCopyTextFile parses the postgres COPY text format: tab separated columns, \N is NULL
+// and the special characters are escaped with backslash. NULL columns are nil.
+func readCopyTextFile(zipReader *zip.Reader, name string, columns int) ([][]*string, error) {
+	rows := make([][]*string, 0)
+
+	zipFile, err := openBackupFile(zipReader, name)
+	if err != nil {
+		return rows, err
+	}
+	defer zipFile.Close()
+
+	scanner := bufio.NewScanner(io.LimitReader(zipFile, maxBackupFileSize))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBackupFileSize)
+
+	for line := 1; scanner.Scan(); line++ {
+		rawColumns := strings.Split(scanner.Text(), "\t")
+		if len(rawColumns) != columns {
+			return rows, invalidBackupError("%s line %d: expected %d columns", name, line, columns)
+		}
+
+		row := make([]*string, columns)
+		for i, rawColumn := range rawColumns {
+			if rawColumn == `\N` {
+				continue
+			}
+			value, err := unescapeCopyText(rawColumn)
+			if err != nil {
+				return rows, invalidBackupError("%s line %d: %v", name, line, err)
+			}
+			row[i] = &value
+		}
+		rows = append(rows, row)
+	}
+	if err = scanner.Err(); err != nil {
+		return rows, invalidBackupError("%s: %v", name, err)
+	}
+
+	return rows, nil
+}
+
+func unescapeCopyText(rawColumn string) (string, error) {
+	if !strings.Contains(rawColumn, `\`) {
+		return rawColumn, nil
+	}
+
+	var value strings.Builder
+	for i := 0; i < len(rawColumn); i++ {
+		if rawColumn[i] != '\\' {
+			value.WriteByte(rawColumn[i])
+			continue
+		}
+
+		i++
+		if i == len(rawColumn) {
+			return "", errors.New("invalid escape at the end")
+		}
+
+		switch c := rawColumn[i]; c {
+		case 'b':
+			value.WriteByte('\b')
+		case 'f':
+			value.WriteByte('\f')
+		case 'n':
+			value.WriteByte('\n')
+		case 'r':
+			value.WriteByte('\r')
+		case 't':
+			value.WriteByte('\t')
+		case 'v':
+			value.WriteByte('\v')
+		case 'x':
+			end := i + 1
+			for end < len(rawColumn) && end < i+3 && isHexDigit(rawColumn[end]) {
+				end++
+			}
+			if end == i+1 {
+				return "", errors.New("invalid hex escape")
+			}
+			code, _ := strconv.ParseUint(rawColumn[i+1:end], 16, 8)
+			value.WriteByte(byte(code))
+			i = end - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			end := i
+			for end < len(rawColumn) && end < i+3 && rawColumn[end] >= '0' && rawColumn[end] <= '7' {
+				end++
+			}
+			code, _ := strconv.ParseUint(rawColumn[i:end], 8, 8)
+			value.WriteByte(byte(code))
+			i = end - 1
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return value.String(), nil
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func copyTextInt(value *string) (int, error) {
+	if value == nil {
+		return 0, errors.New("null value")
+	}
+	return strconv.Atoi(*value)
+}
+
+func copyTextString(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+// readVersionedBackupArchive reads the backup with manifest.json, every file is checked
+// against the rows and SHA-256 of the manifest and the csv columns are read by the header name.
+func readVersionedBackupArchive(zipReader *zip.Reader) (backupArchive, error) {
+	var archive backupArchive
+
+	manifestFile, err := openBackupFile(zipReader, backupManifestName)
+	if err != nil {
+		return archive, err
+	}
+	var manifest BackupManifest
+	err = json.NewDecoder(io.LimitReader(manifestFile, maxBackupFileSize)).Decode(&manifest)
+	_ = manifestFile.Close()
+	if err != nil {
+		return archive, invalidBackupError("invalid %s", backupManifestName)
+	}
+	if manifest.FormatVersion < 2 || manifest.FormatVersion > BackupFormatVersion {
+		return archive, invalidBackupError("unsupported format version %d", manifest.FormatVersion)
+	}
+
+	records := make(map[string][]map[string]string)
+	for _, manifestFile := range manifest.Files {
+		fileRecords, err := readVerifiedCSVFile(zipReader, manifestFile)
+		if err != nil {
+			return archive, err
+		}
+		records[manifestFile.Name] = fileRecords
+	}
+
+	userRecords, ok := records["user.csv"]
+	if !ok || len(userRecords) != 1 {
+		return archive, invalidBackupError("user.csv must have one user")
+	}
+	if archive.UserId, err = strconv.Atoi(userRecords[0]["id"]); err != nil {
+		return archive, invalidBackupError("user.csv invalid user id")
+	}
+	archive.Username = userRecords[0]["username"]
+	if !strings.EqualFold(archive.Username, manifest.Username) {
+		return archive, invalidBackupError("the manifest is of other user")
+	}
+
+	categoryExists := make(map[int]bool)
+	secretExists := make(map[int]bool)
+	for line, record := range records["categories.csv"] {
+		var category backupCategory
+		if category.Id, err = strconv.Atoi(record["id"]); err != nil {
+			return archive, invalidBackupError("categories.csv line %d: invalid id", line+1)
+		}
+		category.Name = record["name"]
+		if category.Name == "" || len(category.Name) > 50 {
+			return archive, invalidBackupError("categories.csv line %d: invalid name", line+1)
+		}
+
+		categoryExists[category.Id] = true
+		archive.Categories = append(archive.Categories, category)
+	}
+
+	for line, record := range records["secrets.csv"] {
+		secret := backupSecret{
+			Description:  record["description"],
+			Username:     record["username"],
+			PasswordJSON: csvNullable(record["password_json"]),
+			SafeNoteJSON: csvNullable(record["safe_note_json"]),
+			URLSite:      record["url_site"],
+			ItemType:     record["item_type"],
+			TypeDataJSON: csvNullable(record["type_data_json"]),
+			CustomFields: csvNullable(record["custom_fields_json"]),
+			TOTPJSON:     csvNullable(record["totp_json"]),
+			CreatedAt:    csvNullable(record["created_at"]),
+		}
+		if secret.ItemType == "" {
+			// backups before the item types
+			secret.ItemType = ItemLogin
+		}
+		if secret.Id, err = strconv.Atoi(record["id"]); err != nil {
+			return archive, invalidBackupError("secrets.csv line %d: invalid id", line+1)
+		}
+		if secret.CategoryId, err = strconv.Atoi(record["category_id"]); err != nil || !categoryExists[secret.CategoryId] {
+			return archive, invalidBackupError("secrets.csv line %d: invalid category", line+1)
+		}
+		if rawTags := record["tags"]; rawTags != "" {
+			if err = json.Unmarshal([]byte(rawTags), &secret.Tags); err != nil {
+				return archive, invalidBackupError("secrets.csv line %d: invalid tags", line+1)
+			}
+		}
+		if err = validateBackupSecret(secret); err != nil {
+			return archive, invalidBackupError("secrets.csv line %d: %v", line+1, err)
+		}
+
+		archive.Secrets = append(archive.Secrets, secret)
+		secretExists[secret.Id] = true
+	}
+
+	attachmentContents := make(map[string]BackupManifestAttachment)
+	for _, manifestAttachment := range manifest.Attachments {
+		attachmentContents[manifestAttachment.Name] = manifestAttachment
+	}
+
+	// backups before the attachments don't have attachments.csv
+	for line, record := range records["attachments.csv"] {
+		attachment := backupAttachment{
+			FileNameJSON: record["file_name_json"],
+			SHA256:       record["sha256"],
+			CreatedAt:    csvNullable(record["created_at"]),
+		}
+		if attachment.Id, err = strconv.Atoi(record["id"]); err != nil {
+			return archive, invalidBackupError("attachments.csv line %d: invalid id", line+1)
+		}
+		if attachment.SecretId, err = strconv.Atoi(record["secret_id"]); err != nil || !secretExists[attachment.SecretId] {
+			return archive, invalidBackupError("attachments.csv line %d: invalid secret", line+1)
+		}
+		if attachment.Size, err = strconv.ParseInt(record["size"], 10, 64); err != nil || attachment.Size <= 0 {
+			return archive, invalidBackupError("attachments.csv line %d: invalid size", line+1)
+		}
+		if !json.Valid([]byte(attachment.FileNameJSON)) {
+			return archive, invalidBackupError("attachments.csv line %d: invalid encrypted payload", line+1)
+		}
+
+		name := fmt.Sprintf("attachments/%d", attachment.Id)
+		if manifestAttachment, ok := attachmentContents[name]; ok {
+			if manifestAttachment.Size != attachment.Size || !strings.EqualFold(manifestAttachment.SHA256, attachment.SHA256) {
+				return archive, invalidBackupError("%s doesn't match attachments.csv", name)
+			}
+			for _, zipFile := range zipReader.File {
+				if zipFile.Name == name {
+					attachment.Content = zipFile
+					break
+				}
+			}
+			if attachment.Content == nil || int64(attachment.Content.UncompressedSize64) != attachment.Size {
+				return archive, invalidBackupError("%s not found", name)
+			}
+		}
+
+		archive.Attachments = append(archive.Attachments, attachment)
+	}
+
+	return archive, nil
+}
+
+// readVerifiedCSVFile returns the rows of the csv as maps by the header name.
+func readVerifiedCSVFile(zipReader *zip.Reader, manifestFile BackupManifestFile) ([]map[string]string, error) {
+	zipFile, err := openBackupFile(zipReader, manifestFile.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer zipFile.Close()
+
+	content, err := io.ReadAll(io.LimitReader(zipFile, maxBackupFileSize))
+	if err != nil {
+		return nil, invalidBackupError("%s: %v", manifestFile.Name, err)
+	}
+
+	checksum := sha256.Sum256(content)
+	if !strings.EqualFold(hex.EncodeToString(checksum[:]), manifestFile.SHA256) {
+		return nil, invalidBackupError("%s: the SHA-256 doesn't match the manifest", manifestFile.Name)
+	}
+
+	csvRecords, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	if err != nil {
+		return nil, invalidBackupError("%s: %v", manifestFile.Name, err)
+	}
+	if len(csvRecords) == 0 {
+		return nil, invalidBackupError("%s: the header is missing", manifestFile.Name)
+	}
+	if int64(len(csvRecords)-1) != manifestFile.Rows {
+		return nil, invalidBackupError("%s: expected %d rows", manifestFile.Name, manifestFile.Rows)
+	}
+
+	header := csvRecords[0]
+	records := make([]map[string]string, 0, len(csvRecords)-1)
+	for _, csvRecord := range csvRecords[1:] {
+		record := make(map[string]string, len(header))
+		for i, column := range header {
+			record[column] = csvRecord[i]
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// csvNullable is for the columns where postgres writes NULL as the empty value.
+func csvNullable(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
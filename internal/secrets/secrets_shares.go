@@ -0,0 +1,597 @@
+package secrets
+
+import (
+	"app-ez-pwd/internal/events"
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/storage"
+	"context"
+	"encoding/json"
+	"fmt"
+	sq "github.com/Masterminds/squirrel"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/go-ozzo/ozzo-validation/v4/is"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	SharePermissionRead = "read"
+	SharePermissionEdit = "edit" // the recipient updates the shared copy
+)
+
+// SharedInfoModel is in the shared items of ListUserSecretDB, the client unwraps WrappedKey with
+// its private key and decrypts the payloads of the item with the share key.
+type SharedInfoModel struct {
+	ShareId       int    `json:"shareId"`
+	OwnerUsername string `json:"ownerUsername"`
+	Permission    string `json:"permission"`
+	WrappedKey    string `json:"wrappedKey"`
+	Stale         bool   `json:"stale"` // the owner changed the secret after the copy
+}
+
+// ShareModel is the share seen by the owner of the secret.
+type ShareModel struct {
+	Id                int       `json:"id"`
+	SecretId          int       `json:"secretId"`
+	RecipientUsername string    `json:"recipientUsername"`
+	Permission        string    `json:"permission"`
+	Stale             bool      `json:"stale"` // the copy has to be encrypted again from the secret
+	Version           int       `json:"version"`
+	CreatedAt         time.Time `json:"createdAt"`
+	UpdatedAt         time.Time `json:"updatedAt"`
+}
+
+// SharedSecretModel is the shared copy, WrappedKey is the share key wrapped for the user that reads it.
+type SharedSecretModel struct {
+	Id                int             `json:"id"` // the share id
+	SecretId          int             `json:"secretId"`
+	OwnerUsername     string          `json:"ownerUsername"`
+	RecipientUsername string          `json:"recipientUsername"`
+	Permission        string          `json:"permission"`
+	WrappedKey        string          `json:"wrappedKey"`
+	Description       string          `json:"description"`
+	Username          string          `json:"username"`
+	PasswordEncrypted json.RawMessage `json:"passwordEncrypted"`
+	SafeNoteEncrypted json.RawMessage `json:"safeNoteEncrypted"`
+	URLSite           string          `json:"urlSite"`
+	Type              string          `json:"type"`
+	TypeData          json.RawMessage `json:"typeData"`
+	CustomFields      json.RawMessage `json:"customFields"`
+	TOTP              json.RawMessage `json:"totp"`
+	Stale             bool            `json:"stale"` // the owner changed the secret after the copy
+	Version           int             `json:"version"`
+	UpdatedAt         time.Time       `json:"updatedAt"`
+}
+
+// SharedSecretContentForm is the secret encrypted with the share key instead of the key of the owner.
+type SharedSecretContentForm struct {
+	Description       string               `json:"description"`
+	Username          string               `json:"username"`
+	PasswordEncrypted EncryptedPayloadForm `json:"passwordEncrypted"`
+	SafeNoteEncrypted EncryptedPayloadForm `json:"safeNoteEncrypted"`
+	URLSite           string               `json:"urlSite"`
+	Type              string               `json:"type"`
+	TypeData          *TypeDataForm        `json:"typeData"`
+	CustomFields      []CustomFieldForm    `json:"customFields"`
+	TOTP              *TOTPForm            `json:"totp"`
+}
+
+func (f SharedSecretContentForm) Validate() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Description, validation.Length(0, 250)),
+		validation.Field(&f.Username, validation.Length(0, 250)),
+		validation.Field(&f.PasswordEncrypted),
+		validation.Field(&f.SafeNoteEncrypted, validation.When(f.Type == ItemSecureNote, requiredPayload)),
+		validation.Field(&f.URLSite, validation.When(f.URLSite != "", is.URL, validation.Length(0, 250))),
+		validation.Field(&f.Type, validation.In(itemTypes...)),
+		validation.Field(&f.TypeData, typeDataRule(f.Type)),
+		validation.Field(&f.CustomFields, validation.Length(0, maxCustomFields)),
+		validation.Field(&f.TOTP))
+}
+
+// columns are the columns of the copy in secret_shares.
+func (f SharedSecretContentForm) columns() map[string]interface{} {
+	bytesPasswordEncrypted, _ := json.Marshal(f.PasswordEncrypted)
+	bytesSafeNoteEncrypted, _ := json.Marshal(f.SafeNoteEncrypted)
+	itemType, bytesTypeData := itemTypeValues(f.Type, f.TypeData)
+
+	return map[string]interface{}{
+		"description":        f.Description,
+		"username":           f.Username,
+		"password_json":      bytesPasswordEncrypted,
+		"safe_note_json":     bytesSafeNoteEncrypted,
+		"url_site":           f.URLSite,
+		"item_type":          itemType,
+		"type_data_json":     bytesTypeData,
+		"custom_fields_json": customFieldsValue(f.CustomFields),
+		"totp_json":          totpValue(f.TOTP),
+	}
+}
+
+type ShareSecretForm struct {
+	RecipientUsername string                  `json:"recipientUsername"`
+	Permission        string                  `json:"permission"`
+	WrappedKey        string                  `json:"wrappedKey"`      // the share key wrapped with the recipient public key
+	OwnerWrappedKey   string                  `json:"ownerWrappedKey"` // the share key wrapped with the owner public key
+	Secret            SharedSecretContentForm `json:"secret"`
+}
+
+func (f ShareSecretForm) ValidateFront() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.RecipientUsername, validation.Required, validation.Length(3, 50)),
+		validation.Field(&f.Permission, validation.Required, validation.In(SharePermissionRead, SharePermissionEdit)),
+		validation.Field(&f.WrappedKey, validation.Required, validation.Length(0, 2000), base64Rule),
+		validation.Field(&f.OwnerWrappedKey, validation.Required, validation.Length(0, 2000), base64Rule),
+		validation.Field(&f.Secret))
+}
+
+// Save shares the secret, sharing again with the same user replaces the copy and the permission.
+func (f ShareSecretForm) Save(userId, secretId int) (ShareModel, error) {
+	return ShareSecretDB(userId, secretId, f.RecipientUsername, f.Permission, f.WrappedKey, f.OwnerWrappedKey, f.Secret.columns())
+}
+
+type UpdateSharedSecretForm struct {
+	Version int                     `json:"version"`
+	Secret  SharedSecretContentForm `json:"secret"`
+}
+
+func (f UpdateSharedSecretForm) ValidateFront() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Version, validation.Required),
+		validation.Field(&f.Secret))
+}
+
+func (f UpdateSharedSecretForm) Update(userId, shareId int) (int, error) {
+	return UpdateSharedSecretDB(userId, shareId, f.Version, f.Secret.columns())
+}
+
+func ShareSecretDB(ownerId, secretId int, recipientUsername, permission, wrappedKey, ownerWrappedKey string, columns map[string]interface{}) (ShareModel, error) {
+	share := ShareModel{SecretId: secretId, Permission: permission}
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return share, internalError(err)
+	}
+
+	if err = existsUserSecretTx(tx, ownerId, secretId); err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return share, err
+	}
+
+	recipient, err := selectPublicKeyTx(tx, recipientUsername)
+	if KindOf(err) == KindNotFound {
+		err = FieldError("recipientUsername", "the user doesn't exist or doesn't have keys")
+	} else if err == nil && recipient.UserId == ownerId {
+		err = FieldError("recipientUsername", "the secret can't be shared with yourself")
+	}
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return share, err
+	}
+	share.RecipientUsername = recipient.Username
+
+	columns["secret_id"] = secretId
+	columns["owner_id"] = ownerId
+	columns["recipient_id"] = recipient.UserId
+	columns["permission"] = permission
+	columns["wrapped_key"] = wrappedKey
+	columns["owner_wrapped_key"] = ownerWrappedKey
+
+	insertShare, insertShareArgs, _ := storage.ApplicationDB.Psql.Insert("secret_shares").
+		SetMap(columns).
+		Suffix("ON CONFLICT (secret_id, recipient_id) DO UPDATE SET " +
+			"permission = EXCLUDED.permission, wrapped_key = EXCLUDED.wrapped_key, owner_wrapped_key = EXCLUDED.owner_wrapped_key, " +
+			"description = EXCLUDED.description, username = EXCLUDED.username, password_json = EXCLUDED.password_json, " +
+			"safe_note_json = EXCLUDED.safe_note_json, url_site = EXCLUDED.url_site, item_type = EXCLUDED.item_type, " +
+			"type_data_json = EXCLUDED.type_data_json, custom_fields_json = EXCLUDED.custom_fields_json, totp_json = EXCLUDED.totp_json, " +
+			"stale = false, version = secret_shares.version + 1, updated_at = CURRENT_TIMESTAMP, sync_txid = txid_current() " +
+			"RETURNING id, version, created_at, updated_at").ToSql()
+
+	err = tx.QueryRow(context.Background(), insertShare, insertShareArgs...).
+		Scan(&share.Id, &share.Version, &share.CreatedAt, &share.UpdatedAt)
+	if err != nil {
+		logger.Logger.Error("err insert share", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return share, internalError(err)
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return share, internalError(err)
+	}
+
+	events.Hub.Publish(events.Event{Type: events.ShareUpdated, UserId: recipient.UserId, EntityId: share.Id, Version: share.Version})
+	return share, nil
+}
+
+// ListSecretSharesDB lists the shares of the secret for its owner.
+func ListSecretSharesDB(ownerId, secretId int) ([]ShareModel, error) {
+	shares := make([]ShareModel, 0)
+
+	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.
+		Select("s.id", "s.secret_id", "u.username", "s.permission", "s.stale", "s.version", "s.created_at", "s.updated_at").
+		From("secret_shares s").
+		Join("users u ON u.id = s.recipient_id").
+		Where(sq.Eq{
+			"s.owner_id":  ownerId,
+			"s.secret_id": secretId,
+		}).OrderBy("s.id").ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return shares, internalError(err)
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	if err = existsUserSecretTx(tx, ownerId, secretId); err != nil {
+		return shares, err
+	}
+
+	rows, err := tx.Query(context.Background(), selectQry, selectQryArgs...)
+	if err != nil {
+		logger.Logger.Error("err query shares", zap.Error(err))
+		return shares, internalError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var share ShareModel
+		err = rows.Scan(&share.Id, &share.SecretId, &share.RecipientUsername, &share.Permission,
+			&share.Stale, &share.Version, &share.CreatedAt, &share.UpdatedAt)
+		if err != nil {
+			logger.Logger.Error("err scan share", zap.Error(err))
+			return shares, internalError(err)
+		}
+		shares = append(shares, share)
+	}
+	return shares, nil
+}
+
+// shareVisibleTo is the filter of the shares of the user: as owner or as recipient.
+func shareVisibleTo(userId int) sq.Or {
+	return sq.Or{
+		sq.Eq{"s.owner_id": userId},
+		sq.Eq{"s.recipient_id": userId},
+	}
+}
+
+// GetSharedSecretDB returns the shared copy to the owner or the recipient, with the key wrapped for the user.
+func GetSharedSecretDB(userId, shareId int) (SharedSecretModel, error) {
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return SharedSecretModel{}, internalError(err)
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	return selectSharedSecretTx(tx, userId, shareId)
+}
+
+// sharedSecretSelect selects the shared copies with the key wrapped for the user, the owner or the recipient.
+func sharedSecretSelect(userId int) sq.SelectBuilder {
+	return storage.ApplicationDB.Psql.
+		Select(
+			"s.id",
+			"s.secret_id",
+			"o.username",
+			"r.username",
+			"s.permission",
+		).
+		Column("CASE WHEN s.owner_id = ? THEN s.owner_wrapped_key ELSE s.wrapped_key END", userId).
+		Columns(
+			"s.description",
+			"s.username",
+			"s.password_json",
+			"s.safe_note_json",
+			"s.url_site",
+			"s.item_type",
+			"s.type_data_json",
+			"COALESCE(s.custom_fields_json, '[]')",
+			"s.totp_json",
+			"s.stale",
+			"s.version",
+			"s.updated_at",
+		).
+		From("secret_shares s").
+		Join("users o ON o.id = s.owner_id").
+		Join("users r ON r.id = s.recipient_id")
+}
+
+func scanSharedSecret(row pgx.Row, sharedSecret *SharedSecretModel) error {
+	return row.Scan(
+		&sharedSecret.Id,
+		&sharedSecret.SecretId,
+		&sharedSecret.OwnerUsername,
+		&sharedSecret.RecipientUsername,
+		&sharedSecret.Permission,
+		&sharedSecret.WrappedKey,
+		&sharedSecret.Description,
+		&sharedSecret.Username,
+		&sharedSecret.PasswordEncrypted,
+		&sharedSecret.SafeNoteEncrypted,
+		&sharedSecret.URLSite,
+		&sharedSecret.Type,
+		&sharedSecret.TypeData,
+		&sharedSecret.CustomFields,
+		&sharedSecret.TOTP,
+		&sharedSecret.Stale,
+		&sharedSecret.Version,
+		&sharedSecret.UpdatedAt,
+	)
+}
+
+func selectSharedSecretTx(tx pgx.Tx, userId, shareId int) (SharedSecretModel, error) {
+	var sharedSecret SharedSecretModel
+
+	selectQry, selectQryArgs, _ := sharedSecretSelect(userId).
+		Where(sq.Eq{"s.id": shareId}).
+		Where(shareVisibleTo(userId)).ToSql()
+
+	err := scanSharedSecret(tx.QueryRow(context.Background(), selectQry, selectQryArgs...), &sharedSecret)
+	if err == pgx.ErrNoRows {
+		return sharedSecret, notFoundError(fmt.Sprintf("shared secret %d not found", shareId))
+	}
+	if err != nil {
+		logger.Logger.Error("err scan shared secret", zap.Error(err))
+		return sharedSecret, internalError(err)
+	}
+	return sharedSecret, nil
+}
+
+// UpdateSharedSecretDB updates the shared copy at the version: the owner or the recipient with edit permission.
+// The copy of the owner is from the current secret, the recipient edits only change the copy.
+func UpdateSharedSecretDB(userId, shareId, version int, columns map[string]interface{}) (int, error) {
+	columns["stale"] = sq.Expr("stale AND owner_id <> ?", userId)
+	columns["version"] = sq.Expr("version + 1")
+	columns["updated_at"] = sq.Expr("CURRENT_TIMESTAMP")
+	columns["sync_txid"] = sq.Expr("txid_current()")
+
+	updateQry, updateQryArgs, _ := storage.ApplicationDB.Psql.Update("secret_shares").
+		SetMap(columns).
+		Where(sq.Eq{
+			"id":      shareId,
+			"version": version,
+		}).
+		Where(sq.Or{
+			sq.Eq{"owner_id": userId},
+			sq.Eq{"recipient_id": userId, "permission": SharePermissionEdit},
+		}).Suffix("RETURNING version, owner_id, recipient_id").ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return 0, internalError(err)
+	}
+
+	var newVersion, ownerId, recipientId int
+	err = tx.QueryRow(context.Background(), updateQry, updateQryArgs...).Scan(&newVersion, &ownerId, &recipientId)
+	if err == pgx.ErrNoRows {
+		err = sharedSecretConflictTx(tx, userId, shareId)
+	} else if err != nil {
+		logger.Logger.Error("err update shared secret", zap.Error(err))
+		err = internalError(err)
+	}
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return 0, err
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return 0, internalError(err)
+	}
+
+	for _, sharedUserId := range []int{ownerId, recipientId} {
+		events.Hub.Publish(events.Event{Type: events.ShareUpdated, UserId: sharedUserId, EntityId: shareId, Version: newVersion})
+	}
+	return newVersion, nil
+}
+
+// sharedSecretConflictTx is called when the update of the shared copy didn't match any row:
+// the share isn't visible, it's read only or it has another version (the conflict has the current copy).
+func sharedSecretConflictTx(tx pgx.Tx, userId, shareId int) error {
+	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.
+		Select("s.owner_id", "s.permission").
+		From("secret_shares s").
+		Where(sq.Eq{"s.id": shareId}).
+		Where(shareVisibleTo(userId)).ToSql()
+
+	var ownerId int
+	var permission string
+	err := tx.QueryRow(context.Background(), selectQry, selectQryArgs...).Scan(&ownerId, &permission)
+	if err == pgx.ErrNoRows {
+		return notFoundError(fmt.Sprintf("shared secret %d not found", shareId))
+	}
+	if err != nil {
+		return internalError(err)
+	}
+	if ownerId != userId && permission != SharePermissionEdit {
+		return &Error{Kind: KindForbidden, Message: "the shared secret is read only"}
+	}
+
+	current, err := selectSharedSecretTx(tx, userId, shareId)
+	if err != nil {
+		return err
+	}
+	return &Error{
+		Kind:    KindConflict,
+		Message: fmt.Sprintf("the shared secret was modified, current version is %d", current.Version),
+		Current: &current,
+		Version: current.Version,
+	}
+}
+
+// RevokeShareDB deletes the share: the owner revokes it or the recipient leaves it.
+func RevokeShareDB(userId, shareId int) error {
+	deleteQry, deleteQryArgs, _ := storage.ApplicationDB.Psql.Delete("secret_shares s").
+		Where(sq.Eq{"s.id": shareId}).
+		Where(shareVisibleTo(userId)).
+		Suffix("RETURNING s.owner_id, s.recipient_id").ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return internalError(err)
+	}
+
+	var ownerId, recipientId int
+	err = tx.QueryRow(context.Background(), deleteQry, deleteQryArgs...).Scan(&ownerId, &recipientId)
+	if err == pgx.ErrNoRows {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return notFoundError(fmt.Sprintf("shared secret %d not found", shareId))
+	}
+	if err != nil {
+		logger.Logger.Error("err delete share", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return internalError(err)
+	}
+
+	// only the recipient syncs the shared copy
+	if err = insertTombstoneTx(tx, recipientId, tombstoneShare, shareId); err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return err
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return internalError(err)
+	}
+
+	for _, sharedUserId := range []int{ownerId, recipientId} {
+		events.Hub.Publish(events.Event{Type: events.ShareRevoked, UserId: sharedUserId, EntityId: shareId})
+	}
+	return nil
+}
+
+// revokeSharesTx deletes the shares of the secrets that are deleted before the cascade of the secrets,
+// like RevokeShareDB. It returns the events to publish after the commit.
+func revokeSharesTx(tx pgx.Tx, filter sq.Sqlizer) ([]events.Event, error) {
+	deleteQry, deleteQryArgs, _ := storage.ApplicationDB.Psql.Delete("secret_shares").
+		Where(filter).
+		Suffix("RETURNING id, owner_id, recipient_id").ToSql()
+
+	rows, err := tx.Query(context.Background(), deleteQry, deleteQryArgs...)
+	if err != nil {
+		logger.Logger.Error("err delete shares", zap.Error(err))
+		return nil, internalError(err)
+	}
+
+	shareEvents := make([]events.Event, 0)
+	recipientIds := make(map[int]int) // share id -> recipient id
+	for rows.Next() {
+		var shareId, ownerId, recipientId int
+		if err = rows.Scan(&shareId, &ownerId, &recipientId); err != nil {
+			rows.Close()
+			logger.Logger.Error("err scan share", zap.Error(err))
+			return nil, internalError(err)
+		}
+		recipientIds[shareId] = recipientId
+		for _, sharedUserId := range []int{ownerId, recipientId} {
+			shareEvents = append(shareEvents, events.Event{Type: events.ShareRevoked, UserId: sharedUserId, EntityId: shareId})
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, internalError(err)
+	}
+
+	for shareId, recipientId := range recipientIds {
+		if err = insertTombstoneTx(tx, recipientId, tombstoneShare, shareId); err != nil {
+			return nil, err
+		}
+	}
+	return shareEvents, nil
+}
+
+// markSharesStaleTx flags the copies of the secret after the owner changed it, the owner client encrypts
+// them again (PUT of the shared secret). It returns the shares flagged now.
+func markSharesStaleTx(tx pgx.Tx, secretId int) ([]events.Event, error) {
+	updateQry, updateQryArgs, _ := storage.ApplicationDB.Psql.Update("secret_shares").
+		Set("stale", true).
+		Set("sync_txid", sq.Expr("txid_current()")).
+		Where(sq.Eq{
+			"secret_id": secretId,
+			"stale":     false,
+		}).Suffix("RETURNING id, recipient_id, version").ToSql()
+
+	rows, err := tx.Query(context.Background(), updateQry, updateQryArgs...)
+	if err != nil {
+		logger.Logger.Error("err mark shares stale", zap.Error(err))
+		return nil, internalError(err)
+	}
+	defer rows.Close()
+
+	shareEvents := make([]events.Event, 0)
+	for rows.Next() {
+		event := events.Event{Type: events.ShareUpdated}
+		if err = rows.Scan(&event.EntityId, &event.UserId, &event.Version); err != nil {
+			logger.Logger.Error("err scan share", zap.Error(err))
+			return nil, internalError(err)
+		}
+		shareEvents = append(shareEvents, event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, internalError(err)
+	}
+	return shareEvents, nil
+}
+
+// listSharedWithUserTx returns the secrets shared with the user as list items, the id is the one of the secret.
+func listSharedWithUserTx(tx pgx.Tx, userId int, itemType string) ([]ListUserSecretModel, error) {
+	itemsShared := make([]ListUserSecretModel, 0)
+
+	whereFilters := sq.Eq{
+		"s.recipient_id": userId,
+	}
+	if itemType != "" {
+		whereFilters["s.item_type"] = itemType
+	}
+
+	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.Select(
+		"s.secret_id",
+		"s.description",
+		"s.username",
+		"s.password_json",
+		"s.safe_note_json",
+		"s.url_site",
+		"s.item_type",
+		"s.type_data_json",
+		"s.version",
+		"s.id",
+		"o.username",
+		"s.permission",
+		"s.wrapped_key",
+		"s.stale",
+	).
+		From("secret_shares s").
+		Join("users o ON o.id = s.owner_id").
+		Where(whereFilters).OrderBy("s.id DESC").ToSql()
+
+	rows, err := tx.Query(context.Background(), selectQry, selectQryArgs...)
+	if err != nil {
+		logger.Logger.Error("err select shared qry", zap.Error(err))
+		return itemsShared, internalError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		sharedSecret := ListUserSecretModel{Tags: make([]string, 0), Shared: &SharedInfoModel{}}
+		err = rows.Scan(
+			&sharedSecret.Id,
+			&sharedSecret.Description,
+			&sharedSecret.Username,
+			&sharedSecret.PasswordEncrypted,
+			&sharedSecret.SafeNoteEncrypted,
+			&sharedSecret.URLSite,
+			&sharedSecret.Type,
+			&sharedSecret.TypeData,
+			&sharedSecret.Version,
+			&sharedSecret.Shared.ShareId,
+			&sharedSecret.Shared.OwnerUsername,
+			&sharedSecret.Shared.Permission,
+			&sharedSecret.Shared.WrappedKey,
+			&sharedSecret.Shared.Stale,
+		)
+		if err != nil {
+			logger.Logger.Error("err scan shared item", zap.Error(err))
+			return itemsShared, internalError(err)
+		}
+		itemsShared = append(itemsShared, sharedSecret)
+	}
+	return itemsShared, nil
+}
@@ -0,0 +1,245 @@
+package secrets
+
+import (
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/storage"
+	"context"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+	"strconv"
+)
+
+const (
+	tombstoneCategory = "category"
+	tombstoneSecret   = "secret"
+	tombstoneShare    = "share"
+	// tombstoneFullSync asks for a full sync: the organizations of the user changed, the rows of
+	// the organization it joined are older than its token and the ones of the organization it left
+	// don't get tombstones anymore.
+	tombstoneFullSync = "full"
+)
+
+type SyncDeletedModel struct {
+	Categories []int `json:"categories"`
+	Secrets    []int `json:"secrets"`
+	Shares     []int `json:"shares"`
+}
+
+// SyncSecretModel is the secret of the user or of one of its organizations.
+type SyncSecretModel struct {
+	UserSecretModel
+	OrganizationId *int `json:"organizationId,omitempty"`
+}
+
+type SyncModel struct {
+	Token      string              `json:"token"` // send it as since in the next sync
+	Full       bool                `json:"full"`  // true: replace the local copy, there are no tombstones
+	Categories []ListCategoryModel `json:"categories"`
+	Secrets    []SyncSecretModel   `json:"secrets"`
+	Shared     []SharedSecretModel `json:"shared"` // the copies shared with the user
+	Deleted    SyncDeletedModel    `json:"deleted"`
+}
+
+// ParseSyncToken returns 0 for the empty token, that is a full sync.
+func ParseSyncToken(token string) (uint64, error) {
+	if token == "" {
+		return 0, nil
+	}
+	since, err := strconv.ParseUint(token, 10, 64)
+	if err != nil {
+		return 0, FieldError("since", "invalid sync token")
+	}
+	return since, nil
+}
+
+// SyncUserSecretsDB returns the categories and secrets written since the token and the deleted ids:
+// the personal ones, the ones of the organizations of the user and the copies shared with the user.
+// The new token is the xmin of the snapshot: every transaction before it is already visible here,
+// the rows of the transactions still running are sent again in the next sync.
+func SyncUserSecretsDB(userId int, since uint64) (SyncModel, error) {
+	syncModel := SyncModel{
+		Categories: make([]ListCategoryModel, 0),
+		Secrets:    make([]SyncSecretModel, 0),
+		Shared:     make([]SharedSecretModel, 0),
+		Deleted: SyncDeletedModel{
+			Categories: make([]int, 0),
+			Secrets:    make([]int, 0),
+			Shares:     make([]int, 0),
+		},
+	}
+
+	cn, tx, err := storage.ApplicationDB.BeginTx(pgx.TxOptions{
+		IsoLevel:   pgx.RepeatableRead,
+		AccessMode: pgx.ReadOnly,
+	})
+	if err != nil {
+		return syncModel, internalError(err)
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	var snapshotXmin uint64
+	if err = tx.QueryRow(context.Background(), "SELECT txid_snapshot_xmin(txid_current_snapshot())").Scan(&snapshotXmin); err != nil {
+		logger.Logger.Error("err snapshot xmin", zap.Error(err))
+		return syncModel, internalError(err)
+	}
+	syncModel.Token = strconv.FormatUint(snapshotXmin, 10)
+
+	if since > 0 {
+		selectFullSync, selectFullSyncArgs, _ := storage.ApplicationDB.Psql.
+			Select("1").
+			From("sync_tombstones").
+			Where(sq.Eq{
+				"user_id": userId,
+				"entity":  tombstoneFullSync,
+			}).
+			Where(sq.GtOrEq{"sync_txid": since}).
+			Prefix("SELECT EXISTS (").Suffix(")").ToSql()
+
+		var fullSync bool
+		if err = tx.QueryRow(context.Background(), selectFullSync, selectFullSyncArgs...).Scan(&fullSync); err != nil {
+			logger.Logger.Error("err query full sync", zap.Error(err))
+			return syncModel, internalError(err)
+		}
+		if fullSync {
+			since = 0
+		}
+	}
+	syncModel.Full = since == 0
+
+	userFilter := sq.And{personalOrMemberScope(userId), sq.GtOrEq{"sync_txid": since}}
+
+	selectCategories, selectCategoriesArgs, _ := storage.ApplicationDB.Psql.
+		Select("id", "name", "organization_id").
+		From("secret_categories").
+		Where(userFilter).
+		OrderBy("id").ToSql()
+
+	categoryRows, err := tx.Query(context.Background(), selectCategories, selectCategoriesArgs...)
+	if err != nil {
+		logger.Logger.Error("err query sync categories", zap.Error(err))
+		return syncModel, internalError(err)
+	}
+	for categoryRows.Next() {
+		var category ListCategoryModel
+		if err = categoryRows.Scan(&category.Id, &category.Name, &category.OrganizationId); err != nil {
+			categoryRows.Close()
+			logger.Logger.Error("err scan sync category", zap.Error(err))
+			return syncModel, internalError(err)
+		}
+		syncModel.Categories = append(syncModel.Categories, category)
+	}
+	categoryRows.Close()
+
+	selectSecrets, selectSecretsArgs, _ := storage.ApplicationDB.Psql.
+		Select(userSecretColumns...).
+		Column("organization_id").
+		From("user_secrets").
+		Where(userFilter).
+		OrderBy("id").ToSql()
+
+	secretRows, err := tx.Query(context.Background(), selectSecrets, selectSecretsArgs...)
+	if err != nil {
+		logger.Logger.Error("err query sync secrets", zap.Error(err))
+		return syncModel, internalError(err)
+	}
+	for secretRows.Next() {
+		var syncSecret SyncSecretModel
+		if err = secretRows.Scan(append(userSecretFields(&syncSecret.UserSecretModel), &syncSecret.OrganizationId)...); err != nil {
+			secretRows.Close()
+			logger.Logger.Error("err scan sync secret", zap.Error(err))
+			return syncModel, internalError(err)
+		}
+		syncModel.Secrets = append(syncModel.Secrets, syncSecret)
+	}
+	secretRows.Close()
+
+	selectShared, selectSharedArgs, _ := sharedSecretSelect(userId).
+		Where(sq.Eq{"s.recipient_id": userId}).
+		Where(sq.GtOrEq{"s.sync_txid": since}).
+		OrderBy("s.id").ToSql()
+
+	sharedRows, err := tx.Query(context.Background(), selectShared, selectSharedArgs...)
+	if err != nil {
+		logger.Logger.Error("err query sync shared secrets", zap.Error(err))
+		return syncModel, internalError(err)
+	}
+	for sharedRows.Next() {
+		var sharedSecret SharedSecretModel
+		if err = scanSharedSecret(sharedRows, &sharedSecret); err != nil {
+			sharedRows.Close()
+			logger.Logger.Error("err scan sync shared secret", zap.Error(err))
+			return syncModel, internalError(err)
+		}
+		syncModel.Shared = append(syncModel.Shared, sharedSecret)
+	}
+	sharedRows.Close()
+
+	if syncModel.Full {
+		return syncModel, nil
+	}
+
+	selectTombstones, selectTombstonesArgs, _ := storage.ApplicationDB.Psql.
+		Select("entity", "entity_id").
+		From("sync_tombstones").
+		Where(userFilter).
+		OrderBy("id").ToSql()
+
+	tombstoneRows, err := tx.Query(context.Background(), selectTombstones, selectTombstonesArgs...)
+	if err != nil {
+		logger.Logger.Error("err query sync tombstones", zap.Error(err))
+		return syncModel, internalError(err)
+	}
+	defer tombstoneRows.Close()
+	for tombstoneRows.Next() {
+		var entity string
+		var entityId int
+		if err = tombstoneRows.Scan(&entity, &entityId); err != nil {
+			logger.Logger.Error("err scan sync tombstone", zap.Error(err))
+			return syncModel, internalError(err)
+		}
+
+		switch entity {
+		case tombstoneCategory:
+			syncModel.Deleted.Categories = append(syncModel.Deleted.Categories, entityId)
+		case tombstoneSecret:
+			syncModel.Deleted.Secrets = append(syncModel.Deleted.Secrets, entityId)
+		case tombstoneShare:
+			syncModel.Deleted.Shares = append(syncModel.Deleted.Shares, entityId)
+		}
+	}
+
+	return syncModel, nil
+}
+
+// insertTombstoneTx records the delete for the clients that sync, call it in the same transaction of the delete.
+func insertTombstoneTx(tx pgx.Tx, userId int, entity string, entityId int) error {
+	insertTombstone, insertTombstoneArgs, _ := storage.ApplicationDB.Psql.Insert("sync_tombstones").
+		SetMap(map[string]interface{}{
+			"entity":    entity,
+			"entity_id": entityId,
+			"user_id":   userId,
+		}).ToSql()
+
+	if _, err := tx.Exec(context.Background(), insertTombstone, insertTombstoneArgs...); err != nil {
+		logger.Logger.Error("err insert tombstone", zap.Error(err))
+		return internalError(err)
+	}
+	return nil
+}
+
+// insertOrganizationTombstoneTx is insertTombstoneTx for the deletes in the organization, every member gets it.
+func insertOrganizationTombstoneTx(tx pgx.Tx, organizationId int, entity string, entityId int) error {
+	insertTombstone, insertTombstoneArgs, _ := storage.ApplicationDB.Psql.Insert("sync_tombstones").
+		SetMap(map[string]interface{}{
+			"entity":          entity,
+			"entity_id":       entityId,
+			"organization_id": organizationId,
+		}).ToSql()
+
+	if _, err := tx.Exec(context.Background(), insertTombstone, insertTombstoneArgs...); err != nil {
+		logger.Logger.Error("err insert organization tombstone", zap.Error(err))
+		return internalError(err)
+	}
+	return nil
+}
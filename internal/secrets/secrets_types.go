@@ -0,0 +1,205 @@
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"regexp"
+)
+
+// The item types, login is the website login of the first version: description, username, password, note and url.
+const (
+	ItemLogin      = "login"
+	ItemCard       = "card"
+	ItemIdentity   = "identity"
+	ItemSSHKey     = "sshKey"
+	ItemAPIKey     = "apiKey"
+	ItemSecureNote = "secureNote"
+)
+
+var itemTypes = []interface{}{ItemLogin, ItemCard, ItemIdentity, ItemSSHKey, ItemAPIKey, ItemSecureNote}
+
+// requiredPayload is the Required of the encrypted payloads: the struct is never empty for ozzo.
+var requiredPayload = validation.By(func(value interface{}) error {
+	if payload, ok := value.(EncryptedPayloadForm); ok && len(payload.Encrypted) == 0 {
+		return errors.New("cannot be blank")
+	}
+	return nil
+})
+
+type CardDataForm struct {
+	Brand               string               `json:"brand"` // visa, mastercard... plaintext to show the item
+	ExpMonth            int                  `json:"expMonth"`
+	ExpYear             int                  `json:"expYear"`
+	CardholderEncrypted EncryptedPayloadForm `json:"cardholderEncrypted"`
+	NumberEncrypted     EncryptedPayloadForm `json:"numberEncrypted"`
+	CodeEncrypted       EncryptedPayloadForm `json:"codeEncrypted"`
+}
+
+func (f CardDataForm) Validate() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Brand, validation.Length(0, 30)),
+		validation.Field(&f.ExpMonth, validation.Min(0), validation.Max(12)),
+		validation.Field(&f.ExpYear, validation.When(f.ExpYear != 0, validation.Min(2000), validation.Max(2200))),
+		validation.Field(&f.CardholderEncrypted),
+		validation.Field(&f.NumberEncrypted, requiredPayload),
+		validation.Field(&f.CodeEncrypted))
+}
+
+// IdentityDataForm has every field of the identity (names, address, documents...) in one payload.
+type IdentityDataForm struct {
+	IdentityEncrypted EncryptedPayloadForm `json:"identityEncrypted"`
+}
+
+func (f IdentityDataForm) Validate() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.IdentityEncrypted, requiredPayload))
+}
+
+var sshPublicKeyRegex = regexp.MustCompile(`^(ssh-(rsa|dss|ed25519)|ecdsa-sha2-nistp(256|384|521)|sk-(ssh-ed25519|ecdsa-sha2-nistp256)@openssh\.com) [A-Za-z0-9+/]+={0,3}( .*)?$`)
+
+type SSHKeyDataForm struct {
+	PublicKey           string               `json:"publicKey"` // authorized_keys format
+	Fingerprint         string               `json:"fingerprint"`
+	PrivateKeyEncrypted EncryptedPayloadForm `json:"privateKeyEncrypted"`
+}
+
+func (f SSHKeyDataForm) Validate() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.PublicKey, validation.Required, validation.Length(0, 16384),
+			validation.Match(sshPublicKeyRegex).Error("must be an OpenSSH public key")),
+		validation.Field(&f.Fingerprint, validation.Length(0, 100)),
+		validation.Field(&f.PrivateKeyEncrypted, requiredPayload))
+}
+
+type APIKeyDataForm struct {
+	KeyId           string               `json:"keyId"`     // the public part, ex: the access key id
+	ExpiresAt       string               `json:"expiresAt"` // YYYY-MM-DD
+	SecretEncrypted EncryptedPayloadForm `json:"secretEncrypted"`
+}
+
+func (f APIKeyDataForm) Validate() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.KeyId, validation.Length(0, 250)),
+		validation.Field(&f.ExpiresAt, validation.Date("2006-01-02")),
+		validation.Field(&f.SecretEncrypted, requiredPayload))
+}
+
+const (
+	TOTPDefaultPeriod    = 30
+	TOTPDefaultDigits    = 6
+	TOTPDefaultAlgorithm = "SHA1"
+)
+
+// TOTPForm is the authenticator of the secret: the seed is encrypted, the otpauth parameters are in
+// plaintext so the clients show the countdown without the decryption. The empty parameters are the defaults.
+type TOTPForm struct {
+	SeedEncrypted EncryptedPayloadForm `json:"seedEncrypted"`
+	Period        int                  `json:"period"` // seconds
+	Digits        int                  `json:"digits"`
+	Algorithm     string               `json:"algorithm"`
+}
+
+func (f TOTPForm) Validate() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.SeedEncrypted, requiredPayload),
+		validation.Field(&f.Period, validation.When(f.Period != 0, validation.Min(15), validation.Max(300))),
+		validation.Field(&f.Digits, validation.In(6, 7, 8)),
+		validation.Field(&f.Algorithm, validation.In("SHA1", "SHA256", "SHA512")))
+}
+
+// totpValue is the totp_json column with the defaults, the clients generate the code without guessing them.
+func totpValue(totp *TOTPForm) []byte {
+	if totp == nil {
+		return nil
+	}
+	totpWithDefaults := *totp
+	if totpWithDefaults.Period == 0 {
+		totpWithDefaults.Period = TOTPDefaultPeriod
+	}
+	if totpWithDefaults.Digits == 0 {
+		totpWithDefaults.Digits = TOTPDefaultDigits
+	}
+	if totpWithDefaults.Algorithm == "" {
+		totpWithDefaults.Algorithm = TOTPDefaultAlgorithm
+	}
+	bytesTOTP, _ := json.Marshal(totpWithDefaults)
+	return bytesTOTP
+}
+
+// TypeDataForm has the fields of the item type, only the one of the type is set.
+// Login and secure note don't have type data: they use the columns of the secret.
+type TypeDataForm struct {
+	Card     *CardDataForm     `json:"card,omitempty"`
+	Identity *IdentityDataForm `json:"identity,omitempty"`
+	SSHKey   *SSHKeyDataForm   `json:"sshKey,omitempty"`
+	APIKey   *APIKeyDataForm   `json:"apiKey,omitempty"`
+}
+
+func (f TypeDataForm) Validate() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Card),
+		validation.Field(&f.Identity),
+		validation.Field(&f.SSHKey),
+		validation.Field(&f.APIKey))
+}
+
+// typeDataRule checks the type data is the one of the item type, the fields are checked by TypeDataForm.Validate
+func typeDataRule(itemType string) validation.Rule {
+	return validation.By(func(value interface{}) error {
+		typeData, _ := value.(*TypeDataForm)
+		if itemType == "" {
+			itemType = ItemLogin
+		}
+
+		present := map[string]bool{}
+		if typeData != nil {
+			present[ItemCard] = typeData.Card != nil
+			present[ItemIdentity] = typeData.Identity != nil
+			present[ItemSSHKey] = typeData.SSHKey != nil
+			present[ItemAPIKey] = typeData.APIKey != nil
+		}
+
+		for _, rawDataType := range itemTypes {
+			dataType := rawDataType.(string)
+			if present[dataType] && dataType != itemType {
+				return fmt.Errorf("%s data isn't allowed for the %s type", dataType, itemType)
+			}
+		}
+		switch itemType {
+		case ItemCard, ItemIdentity, ItemSSHKey, ItemAPIKey:
+			if !present[itemType] {
+				return fmt.Errorf("%s data is required", itemType)
+			}
+		}
+		return nil
+	})
+}
+
+// ValidateItemType checks the type filter of the list, the empty type is every type.
+func ValidateItemType(itemType string) error {
+	if err := validation.Validate(itemType, validation.In(itemTypes...)); err != nil {
+		return FieldError("type", err.Error())
+	}
+	return nil
+}
+
+// itemTypeValues returns the columns item_type and type_data_json, the empty type is login.
+func itemTypeValues(itemType string, typeData *TypeDataForm) (string, []byte) {
+	if itemType == "" {
+		itemType = ItemLogin
+	}
+	if typeData == nil {
+		return itemType, nil
+	}
+	bytesTypeData, _ := json.Marshal(typeData)
+	return itemType, bytesTypeData
+}
+
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
@@ -0,0 +1,154 @@
+package secrets
+
+import (
+	"app-ez-pwd/internal/events"
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/storage"
+	"context"
+	"encoding/json"
+	"fmt"
+	sq "github.com/Masterminds/squirrel"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+)
+
+// VaultSecretForm is a secret encrypted again with the new vault key, for the accounts that encrypted
+// the secrets with the key derived from the password. Only the encrypted fields change.
+type VaultSecretForm struct {
+	Id                int                  `json:"id"`
+	Version           int                  `json:"version"` // the version the client encrypted again
+	PasswordEncrypted EncryptedPayloadForm `json:"passwordEncrypted"`
+	SafeNoteEncrypted EncryptedPayloadForm `json:"safeNoteEncrypted"`
+	Type              string               `json:"type"`
+	TypeData          *TypeDataForm        `json:"typeData"`
+	CustomFields      []CustomFieldForm    `json:"customFields"`
+	TOTP              *TOTPForm            `json:"totp"`
+}
+
+func (f VaultSecretForm) Validate() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Id, validation.Required),
+		validation.Field(&f.Version, validation.Required),
+		validation.Field(&f.PasswordEncrypted),
+		validation.Field(&f.SafeNoteEncrypted, validation.When(f.Type == ItemSecureNote, requiredPayload)),
+		validation.Field(&f.Type, validation.In(itemTypes...)),
+		validation.Field(&f.TypeData, typeDataRule(f.Type)),
+		validation.Field(&f.CustomFields, validation.Length(0, maxCustomFields)),
+		validation.Field(&f.TOTP))
+}
+
+func (f VaultSecretForm) columns() map[string]interface{} {
+	bytesPasswordEncrypted, _ := json.Marshal(f.PasswordEncrypted)
+	bytesSafeNoteEncrypted, _ := json.Marshal(f.SafeNoteEncrypted)
+	itemType, bytesTypeData := itemTypeValues(f.Type, f.TypeData)
+
+	return map[string]interface{}{
+		"password_json":      bytesPasswordEncrypted,
+		"safe_note_json":     bytesSafeNoteEncrypted,
+		"item_type":          itemType,
+		"type_data_json":     bytesTypeData,
+		"custom_fields_json": customFieldsValue(f.CustomFields),
+		"totp_json":          totpValue(f.TOTP),
+	}
+}
+
+// MigrateVaultKeyDB saves the secrets encrypted with the vault key and the user columns of the vault key
+// (userColumns) in one transaction: the secrets and the key never disagree. Every secret of the user
+// must be in the migration at its current version, the conflict has the current secret.
+func MigrateVaultKeyDB(userId int, userColumns map[string]interface{}, vaultSecrets []VaultSecretForm) error {
+	lockUser, lockUserArgs, _ := storage.ApplicationDB.Psql.
+		Select("wrapped_vault_key IS NOT NULL").
+		From("users").
+		Where(sq.Eq{
+			"id": userId,
+		}).Suffix("FOR UPDATE").ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return internalError(err)
+	}
+
+	var hasVaultKey bool
+	if err = tx.QueryRow(context.Background(), lockUser, lockUserArgs...).Scan(&hasVaultKey); err != nil {
+		logger.Logger.Error("err lock user", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return internalError(err)
+	}
+	if hasVaultKey {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return &Error{Kind: KindConflict, Message: "the account already has a vault key"}
+	}
+
+	secretEvents := make([]events.Event, 0, len(vaultSecrets))
+	for _, vaultSecret := range vaultSecrets {
+		newVersion, err := migrateSecretTx(tx, userId, vaultSecret)
+		if err != nil {
+			_ = storage.ApplicationDB.Rollback(cn, tx)
+			return err
+		}
+		secretEvents = append(secretEvents, events.Event{Type: events.SecretUpdated, UserId: userId, EntityId: vaultSecret.Id, Version: newVersion})
+	}
+
+	// the secrets written by this transaction have its txid: the rest wasn't encrypted again
+	selectRemaining, selectRemainingArgs, _ := storage.ApplicationDB.Psql.
+		Select("COUNT(*)").
+		From("user_secrets").
+		Where(sq.Eq{
+			"user_id": userId,
+		}).
+		Where("sync_txid <> txid_current()").ToSql()
+
+	var remaining int
+	if err = tx.QueryRow(context.Background(), selectRemaining, selectRemainingArgs...).Scan(&remaining); err != nil {
+		logger.Logger.Error("err scan", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return internalError(err)
+	}
+	if remaining > 0 {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return &Error{Kind: KindConflict, Message: fmt.Sprintf("%d secrets aren't in the migration", remaining)}
+	}
+
+	updateUser, updateUserArgs, _ := storage.ApplicationDB.Psql.Update("users").
+		SetMap(userColumns).
+		Where(sq.Eq{
+			"id": userId,
+		}).ToSql()
+
+	if _, err = tx.Exec(context.Background(), updateUser, updateUserArgs...); err != nil {
+		logger.Logger.Error("err update vault key", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return internalError(err)
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return internalError(err)
+	}
+
+	for _, event := range secretEvents {
+		events.Hub.Publish(event)
+	}
+	return nil
+}
+
+func migrateSecretTx(tx pgx.Tx, userId int, vaultSecret VaultSecretForm) (int, error) {
+	updateSecret, updateSecretArgs, _ := storage.ApplicationDB.Psql.Update("user_secrets").
+		SetMap(touchedColumns(vaultSecret.columns())).
+		Where(sq.Eq{
+			"id":      vaultSecret.Id,
+			"user_id": userId,
+			"version": vaultSecret.Version,
+		}).Suffix("RETURNING version").ToSql()
+
+	var newVersion int
+	err := tx.QueryRow(context.Background(), updateSecret, updateSecretArgs...).Scan(&newVersion)
+	if err == pgx.ErrNoRows {
+		return 0, versionConflictTx(tx, userId, vaultSecret.Id)
+	}
+	if err != nil {
+		logger.Logger.Error("err migrate secret", zap.Error(err))
+		return 0, internalError(err)
+	}
+	return newVersion, nil
+}
@@ -0,0 +1,128 @@
+// Package sends shares a payload encrypted by the client with a link: the key is in the url fragment,
+// the server only keeps the ciphertext until the views or the expiration end.
+package sends
+
+import (
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/secrets"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/go-ozzo/ozzo-validation/v4/is"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"time"
+)
+
+const (
+	maxExpirationHours = 30 * 24
+	maxViews           = 1000
+	maxPayloadBytes    = 64 * 1024
+
+	// CleanupInterval is how often the expired sends are deleted.
+	CleanupInterval = 10 * time.Minute
+)
+
+var (
+	ErrNotFound         = errors.New("the send doesn't exist or it expired")
+	ErrPasswordRequired = errors.New("the send requires the access password")
+	ErrInvalidPassword  = errors.New("invalid access password")
+)
+
+// SendModel is the send for its owner, without the payload.
+type SendModel struct {
+	Id          string    `json:"id"`
+	Name        string    `json:"name"`
+	MaxViews    *int      `json:"maxViews"` // null is unlimited
+	ViewCount   int       `json:"viewCount"`
+	HasPassword bool      `json:"hasPassword"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// SendContentModel is the answer of the public link.
+type SendContentModel struct {
+	PayloadEncrypted json.RawMessage `json:"payloadEncrypted"`
+	ViewsLeft        *int            `json:"viewsLeft"` // null is unlimited, 0 was the last view
+	ExpiresAt        time.Time       `json:"expiresAt"`
+}
+
+type SendForm struct {
+	Name             string                       `json:"name"` // only for the owner list, plaintext
+	PayloadEncrypted secrets.EncryptedPayloadForm `json:"payloadEncrypted"`
+	MaxViews         int                          `json:"maxViews"` // 0 is unlimited
+	ExpirationHours  int                          `json:"expirationHours"`
+	PasswordHash     string                       `json:"passwordHash"` // optional, the sha256 of the access password in hex
+}
+
+func (f SendForm) ValidateFront() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Name, validation.Length(0, 100)),
+		validation.Field(&f.PayloadEncrypted, validation.By(func(value interface{}) error {
+			if len(f.PayloadEncrypted.Encrypted) == 0 {
+				return errors.New("cannot be blank")
+			}
+			if len(f.PayloadEncrypted.Encrypted) > maxPayloadBytes {
+				return errors.New("the payload is too big")
+			}
+			return nil
+		})),
+		validation.Field(&f.MaxViews, validation.Min(0), validation.Max(maxViews)),
+		validation.Field(&f.ExpirationHours, validation.Required, validation.Min(1), validation.Max(maxExpirationHours)),
+		validation.Field(&f.PasswordHash, validation.Length(64, 64), is.Hexadecimal))
+}
+
+func (f SendForm) Save(userId int) (SendModel, error) {
+	bytesPayload, _ := json.Marshal(f.PayloadEncrypted)
+
+	var passwordHash []byte
+	if f.PasswordHash != "" {
+		var err error
+		passwordHash, err = bcrypt.GenerateFromPassword([]byte(f.PasswordHash), bcrypt.DefaultCost)
+		if err != nil {
+			return SendModel{}, err
+		}
+	}
+
+	var maxViews *int
+	if f.MaxViews > 0 {
+		maxViews = &f.MaxViews
+	}
+
+	sendId, err := newSendId()
+	if err != nil {
+		return SendModel{}, err
+	}
+
+	return SaveSendDB(NewSendModel{
+		Id:           sendId,
+		UserId:       userId,
+		Name:         f.Name,
+		Payload:      bytesPayload,
+		PasswordHash: passwordHash,
+		MaxViews:     maxViews,
+		ExpiresAt:    time.Now().Add(time.Duration(f.ExpirationHours) * time.Hour),
+	})
+}
+
+// newSendId is the id of the link, 128 random bits in base64 url.
+func newSendId() (string, error) {
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// Cleanup deletes the expired sends, it's run by a job: the sends without views left are
+// deleted with the last view.
+func Cleanup() {
+	deleted, err := DeleteExpiredSendsDB()
+	if err != nil {
+		logger.Logger.Error("err cleanup sends", zap.Error(err))
+	} else if deleted > 0 {
+		logger.Logger.Info("expired sends deleted", zap.Int64("deleted", deleted))
+	}
+}
@@ -0,0 +1,252 @@
+package sends
+
+import (
+	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/storage"
+	"context"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"time"
+)
+
+type NewSendModel struct {
+	Id           string
+	UserId       int
+	Name         string
+	Payload      []byte
+	PasswordHash []byte // bcrypt, nil without password
+	MaxViews     *int
+	ExpiresAt    time.Time
+}
+
+func SaveSendDB(newSend NewSendModel) (SendModel, error) {
+	send := SendModel{
+		Id:          newSend.Id,
+		Name:        newSend.Name,
+		MaxViews:    newSend.MaxViews,
+		HasPassword: newSend.PasswordHash != nil,
+		ExpiresAt:   newSend.ExpiresAt,
+	}
+
+	var passwordHash interface{}
+	if newSend.PasswordHash != nil {
+		passwordHash = string(newSend.PasswordHash)
+	}
+
+	insertSend, insertSendArgs, _ := storage.ApplicationDB.Psql.Insert("sends").
+		SetMap(map[string]interface{}{
+			"id":            newSend.Id,
+			"user_id":       newSend.UserId,
+			"name":          newSend.Name,
+			"payload_json":  newSend.Payload,
+			"password_hash": passwordHash,
+			"max_views":     newSend.MaxViews,
+			"expires_at":    newSend.ExpiresAt,
+		}).Suffix("RETURNING created_at").ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return send, err
+	}
+
+	if err = tx.QueryRow(context.Background(), insertSend, insertSendArgs...).Scan(&send.CreatedAt); err != nil {
+		logger.Logger.Error("err insert send", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return send, err
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return send, err
+	}
+	return send, nil
+}
+
+// ListSendsDB lists the sends of the user that didn't expire.
+func ListSendsDB(userId int) ([]SendModel, error) {
+	userSends := make([]SendModel, 0)
+
+	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.
+		Select("id", "name", "max_views", "view_count", "password_hash IS NOT NULL", "expires_at", "created_at").
+		From("sends").
+		Where(sq.Eq{
+			"user_id": userId,
+		}).
+		Where("expires_at > CURRENT_TIMESTAMP").
+		OrderBy("created_at DESC").ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return userSends, err
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	rows, err := tx.Query(context.Background(), selectQry, selectQryArgs...)
+	if err != nil {
+		logger.Logger.Error("err query sends", zap.Error(err))
+		return userSends, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var send SendModel
+		err = rows.Scan(&send.Id, &send.Name, &send.MaxViews, &send.ViewCount, &send.HasPassword, &send.ExpiresAt, &send.CreatedAt)
+		if err != nil {
+			logger.Logger.Error("err scan send", zap.Error(err))
+			return userSends, err
+		}
+		userSends = append(userSends, send)
+	}
+	return userSends, rows.Err()
+}
+
+func DeleteSendDB(userId int, sendId string) error {
+	deleteQry, deleteArgs, _ := storage.ApplicationDB.Psql.Delete("sends").Where(sq.Eq{
+		"id":      sendId,
+		"user_id": userId,
+	}).ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(context.Background(), deleteQry, deleteArgs...)
+	if err != nil {
+		logger.Logger.Error("err delete send", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return ErrNotFound
+	}
+
+	return storage.ApplicationDB.Commit(cn, tx)
+}
+
+// checkSendPasswordDB compares the access password before ViewSendDB locks the row:
+// bcrypt is slow, the wrong guesses must not block the readers with the right password.
+func checkSendPasswordDB(sendId, accessPasswordHash string) error {
+	selectQry, selectQryArgs, _ := storage.ApplicationDB.Psql.
+		Select("password_hash").
+		From("sends").
+		Where(sq.Eq{
+			"id": sendId,
+		}).
+		Where("expires_at > CURRENT_TIMESTAMP").ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer storage.ApplicationDB.Rollback(cn, tx)
+
+	var passwordHash *string
+	err = tx.QueryRow(context.Background(), selectQry, selectQryArgs...).Scan(&passwordHash)
+	if err == pgx.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		logger.Logger.Error("err scan send", zap.Error(err))
+		return err
+	}
+
+	if passwordHash == nil {
+		return nil
+	}
+	if accessPasswordHash == "" {
+		return ErrPasswordRequired
+	}
+	if bcrypt.CompareHashAndPassword([]byte(*passwordHash), []byte(accessPasswordHash)) != nil {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// ViewSendDB returns the payload and counts the view, the last view deletes the send.
+// The row is locked after the password check so two readers can't use the same last view.
+func ViewSendDB(sendId, accessPasswordHash string) (SendContentModel, error) {
+	var content SendContentModel
+
+	if err := checkSendPasswordDB(sendId, accessPasswordHash); err != nil {
+		return content, err
+	}
+
+	selectSend, selectSendArgs, _ := storage.ApplicationDB.Psql.
+		Select("payload_json", "max_views", "view_count", "expires_at").
+		From("sends").
+		Where(sq.Eq{
+			"id": sendId,
+		}).
+		Where("expires_at > CURRENT_TIMESTAMP").
+		Suffix("FOR UPDATE").ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return content, err
+	}
+
+	// the send can be deleted by the last view or the cleanup between the two selects
+	var maxViews *int
+	var viewCount int
+	err = tx.QueryRow(context.Background(), selectSend, selectSendArgs...).
+		Scan(&content.PayloadEncrypted, &maxViews, &viewCount, &content.ExpiresAt)
+	if err == pgx.ErrNoRows {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return content, ErrNotFound
+	}
+	if err != nil {
+		logger.Logger.Error("err scan send", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return content, err
+	}
+
+	var changeQry string
+	var changeQryArgs []interface{}
+	if maxViews != nil && viewCount+1 >= *maxViews {
+		changeQry, changeQryArgs, _ = storage.ApplicationDB.Psql.Delete("sends").Where(sq.Eq{"id": sendId}).ToSql()
+	} else {
+		changeQry, changeQryArgs, _ = storage.ApplicationDB.Psql.Update("sends").
+			Set("view_count", sq.Expr("view_count + 1")).
+			Where(sq.Eq{"id": sendId}).ToSql()
+	}
+
+	if _, err = tx.Exec(context.Background(), changeQry, changeQryArgs...); err != nil {
+		logger.Logger.Error("err count send view", zap.Error(err))
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return SendContentModel{}, err
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return SendContentModel{}, err
+	}
+
+	if maxViews != nil {
+		viewsLeft := *maxViews - viewCount - 1
+		content.ViewsLeft = &viewsLeft
+	}
+	return content, nil
+}
+
+func DeleteExpiredSendsDB() (int64, error) {
+	deleteQry, deleteArgs, _ := storage.ApplicationDB.Psql.Delete("sends").
+		Where("expires_at <= CURRENT_TIMESTAMP").ToSql()
+
+	cn, tx, err := storage.ApplicationDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(context.Background(), deleteQry, deleteArgs...)
+	if err != nil {
+		_ = storage.ApplicationDB.Rollback(cn, tx)
+		return 0, err
+	}
+
+	if err = storage.ApplicationDB.Commit(cn, tx); err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
@@ -2,18 +2,42 @@ package settings
 
 import (
 	"app-ez-pwd/internal/logger"
+	"app-ez-pwd/internal/objectstore"
 	"encoding/json"
 	"go.uber.org/zap"
 	"io"
 	"os"
 )
 
+// AppVersion is set at build time with -ldflags "-X app-ez-pwd/internal/settings.AppVersion=..."
+var AppVersion = "dev"
+
 var Settings struct {
 	SecretHex       string `json:"SECRET_HEX"`
 	ApiHostPort     string `json:"API_HOST_PORT"`
 	DatabaseURL     string `json:"DATABASE_URL"`
 	CookieWebDomain string `json:"COOKIE_WEB_DOMAIN"`
 	Debug           bool   `json:"DEBUG"`
+	EventsBroker    string `json:"EVENTS_BROKER"` // memory (default) or postgres for more than one instance
+
+	BackupSchedule BackupScheduleSettings `json:"BACKUP_SCHEDULE"`
+	Attachments    AttachmentsSettings    `json:"ATTACHMENTS"`
+}
+
+type BackupScheduleSettings struct {
+	IntervalMinutes  int                `json:"INTERVAL_MINUTES"` // 0 disables the scheduled backups
+	Mode             string             `json:"MODE"`             // users (default): a zip per user, database: every table
+	ExcludeLoginHash bool               `json:"EXCLUDE_LOGIN_HASH"`
+	PublicKey        string             `json:"PUBLIC_KEY"`      // X25519 in base64, the database backups are encrypted to it
+	RetentionCount   int                `json:"RETENTION_COUNT"` // backups kept per user or of the database, 0 keeps all
+	RetentionDays    int                `json:"RETENTION_DAYS"`  // older backups are deleted, the newest is always kept
+	Store            objectstore.Config `json:"STORE"`
+}
+
+type AttachmentsSettings struct {
+	MaxFileMB int                `json:"MAX_FILE_MB"` // 25 by default
+	QuotaMB   int                `json:"QUOTA_MB"`    // per user, 100 by default
+	Store     objectstore.Config `json:"STORE"`       // without store the attachments are disabled
 }
 
 func LoadConfiguration() {
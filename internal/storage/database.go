@@ -23,12 +23,17 @@ func PrepareApplicationDB(connString string) ApplicationDatabase {
 }
 
 func (db ApplicationDatabase) Begin() (*pgx.Conn, pgx.Tx, error) {
+	return db.BeginTx(pgx.TxOptions{})
+}
+
+// BeginTx is Begin with the isolation level and access mode, ex: the snapshot reads of the sync.
+func (db ApplicationDatabase) BeginTx(txOptions pgx.TxOptions) (*pgx.Conn, pgx.Tx, error) {
 	cn, err := pgx.Connect(context.Background(), db.ConnString)
 	if err != nil {
 		logger.Logger.Error("pgx err connection", zap.Error(err))
 		return cn, nil, err
 	}
-	tx, err := cn.Begin(context.Background())
+	tx, err := cn.BeginTx(context.Background(), txOptions)
 	return cn, tx, err
 }
 
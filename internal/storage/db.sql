@@ -2,16 +2,49 @@ CREATE TABLE users (
     id SERIAL PRIMARY KEY,
     username VARCHAR(50) NOT NULL ,
     password_hash VARCHAR(500) NOT NULL ,
+    backup_public_key VARCHAR(100), -- X25519 in base64 for the encrypted backups
+    user_type VARCHAR(10) NOT NULL DEFAULT 'USER', -- USER or ADMIN
+    key_algorithm VARCHAR(20), -- RSA-OAEP-256
+    public_key VARCHAR(1000), -- SPKI in base64, to wrap the keys of the secrets shared with the user
+    private_key_json JSONB, -- encrypted by the client
+    wrapped_vault_key JSONB, -- the vault key encrypted with the key of the password
+    kdf_type VARCHAR(10), -- PBKDF2, Argon2id of the password key
+    kdf_params_json JSONB, -- {"type", "salt", "iterations", "memoryKiB", "parallelism"}
+    recovery_verifier VARCHAR(500), -- bcrypt of the proof of the recovery key
+    recovery_wrapped_key JSONB, -- the vault key encrypted with the recovery key
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
-CREATE TABLE secret_categories (
+CREATE TABLE organizations (
     id SERIAL PRIMARY KEY,
-    name VARCHAR(50) NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- the org key is generated by the client and wrapped with the public key of every member.
+CREATE TABLE organization_members (
+    organization_id INTEGER NOT NULL,
     user_id INTEGER NOT NULL,
+    role VARCHAR(10) NOT NULL, -- owner, admin, member, readonly
+    wrapped_org_key VARCHAR(2000) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (organization_id, user_id),
+    CONSTRAINT fk_organization_id FOREIGN KEY (organization_id) REFERENCES organizations(id) ON DELETE CASCADE,
     CONSTRAINT fk_user_id FOREIGN KEY (user_id) REFERENCES users(id)
 );
 
+-- the categories and the secrets belong to a user or to an organization.
+CREATE TABLE secret_categories (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(50) NOT NULL,
+    user_id INTEGER,
+    organization_id INTEGER,
+    sync_txid BIGINT NOT NULL DEFAULT txid_current(),
+    CONSTRAINT fk_user_id FOREIGN KEY (user_id) REFERENCES users(id),
+    CONSTRAINT fk_organization_id FOREIGN KEY (organization_id) REFERENCES organizations(id),
+    CONSTRAINT chk_owner CHECK ((user_id IS NULL) <> (organization_id IS NULL))
+);
+
 CREATE TABLE user_secrets(
     id SERIAL PRIMARY KEY,
     description VARCHAR(250),
@@ -19,9 +52,152 @@ CREATE TABLE user_secrets(
     password_json JSONB,
     safe_note_json JSONB,
     url_site VARCHAR(250),
+    item_type VARCHAR(20) NOT NULL DEFAULT 'login', -- login, card, identity, sshKey, apiKey, secureNote
+    type_data_json JSONB, -- the fields of the type, the secret ones encrypted by the client
+    custom_fields_json JSONB, -- [{"name", "type", "valueEncrypted"}]
+    totp_json JSONB, -- {"seedEncrypted", "period", "digits", "algorithm"}, the parameters in plaintext
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    version INTEGER NOT NULL DEFAULT 1,
+    sync_txid BIGINT NOT NULL DEFAULT txid_current(),
     category_id INTEGER NOT NULL,
-    user_id INTEGER NOT NULL,
+    user_id INTEGER,
+    organization_id INTEGER,
     CONSTRAINT fk_categories FOREIGN KEY(category_id) REFERENCES secret_categories(id),
+    CONSTRAINT fk_user_id FOREIGN KEY (user_id) REFERENCES users(id),
+    CONSTRAINT fk_organization_id FOREIGN KEY (organization_id) REFERENCES organizations(id),
+    CONSTRAINT chk_owner CHECK ((user_id IS NULL) <> (organization_id IS NULL))
+);
+
+CREATE TABLE user_secret_tags(
+    secret_id INTEGER NOT NULL,
+    name VARCHAR(50) NOT NULL,
+    PRIMARY KEY (secret_id, name),
+    CONSTRAINT fk_secret_id FOREIGN KEY (secret_id) REFERENCES user_secrets(id) ON DELETE CASCADE
+);
+
+-- the content is encrypted by the client and saved in the attachments store with object_key,
+-- secret_id is NULL after the secret is deleted until the blob is deleted.
+CREATE TABLE secret_attachments(
+    id SERIAL PRIMARY KEY,
+    secret_id INTEGER,
+    user_id INTEGER NOT NULL,
+    file_name_json JSONB NOT NULL, -- encrypted by the client
+    size BIGINT NOT NULL,
+    sha256 VARCHAR(64) NOT NULL, -- of the encrypted content
+    object_key VARCHAR(250) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_secret_id FOREIGN KEY (secret_id) REFERENCES user_secrets(id) ON DELETE SET NULL,
     CONSTRAINT fk_user_id FOREIGN KEY (user_id) REFERENCES users(id)
 );
+
+-- the copy of the secret encrypted with the share key, the share key is wrapped with the public keys
+-- of the recipient and of the owner.
+CREATE TABLE secret_shares(
+    id SERIAL PRIMARY KEY,
+    secret_id INTEGER NOT NULL,
+    owner_id INTEGER NOT NULL,
+    recipient_id INTEGER NOT NULL,
+    permission VARCHAR(10) NOT NULL, -- read, edit
+    wrapped_key VARCHAR(2000) NOT NULL,
+    owner_wrapped_key VARCHAR(2000) NOT NULL,
+    description VARCHAR(250),
+    username VARCHAR(250),
+    password_json JSONB,
+    safe_note_json JSONB,
+    url_site VARCHAR(250),
+    item_type VARCHAR(20) NOT NULL DEFAULT 'login',
+    type_data_json JSONB,
+    custom_fields_json JSONB,
+    totp_json JSONB,
+    stale BOOLEAN NOT NULL DEFAULT false, -- the owner changed the secret after the copy
+    version INTEGER NOT NULL DEFAULT 1,
+    sync_txid BIGINT NOT NULL DEFAULT txid_current(),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (secret_id, recipient_id),
+    CONSTRAINT fk_secret_id FOREIGN KEY (secret_id) REFERENCES user_secrets(id) ON DELETE CASCADE,
+    CONSTRAINT fk_owner_id FOREIGN KEY (owner_id) REFERENCES users(id),
+    CONSTRAINT fk_recipient_id FOREIGN KEY (recipient_id) REFERENCES users(id)
+);
+
+-- the trusted contact (grantee) reads the vault of the grantor after the grantor approves the request
+-- or after wait_days without rejecting it.
+CREATE TABLE emergency_access(
+    id SERIAL PRIMARY KEY,
+    grantor_id INTEGER NOT NULL,
+    grantee_id INTEGER NOT NULL,
+    wait_days INTEGER NOT NULL,
+    status VARCHAR(10) NOT NULL, -- granted, requested, approved
+    wrapped_key VARCHAR(2000) NOT NULL, -- the vault key of the grantor wrapped with the grantee public key
+    requested_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (grantor_id, grantee_id),
+    CONSTRAINT fk_grantor_id FOREIGN KEY (grantor_id) REFERENCES users(id),
+    CONSTRAINT fk_grantee_id FOREIGN KEY (grantee_id) REFERENCES users(id)
+);
+
+-- without foreign key to the access: the entries are kept after it's revoked.
+CREATE TABLE emergency_access_audit(
+    id SERIAL PRIMARY KEY,
+    access_id INTEGER NOT NULL,
+    grantor_id INTEGER NOT NULL,
+    grantee_id INTEGER NOT NULL,
+    action VARCHAR(20) NOT NULL, -- granted, requested, approved, rejected, approved_by_timeout, viewed, revoked, reset
+    actor_id INTEGER, -- NULL for the timeout
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- the payload is encrypted by the client, the key is only in the url fragment of the link.
+-- the last view deletes the send, the cleanup job deletes the expired ones.
+CREATE TABLE sends(
+    id VARCHAR(50) PRIMARY KEY, -- random, it's the link
+    user_id INTEGER NOT NULL,
+    name VARCHAR(100),
+    payload_json JSONB NOT NULL,
+    password_hash VARCHAR(500), -- bcrypt of the sha256 access password, NULL without password
+    max_views INTEGER, -- NULL is unlimited
+    view_count INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_user_id FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- sync_txid is the transaction of the last write, the sync token is the xmin of the reader snapshot
+-- so the rows written by transactions still running are sent in the next sync.
+-- The tombstones of the organization secrets are for every member, full asks the user for a full sync.
+CREATE TABLE sync_tombstones(
+    id SERIAL PRIMARY KEY,
+    entity VARCHAR(20) NOT NULL, -- category, secret, share, full
+    entity_id INTEGER NOT NULL,
+    user_id INTEGER,
+    organization_id INTEGER,
+    sync_txid BIGINT NOT NULL DEFAULT txid_current(),
+    deleted_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_user_id FOREIGN KEY (user_id) REFERENCES users(id),
+    CONSTRAINT fk_organization_id FOREIGN KEY (organization_id) REFERENCES organizations(id) ON DELETE CASCADE,
+    CONSTRAINT chk_owner CHECK ((user_id IS NULL) <> (organization_id IS NULL))
+);
+
+-- the interval of the last scheduled backups, saved by the instance that writes them.
+CREATE TABLE backup_runs(
+    interval_start TIMESTAMP WITH TIME ZONE PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_secret_categories_sync ON secret_categories(user_id, sync_txid);
+CREATE INDEX idx_user_secrets_sync ON user_secrets(user_id, sync_txid);
+CREATE INDEX idx_sync_tombstones_sync ON sync_tombstones(user_id, sync_txid);
+CREATE INDEX idx_sync_tombstones_organization_sync ON sync_tombstones(organization_id, sync_txid);
+CREATE INDEX idx_secret_attachments_secret ON secret_attachments(secret_id);
+CREATE INDEX idx_secret_attachments_user ON secret_attachments(user_id);
+CREATE INDEX idx_secret_shares_recipient ON secret_shares(recipient_id, sync_txid);
+CREATE INDEX idx_organization_members_user ON organization_members(user_id);
+CREATE INDEX idx_secret_categories_organization ON secret_categories(organization_id);
+CREATE INDEX idx_user_secrets_organization ON user_secrets(organization_id);
+CREATE INDEX idx_sends_user ON sends(user_id);
+CREATE INDEX idx_sends_expires ON sends(expires_at);
+CREATE INDEX idx_emergency_access_grantee ON emergency_access(grantee_id);
+CREATE INDEX idx_emergency_access_requested ON emergency_access(status, requested_at);
+CREATE INDEX idx_emergency_access_audit_access ON emergency_access_audit(access_id);